@@ -0,0 +1,179 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Request is embedded by events that expect a reply, see Ask. The state
+	// func that handles a request answers it via Reply or Fail, exactly once:
+	//
+	//	type ConnectRequest struct{ state.Request }
+	//
+	//	case *ConnectRequest:
+	//		e.Reply(true)
+	Request struct {
+		AbstractEvent
+		p *pending
+	}
+
+	// Requester is implemented by events that embed Request.
+	Requester interface {
+		Event
+		request() *Request
+	}
+
+	// pending is referenced by the request only, so that it's garbage
+	// collected (and the request reported as dropped, unless it was answered)
+	// once the request is.
+	pending struct {
+		once  sync.Once
+		reply chan reply
+		asker *asker
+	}
+
+	// asker is shared by the request and the caller of Ask.
+	asker struct {
+		abandoned int32
+	}
+
+	reply struct {
+		value interface{}
+		err   error
+	}
+)
+
+var (
+	// ErrTimeout is returned when a deadline expires before an operation
+	// completes.
+	ErrTimeout = errors.New("timed out")
+	// ErrDropped is returned by Ask when a request is discarded, by the
+	// handler or along with the queue of a terminated machine, without a reply.
+	ErrDropped = errors.New("request dropped without a reply")
+
+	// Request implements Requester
+	_ Requester = &Request{}
+)
+
+func (r *Request) request() *Request { return r }
+
+// Reply answers a request with a value. Returns false if the request was
+// already answered, wasn't sent by Ask, or if the caller of Ask gave up
+// waiting for the reply.
+func (r *Request) Reply(value interface{}) bool { return r.respond(reply{value: value}) }
+
+// Fail answers a request with an error, see Reply.
+func (r *Request) Fail(err error) bool { return r.respond(reply{err: err}) }
+
+func (r *Request) respond(rep reply) bool {
+	if r.p == nil {
+		return false
+	}
+	return r.p.respond(rep)
+}
+
+func (p *pending) respond(rep reply) (ok bool) {
+	p.once.Do(func() {
+		p.reply <- rep // buffered
+		ok = atomic.LoadInt32(&p.asker.abandoned) == 0
+	})
+	return
+}
+
+// Discard fails a request with ErrDropped, and ignores other events. State
+// funcs invoke it for the events that they don't handle, so that callers of
+// Ask learn that their requests were dropped; Loop does so for the events
+// that it has no Handler for.
+func Discard(e Event) {
+	if r, ok := e.(Requester); ok {
+		r.request().Fail(ErrDropped)
+	}
+}
+
+// DiscardQueued discards (see Discard) the events that are queued by the
+// Source of a terminated machine, that won't be read anymore; returns the
+// number of discarded events. Registry.Run and Host.Run invoke it for the
+// machines that they run.
+func DiscardQueued(m EventSource) int {
+	events := drain(m)
+	for _, e := range events {
+		Discard(e)
+	}
+	return len(events)
+}
+
+// Ask sends a request to a machine and waits for its reply, which must be of
+// type T. The wait is bounded by the Context and, unless zero, by the
+// timeout: ErrCancelled or ErrTimeout is returned if either is exceeded
+// before the request is queued or answered. ErrDropped is returned if the
+// request is discarded without a reply, see Discard and DiscardQueued; as a
+// last resort, requests that are dropped otherwise are detected once they're
+// garbage collected, so callers that can't afford to wait for that should
+// specify a timeout. A request may only be asked once.
+func Ask[T any](ctx Context, m EventSink, req Requester, timeout time.Duration) (T, error) {
+	var (
+		zero    T
+		a       = &asker{}
+		replies = make(chan reply, 1)
+		expired <-chan time.Time
+	)
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	giveUp := func(err error) (T, error) {
+		atomic.StoreInt32(&a.abandoned, 1)
+		return zero, err
+	}
+	p := &pending{reply: replies, asker: a}
+	runtime.SetFinalizer(p, func(p *pending) { p.respond(reply{err: ErrDropped}) })
+	req.request().p = p
+	p = nil
+
+	select {
+	case m.Sink() <- req:
+	case <-ctx.Done():
+		return giveUp(ErrCancelled)
+	case <-expired:
+		return giveUp(ErrTimeout)
+	}
+	req = nil // from now on only the handler references the request
+
+	select {
+	case rep := <-replies:
+		if rep.err != nil {
+			return zero, rep.err
+		}
+		v, ok := rep.value.(T)
+		if !ok && rep.value != nil {
+			return zero, fmt.Errorf("unexpected reply of type %T, expected %T", rep.value, zero)
+		}
+		return v, nil
+	case <-ctx.Done():
+		return giveUp(ErrCancelled)
+	case <-expired:
+		return giveUp(ErrTimeout)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state_test
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+type lookupRequest struct {
+	state.Request
+	key string
+}
+
+func ExampleAsk() {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	directory := func(ctx state.Context, m state.Machine) state.Fn {
+		for {
+			select {
+			case e := <-m.Source():
+				if r, ok := e.(*lookupRequest); ok {
+					if r.key == "agent" {
+						r.Reply(42)
+					} else {
+						r.Fail(fmt.Errorf("unknown key %q", r.key))
+					}
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	m := state.NewSimpleMachine(0, directory)
+	go state.Run(ctx, m)
+
+	fmt.Println(state.Ask[int](ctx, m, &lookupRequest{key: "agent"}, time.Second))
+	fmt.Println(state.Ask[int](ctx, m, &lookupRequest{key: "nope"}, time.Second))
+	fmt.Println(state.Ask[string](ctx, m, &lookupRequest{key: "agent"}, time.Second))
+	// Output:
+	// 42 <nil>
+	// 0 unknown key "nope"
+	//  unexpected reply of type int, expected string
+}
+
+func TestAsk_dropped(t *testing.T) {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	m := state.NewSimpleMachine(0, func(ctx state.Context, m state.Machine) state.Fn {
+		for {
+			select {
+			case <-m.Source(): // never replies
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	go state.Run(ctx, m)
+
+	done := make(chan error)
+	go func() {
+		_, err := state.Ask[bool](ctx, m, &lookupRequest{}, 0)
+		done <- err
+	}()
+	for {
+		runtime.GC() // drives the detection of dropped requests
+		select {
+		case err := <-done:
+			if !errors.Is(err, state.ErrDropped) {
+				t.Fatalf("expected ErrDropped, got %v", err)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestAsk_timeout(t *testing.T) {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	var (
+		m       = state.NewSimpleMachine(1, nil) // never read
+		r       = &lookupRequest{}
+		_, err  = state.Ask[bool](ctx, m, r, 10*time.Millisecond)
+		replied = r.Reply(true)
+	)
+	if err != state.ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if replied {
+		t.Fatal("reply to an abandoned request was accepted")
+	}
+	if _, err := state.Ask[bool](ctx, m, &lookupRequest{}, 10*time.Millisecond); err != state.ErrTimeout {
+		t.Fatalf("expected ErrTimeout while queueing, got %v", err)
+	}
+}
+
+func TestAsk_discarded(t *testing.T) {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	// requests that are left queued by a terminated machine are discarded
+	var (
+		m    = state.NewSimpleMachine(1, nil)
+		done = make(chan error)
+	)
+	go func() {
+		_, err := state.Ask[bool](ctx, m, &lookupRequest{}, time.Second)
+		done <- err
+	}()
+	for len(m.Source()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := state.DiscardQueued(m); n != 1 {
+		t.Fatalf("expected 1 discarded event, got %d", n)
+	}
+	if err := <-done; !errors.Is(err, state.ErrDropped) {
+		t.Fatalf("expected ErrDropped, got %v", err)
+	}
+}
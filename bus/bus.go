@@ -0,0 +1,233 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bus provides an in-process publish/subscribe bus: machines publish
+// events to topics and subscribe their Sink to topics, without knowing each
+// other. Every subscription buffers events on its own and forwards them to
+// the subscriber's Sink, so that a slow subscriber delays no one else, as
+// long as its Overflow policy doesn't block publishers.
+package bus
+
+import (
+	"sync"
+
+	"github.com/jdef/state"
+)
+
+type (
+	// Policy determines what happens to an event that's published while the
+	// buffer of a subscription is full.
+	Policy int
+
+	// Options configure a subscription.
+	Options struct {
+		// Buffer is the number of events that are buffered for the
+		// subscriber, in addition to the one that's being forwarded.
+		Buffer   int
+		Overflow Policy
+		// OnDrop, if not nil, is notified of the events that are dropped
+		// due to the Overflow policy.
+		OnDrop func(topic string, e state.Event)
+	}
+
+	// Bus delivers the events that are published to a topic to the Sink of
+	// every subscriber of the topic. The zero value is ready for use.
+	Bus struct {
+		mu   sync.Mutex
+		subs map[string]map[*Subscription]struct{}
+	}
+
+	// Subscription forwards the events of one or more topics to a Sink. It
+	// implements state.Observer: given to state.Run it cancels itself once the
+	// machine terminates.
+	Subscription struct {
+		bus    *Bus
+		topics []string
+		opts   Options
+		mu     sync.Mutex // serializes dropping publishers
+		queue  chan published
+		done   chan struct{}
+		once   sync.Once
+	}
+
+	published struct {
+		topic string
+		event state.Event
+	}
+)
+
+const (
+	// Block blocks the publisher until there's room in the buffer, or until
+	// its Context is done.
+	Block Policy = iota
+	// DropNewest drops the published event.
+	DropNewest
+	// DropOldest drops the oldest buffered event to make room. Without a
+	// Buffer there's no event to drop, so the published event is dropped
+	// instead, as with DropNewest.
+	DropOldest
+)
+
+// Subscription implements state.Observer
+var _ state.Observer = &Subscription{}
+
+// Subscribe subscribes a Sink to the given topics.
+func (b *Bus) Subscribe(sink state.EventSink, opts Options, topics ...string) *Subscription {
+	s := &Subscription{
+		bus:    b,
+		topics: topics,
+		opts:   opts,
+		queue:  make(chan published, opts.Buffer),
+		done:   make(chan struct{}),
+	}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = map[string]map[*Subscription]struct{}{}
+	}
+	for _, t := range topics {
+		if b.subs[t] == nil {
+			b.subs[t] = map[*Subscription]struct{}{}
+		}
+		b.subs[t][s] = struct{}{}
+	}
+	b.mu.Unlock()
+	go s.forward(sink.Sink())
+	return s
+}
+
+// Publish publishes an event to a topic, and returns the number of
+// subscriptions that accepted it. Subscriptions with the Block policy may
+// block Publish until the Context is done, in which case the remaining
+// subscriptions are skipped and state.ErrCancelled is returned.
+func (b *Bus) Publish(ctx state.Context, topic string, e state.Event) (int, error) {
+	b.mu.Lock()
+	subs := make([]*Subscription, 0, len(b.subs[topic]))
+	for s := range b.subs[topic] {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+
+	n := 0
+	for _, s := range subs {
+		ok, err := s.offer(ctx, published{topic, e})
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Subscribers returns the number of subscriptions to a topic.
+func (b *Bus) Subscribers(topic string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs[topic])
+}
+
+// offer queues a published event according to the overflow policy.
+func (s *Subscription) offer(ctx state.Context, p published) (bool, error) {
+	if s.opts.Overflow == Block {
+		select {
+		case s.queue <- p:
+			return true, nil
+		case <-s.done:
+			return false, nil
+		case <-ctx.Done():
+			return false, state.ErrCancelled
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		select {
+		case <-s.done:
+			return false, nil
+		case <-ctx.Done():
+			return false, state.ErrCancelled
+		case s.queue <- p:
+			return true, nil
+		default:
+		}
+		if s.opts.Overflow == DropNewest || cap(s.queue) == 0 {
+			// there's no buffered event to make room by dropping
+			s.dropped(p)
+			return false, nil
+		}
+		select {
+		case old := <-s.queue:
+			s.dropped(old)
+		default:
+			// the forwarder took the oldest event in the meantime
+		}
+	}
+}
+
+// dropped notifies OnDrop of a dropped event, and discards it so that the
+// asker of a dropped request isn't left waiting (see state.Discard).
+func (s *Subscription) dropped(p published) {
+	if s.opts.OnDrop != nil {
+		s.opts.OnDrop(p.topic, p.event)
+	}
+	state.Discard(p.event)
+}
+
+func (s *Subscription) forward(sink chan<- state.Event) {
+	for {
+		select {
+		case p := <-s.queue:
+			select {
+			case sink <- p.event:
+			case <-s.done:
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Topics returns the topics of the subscription.
+func (s *Subscription) Topics() []string { return append([]string(nil), s.topics...) }
+
+// Cancel removes the subscription from the bus; events that are buffered but
+// not yet forwarded are discarded. Cancel may be invoked multiple times.
+func (s *Subscription) Cancel() {
+	s.once.Do(func() {
+		b := s.bus
+		b.mu.Lock()
+		for _, t := range s.topics {
+			delete(b.subs[t], s)
+			if len(b.subs[t]) == 0 {
+				delete(b.subs, t)
+			}
+		}
+		b.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// Done returns a chan that closes once the subscription is cancelled.
+func (s *Subscription) Done() <-chan struct{} { return s.done }
+
+// Observe cancels the subscription once the machine terminates.
+func (s *Subscription) Observe(_ state.Fn, _ state.Event, to state.Fn) {
+	if to == nil {
+		s.Cancel()
+	}
+}
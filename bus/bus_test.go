@@ -0,0 +1,164 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bus
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+func TestSubscription_Overflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy             Policy
+		forwarded, dropped []string
+	}{
+		{DropNewest, []string{"1", "2"}, []string{"3", "4"}},
+		{DropOldest, []string{"1", "4"}, []string{"2", "3"}},
+	} {
+		var (
+			b       Bus
+			ctx     = make(state.SimpleContext)
+			m       = state.NewSimpleEvents(0)
+			dropped []string
+		)
+		s := b.Subscribe(m, Options{Buffer: 1, Overflow: tc.policy, OnDrop: func(topic string, e state.Event) {
+			dropped = append(dropped, state.EventName(e))
+		}}, "t")
+		publish := func(name string) {
+			if _, err := b.Publish(ctx, "t", &state.NamedEvent{Name: name}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		publish("1")
+		// wait for the forwarder to block upon the (unread) sink
+		for deadline := time.Now().Add(5 * time.Second); len(s.queue) > 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the forwarder")
+			}
+		}
+		for _, name := range []string{"2", "3", "4"} {
+			publish(name)
+		}
+
+		var forwarded []string
+		for range tc.forwarded {
+			forwarded = append(forwarded, state.EventName(<-m.Source()))
+		}
+		if !reflect.DeepEqual(forwarded, tc.forwarded) || !reflect.DeepEqual(dropped, tc.dropped) {
+			t.Errorf("policy %d: expected %v forwarded and %v dropped, got %v and %v",
+				tc.policy, tc.forwarded, tc.dropped, forwarded, dropped)
+		}
+		s.Cancel()
+		if n, _ := b.Publish(ctx, "t", &state.NamedEvent{Name: "5"}); n != 0 {
+			t.Errorf("policy %d: published to a cancelled subscription", tc.policy)
+		}
+	}
+}
+
+func TestSubscription_DropOldestUnbuffered(t *testing.T) {
+	var (
+		b       Bus
+		ctx     = make(state.SimpleContext)
+		dropped = 0
+	)
+	s := b.Subscribe(state.NewSimpleEvents(0), Options{Overflow: DropOldest, OnDrop: func(string, state.Event) {
+		dropped++
+	}}, "t") // never read
+	defer s.Cancel()
+
+	// the forwarder accepts at most one event, there's nothing to evict for
+	// the others
+	done := make(chan int)
+	go func() {
+		n := 0
+		for i := 0; i < 3; i++ {
+			k, err := b.Publish(ctx, "t", &state.NamedEvent{Name: "e"})
+			if err != nil {
+				t.Error(err)
+			}
+			n += k
+		}
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n > 1 || n+dropped != 3 {
+			t.Fatalf("expected at most 1 of 3 events accepted and the rest dropped, got %d accepted and %d dropped", n, dropped)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocks")
+	}
+}
+
+// publisher is an EventSink that publishes the events sent to it to topic t.
+type publisher chan state.Event
+
+func (p publisher) Sink() chan<- state.Event { return p }
+
+func TestSubscription_dropRequest(t *testing.T) {
+	var (
+		b   Bus
+		ctx = make(state.SimpleContext)
+		p   = make(publisher)
+	)
+	defer ctx.Cancel()
+	s := b.Subscribe(state.NewSimpleEvents(0), Options{Overflow: DropNewest}, "t") // never read
+	defer s.Cancel()
+	if _, err := b.Publish(ctx, "t", &state.NamedEvent{Name: "e"}); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the forwarder to block upon the sink
+	for deadline := time.Now().Add(5 * time.Second); len(s.queue) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the forwarder")
+		}
+	}
+	go func() {
+		if _, err := b.Publish(ctx, "t", <-p); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err := state.Ask[bool](ctx, p, &state.Request{}, 5*time.Second); !errors.Is(err, state.ErrDropped) {
+		t.Fatalf("expected ErrDropped, got %v", err)
+	}
+}
+
+func TestPublish_cancelled(t *testing.T) {
+	var (
+		b   Bus
+		ctx = make(state.SimpleContext)
+	)
+	b.Subscribe(state.NewSimpleEvents(0), Options{}, "t") // never read
+	done := make(chan error)
+	go func() {
+		for {
+			if _, err := b.Publish(ctx, "t", &state.NamedEvent{Name: "e"}); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ctx.Cancel()
+	if err := <-done; err != state.ErrCancelled {
+		t.Fatalf("expected ErrCancelled, got %v", err)
+	}
+}
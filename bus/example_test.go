@@ -0,0 +1,71 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bus_test
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/bus"
+)
+
+func Example() {
+	var (
+		b   bus.Bus
+		ctx = make(state.SimpleContext)
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		log []string
+	)
+	for _, name := range []string{"agent-1", "agent-2"} {
+		name := name
+		connected := func(ctx state.Context, m state.Machine) state.Fn {
+			select {
+			case e := <-m.Source():
+				mu.Lock()
+				log = append(log, name+" received "+state.EventName(e))
+				mu.Unlock()
+			case <-ctx.Done():
+			}
+			return nil
+		}
+		m := state.NewSimpleMachine(0, connected)
+		sub := b.Subscribe(m, bus.Options{Buffer: 1}, "cluster")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.Run(ctx, m, sub) // the subscription ends with the machine
+		}()
+	}
+
+	n, err := b.Publish(ctx, "cluster", &state.NamedEvent{Name: "DisconnectRequest"})
+	fmt.Println(n, err)
+	wg.Wait()
+
+	sort.Strings(log)
+	for _, line := range log {
+		fmt.Println(line)
+	}
+	fmt.Println(b.Subscribers("cluster"))
+	// Output:
+	// 2 <nil>
+	// agent-1 received DisconnectRequest
+	// agent-2 received DisconnectRequest
+	// 0
+}
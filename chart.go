@@ -0,0 +1,573 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+type (
+	// Chart is a declarative description of a hierarchical state machine, a
+	// statechart. States may be nested to any depth: a state with child states
+	// is a composite state, and while it's active exactly one of its children
+	// is active too. Events are handled by the innermost active state that
+	// declares a transition for the event, otherwise they bubble up to the
+	// parent state, and so on.
+	//
+	// The children of a parallel state (see ChartState.Parallel) are regions
+	// that are all active at once; every event is offered to every region.
+	//
+	// History pseudo-states (see ChartState.History) remember the substates
+	// that a composite state was in when it was last exited; a transition that
+	// targets a history pseudo-state resumes those substates. Choice and
+	// junction pseudo-states (see ChartState.Choice and ChartState.Junction)
+	// select the target of a transition by evaluating guards.
+	//
+	// Actions and guards are registered with the chart by name (see Action and
+	// Guard) and states refer to them by name, as do transitions. State names
+	// are unique within a chart.
+	Chart struct {
+		name    string
+		root    *ChartState
+		states  map[string]*ChartState
+		actions map[string]Action
+		guards  map[string]Guard
+		order   int
+		err     error
+	}
+
+	// ChartState is a state of a Chart; see Chart.State and ChartState.State.
+	ChartState struct {
+		chart       *Chart
+		name        string
+		parent      *ChartState
+		children    []*ChartState
+		initial     string
+		final       bool
+		parallel    bool
+		kind        pseudoKind
+		pseudo      []*ChartState
+		branches    []*ChartBranch
+		entry, exit []string
+		transitions []*ChartTransition
+		order       int
+	}
+
+	// ChartTransition is the reaction of a state to an event. Transitions
+	// without a Target are internal: the event is handled (actions execute)
+	// but no state is exited or entered.
+	ChartTransition struct {
+		// Event is a space-separated list of event descriptors, see On.
+		// Transitions without an Event are eventless.
+		Event   string
+		Target  string
+		Actions []string
+		// Guard, if any, names a guard that must hold for the transition to
+		// be taken.
+		Guard string
+		// In, if any, names a state that must be active for the transition to
+		// be taken.
+		In string
+		// Local transitions from a composite state to one of its descendants
+		// don't exit (and re-enter) the composite state.
+		Local bool
+		// After delays a transition without an Event: the transition is
+		// taken once its source state has been active for the duration.
+		After time.Duration
+	}
+
+	// ChartBranch is an outgoing branch of a choice or junction pseudo-state:
+	// the branch is taken if its Guard holds. The else branch has no Guard.
+	ChartBranch struct {
+		Guard   string
+		Target  string
+		Actions []string
+	}
+
+	pseudoKind int
+
+	// Action is executed upon entry or exit of a state, or as part of a
+	// transition. The event is the event that triggered the transition, nil
+	// upon entry of the initial states, for eventless transitions, or upon exit
+	// due to cancellation. Actions are executed by the goroutine that runs the
+	// machine and shouldn't block.
+	Action func(ctx Context, m *ChartMachine, e Event)
+
+	// Guard decides whether a branch of a choice or junction pseudo-state is
+	// taken, given the event that triggered the transition and the extended
+	// state of the machine (see ChartMachine.Data). Guards shouldn't have side
+	// effects.
+	Guard func(e Event, data interface{}) bool
+)
+
+const (
+	notPseudo pseudoKind = iota
+	shallowHistory
+	deepHistory
+	choicePseudo
+	junctionPseudo
+)
+
+// NewChart returns an empty chart with the given name.
+func NewChart(name string) *Chart {
+	c := &Chart{
+		name:    name,
+		states:  map[string]*ChartState{},
+		actions: map[string]Action{},
+		guards:  map[string]Guard{},
+	}
+	c.root = &ChartState{chart: c}
+	return c
+}
+
+// Name returns the name of the chart.
+func (c *Chart) Name() string { return c.name }
+
+// Action registers a named action.
+func (c *Chart) Action(name string, a Action) *Chart {
+	c.actions[name] = a
+	return c
+}
+
+// Guard registers a named guard.
+func (c *Chart) Guard(name string, g Guard) *Chart {
+	c.guards[name] = g
+	return c
+}
+
+// State returns a new top-level state; see ChartState.State.
+func (c *Chart) State(name string) *ChartState { return c.root.State(name) }
+
+// Choice returns a new top-level choice pseudo-state; see ChartState.Choice.
+func (c *Chart) Choice(name string) *ChartState { return c.root.Choice(name) }
+
+// Junction returns a new top-level junction pseudo-state; see ChartState.Junction.
+func (c *Chart) Junction(name string) *ChartState { return c.root.Junction(name) }
+
+// Initial sets the initial top-level state, which otherwise defaults to the
+// first top-level state.
+func (c *Chart) Initial(name string) *Chart {
+	c.root.Initial(name)
+	return c
+}
+
+// InitialChild returns the initial top-level state.
+func (c *Chart) InitialChild() *ChartState { return c.root.InitialChild() }
+
+// Lookup returns the named state, or nil if there's no such state.
+func (c *Chart) Lookup(name string) *ChartState { return c.states[name] }
+
+// States returns all states and pseudo-states of the chart, in declaration order.
+func (c *Chart) States() []*ChartState {
+	states := make([]*ChartState, 0, len(c.states))
+	for _, s := range c.states {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].order < states[j].order })
+	return states
+}
+
+// Validate returns the first error found in the definition of the chart: an
+// invalid or duplicate state name, a reference to an undeclared state or an
+// unregistered action, etc.
+func (c *Chart) Validate() error {
+	if c.err != nil {
+		return c.err
+	}
+	if len(c.root.children) == 0 {
+		return fmt.Errorf("chart %q declares no states", c.name)
+	}
+	if err := c.root.validate(); err != nil {
+		return err
+	}
+	return c.validateBranches()
+}
+
+// validateBranches returns an error if the branches of choice and junction
+// pseudo-states form a cycle.
+func (c *Chart) validateBranches() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := map[*ChartState]int{}
+	var visit func(s *ChartState) error
+	visit = func(s *ChartState) error {
+		if s.kind != choicePseudo && s.kind != junctionPseudo || marks[s] == visited {
+			return nil
+		}
+		if marks[s] == visiting {
+			return fmt.Errorf("%v: branches form a cycle", s)
+		}
+		marks[s] = visiting
+		for _, b := range s.branches {
+			if err := visit(c.states[b.Target]); err != nil {
+				return err
+			}
+		}
+		marks[s] = visited
+		return nil
+	}
+	for _, s := range c.States() {
+		if err := visit(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Chart) fail(format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf(format, args...)
+	}
+}
+
+// State adds a new child state; a state that has children is a composite state.
+func (s *ChartState) State(name string) *ChartState {
+	c := s.chart
+	if name == "" {
+		c.fail("state names may not be empty")
+	} else if _, ok := c.states[name]; ok {
+		c.fail("duplicate state %q", name)
+	}
+	c.order++
+	child := &ChartState{chart: c, name: name, parent: s, order: c.order}
+	c.states[name] = child
+	s.children = append(s.children, child)
+	return child
+}
+
+// History adds a history pseudo-state to a composite state. A transition that
+// targets the history pseudo-state enters the child states that were active
+// when the composite state was last exited (shallow history) or, if deep is
+// true, the atomic descendants that were active, along with their ancestors.
+// If the composite state has never been exited then the default target of the
+// history pseudo-state is entered instead, see Initial, and otherwise the
+// composite state is entered as usual.
+//
+// History pseudo-states are never active themselves; they have no children,
+// transitions or actions, and aren't included by Children.
+func (s *ChartState) History(name string, deep bool) *ChartState {
+	if deep {
+		return s.pseudoState(name, deepHistory)
+	}
+	return s.pseudoState(name, shallowHistory)
+}
+
+// Choice adds a choice pseudo-state. A transition that targets a choice
+// pseudo-state exits its source states and executes its actions before the
+// guards of the branches (see When and Else) are evaluated, in order: the
+// first branch whose guard holds is taken, otherwise the else branch is. So
+// the guards of a choice observe the effects of the transition's actions upon
+// the extended state of the machine.
+//
+// Like all pseudo-states, choices are never active and aren't included by
+// Children; they have no children, transitions or actions of their own.
+func (s *ChartState) Choice(name string) *ChartState { return s.pseudoState(name, choicePseudo) }
+
+// Junction adds a junction pseudo-state. A junction is like a choice, except
+// that its guards are evaluated before the transition that targets it is
+// executed: the transition and the selected branch form a single transition
+// from the source to the target of the branch.
+func (s *ChartState) Junction(name string) *ChartState { return s.pseudoState(name, junctionPseudo) }
+
+func (s *ChartState) pseudoState(name string, kind pseudoKind) *ChartState {
+	p := s.State(name)
+	s.children = s.children[:len(s.children)-1]
+	s.pseudo = append(s.pseudo, p)
+	p.kind = kind
+	return p
+}
+
+// When adds a branch to a choice or junction pseudo-state that's taken if the
+// named guard holds.
+func (s *ChartState) When(guard, target string, actions ...string) *ChartState {
+	s.branches = append(s.branches, &ChartBranch{Guard: guard, Target: target, Actions: actions})
+	return s
+}
+
+// Else adds the else branch of a choice or junction pseudo-state, which is
+// taken if none of the guards of the other branches hold. Every choice and
+// junction requires exactly one else branch.
+func (s *ChartState) Else(target string, actions ...string) *ChartState {
+	return s.When("", target, actions...)
+}
+
+// Initial sets the initial child state of a composite state, which otherwise
+// defaults to the first child. The initial state may also be a deeper
+// descendant, in which case its ancestors are entered along with it. For
+// history pseudo-states it sets the default target: a child (shallow) or
+// descendant (deep) of the composite state.
+func (s *ChartState) Initial(name string) *ChartState {
+	s.initial = name
+	return s
+}
+
+// Final marks a state as final. A final state has no children and no
+// transitions. Upon entry of a final top-level state the machine terminates;
+// upon entry of any other final state a `done.state.<parent>` event is raised
+// for the parent state.
+func (s *ChartState) Final() *ChartState {
+	s.final = true
+	return s
+}
+
+// Parallel marks a composite state as parallel: its children are orthogonal
+// regions that are entered, and are active, together. Events are broadcast to
+// all regions. Once every region is in a final state a `done.state.<name>`
+// event is raised for the parallel state, see Final.
+func (s *ChartState) Parallel() *ChartState {
+	s.parallel = true
+	return s
+}
+
+// OnEntry adds named actions that are executed upon entry of the state.
+func (s *ChartState) OnEntry(actions ...string) *ChartState {
+	s.entry = append(s.entry, actions...)
+	return s
+}
+
+// OnExit adds named actions that are executed upon exit of the state.
+func (s *ChartState) OnExit(actions ...string) *ChartState {
+	s.exit = append(s.exit, actions...)
+	return s
+}
+
+// On adds a transition to the target state upon the named event, see EventName.
+// If the target is empty then the transition is internal. Transitions are
+// considered in the order that they were added.
+//
+// The event may be a space-separated list of event descriptors. A descriptor
+// matches events that it names, and events whose names extend it by one or
+// more dot-separated tokens: "error" matches "error" and "error.send", but not
+// "errors". The descriptor "*" matches all events. If the event is empty then
+// the transition is eventless: it's taken as soon as it's enabled (see
+// Transition), before any further events are processed.
+func (s *ChartState) On(event, target string, actions ...string) *ChartState {
+	return s.Transition(ChartTransition{Event: event, Target: target, Actions: actions})
+}
+
+// After adds a delayed transition to the target state, which is taken once the
+// state has been active for the given duration; see ChartTransition.After.
+func (s *ChartState) After(delay time.Duration, target string, actions ...string) *ChartState {
+	return s.Transition(ChartTransition{After: delay, Target: target, Actions: actions})
+}
+
+// Transition adds a transition, see On.
+func (s *ChartState) Transition(t ChartTransition) *ChartState {
+	s.transitions = append(s.transitions, &t)
+	return s
+}
+
+// Name returns the name of the state.
+func (s *ChartState) Name() string { return s.name }
+
+// Parent returns the parent state, or nil for top-level states.
+func (s *ChartState) Parent() *ChartState {
+	if s.parent == s.chart.root {
+		return nil
+	}
+	return s.parent
+}
+
+// Children returns the child states, in declaration order.
+func (s *ChartState) Children() []*ChartState { return append([]*ChartState(nil), s.children...) }
+
+// IsFinal returns true for final states.
+func (s *ChartState) IsFinal() bool { return s.final }
+
+// IsParallel returns true for parallel states.
+func (s *ChartState) IsParallel() bool { return s.parallel }
+
+// IsHistory returns true for history pseudo-states; deep is true for deep
+// history pseudo-states.
+func (s *ChartState) IsHistory() (ok, deep bool) {
+	return s.isHistory(), s.kind == deepHistory
+}
+
+// IsChoice returns true for choice pseudo-states.
+func (s *ChartState) IsChoice() bool { return s.kind == choicePseudo }
+
+// IsJunction returns true for junction pseudo-states.
+func (s *ChartState) IsJunction() bool { return s.kind == junctionPseudo }
+
+// Branches returns the branches of a choice or junction pseudo-state, in
+// declaration order.
+func (s *ChartState) Branches() []*ChartBranch { return append([]*ChartBranch(nil), s.branches...) }
+
+// PseudoStates returns the pseudo-states of a composite state, in declaration
+// order.
+func (s *ChartState) PseudoStates() []*ChartState { return append([]*ChartState(nil), s.pseudo...) }
+
+// Transitions returns the transitions of the state, in declaration order.
+func (s *ChartState) Transitions() []*ChartTransition {
+	return append([]*ChartTransition(nil), s.transitions...)
+}
+
+// EntryActions returns the names of the actions executed upon entry.
+func (s *ChartState) EntryActions() []string { return append([]string(nil), s.entry...) }
+
+// ExitActions returns the names of the actions executed upon exit.
+func (s *ChartState) ExitActions() []string { return append([]string(nil), s.exit...) }
+
+// InitialChild returns the initial state of a composite state, usually a
+// child (see Initial), or nil for atomic and parallel states. For history
+// pseudo-states it returns the default target, if any.
+func (s *ChartState) InitialChild() *ChartState {
+	if s.isHistory() && s.initial != "" {
+		return s.chart.states[s.initial]
+	}
+	if len(s.children) == 0 || s.parallel || s.kind != notPseudo {
+		return nil
+	}
+	if s.initial != "" {
+		return s.chart.states[s.initial]
+	}
+	return s.children[0]
+}
+
+func (s *ChartState) isHistory() bool { return s.kind == shallowHistory || s.kind == deepHistory }
+
+func (s *ChartState) isAtomic() bool { return len(s.children) == 0 }
+
+// isDescendantOf returns true if s is a (proper) descendant of other.
+func (s *ChartState) isDescendantOf(other *ChartState) bool {
+	for p := s.parent; p != nil; p = p.parent {
+		if p == other {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ChartState) String() string {
+	if s.parent == nil {
+		return fmt.Sprintf("chart %q", s.chart.name)
+	}
+	return fmt.Sprintf("state %q", s.name)
+}
+
+func (s *ChartState) validate() error {
+	c := s.chart
+	switch s.kind {
+	case shallowHistory, deepHistory:
+		return s.validateHistory()
+	case choicePseudo, junctionPseudo:
+		return s.validateBranches()
+	}
+	if len(s.branches) > 0 {
+		return fmt.Errorf("%v: only choice and junction pseudo-states have branches", s)
+	}
+	if s.initial != "" {
+		if i := c.states[s.initial]; i == nil || !i.isDescendantOf(s) || i.kind != notPseudo {
+			return fmt.Errorf("%v: initial state %q is not a descendant", s, s.initial)
+		}
+	}
+	if s.parallel && (len(s.children) == 0 || s.initial != "") {
+		return fmt.Errorf("%v: parallel states must have children and may not have an initial state", s)
+	}
+	if s.final && (len(s.children) > 0 || len(s.transitions) > 0) {
+		return fmt.Errorf("%v: final states may not have children or transitions", s)
+	}
+	for _, names := range [][]string{s.entry, s.exit} {
+		for _, a := range names {
+			if c.actions[a] == nil {
+				return fmt.Errorf("%v: unregistered action %q", s, a)
+			}
+		}
+	}
+	for _, t := range s.transitions {
+		if t.Target != "" && c.states[t.Target] == nil {
+			return fmt.Errorf("%v: transition upon %q to undeclared state %q", s, t.Event, t.Target)
+		}
+		if t.After < 0 || t.After > 0 && t.Event != "" {
+			return fmt.Errorf("%v: transition upon %q: invalid delay %v", s, t.Event, t.After)
+		}
+		if t.Guard != "" && c.guards[t.Guard] == nil {
+			return fmt.Errorf("%v: transition upon %q: unregistered guard %q", s, t.Event, t.Guard)
+		}
+		if t.In != "" && c.states[t.In] == nil {
+			return fmt.Errorf("%v: transition upon %q: in undeclared state %q", s, t.Event, t.In)
+		}
+		for _, a := range t.Actions {
+			if c.actions[a] == nil {
+				return fmt.Errorf("%v: transition upon %q: unregistered action %q", s, t.Event, a)
+			}
+		}
+	}
+	for _, children := range [][]*ChartState{s.children, s.pseudo} {
+		for _, child := range children {
+			if err := child.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *ChartState) validateBranches() error {
+	c := s.chart
+	if len(s.children) > 0 || len(s.pseudo) > 0 || len(s.transitions) > 0 ||
+		len(s.entry) > 0 || len(s.exit) > 0 || s.final || s.parallel || s.initial != "" {
+		return fmt.Errorf("%v: choice and junction pseudo-states may only have branches", s)
+	}
+	elses := 0
+	for _, b := range s.branches {
+		if b.Guard == "" {
+			elses++
+		} else if c.guards[b.Guard] == nil {
+			return fmt.Errorf("%v: unregistered guard %q", s, b.Guard)
+		}
+		if t := c.states[b.Target]; t == nil || t == s {
+			return fmt.Errorf("%v: branch to undeclared state %q", s, b.Target)
+		}
+		for _, a := range b.Actions {
+			if c.actions[a] == nil {
+				return fmt.Errorf("%v: branch to %q: unregistered action %q", s, b.Target, a)
+			}
+		}
+	}
+	if elses != 1 {
+		return fmt.Errorf("%v: requires exactly one else branch", s)
+	}
+	return nil
+}
+
+func (s *ChartState) validateHistory() error {
+	p := s.parent
+	switch {
+	case p == s.chart.root || len(p.children) == 0:
+		return fmt.Errorf("%v: history pseudo-states require a composite parent state", s)
+	case len(s.children) > 0 || len(s.pseudo) > 0 || len(s.transitions) > 0 || len(s.branches) > 0 ||
+		len(s.entry) > 0 || len(s.exit) > 0 || s.final || s.parallel:
+		return fmt.Errorf("%v: history pseudo-states may not have children, transitions or actions", s)
+	case s.initial == "":
+		return nil
+	}
+	t := s.chart.states[s.initial]
+	switch {
+	case t == nil || !t.isDescendantOf(p):
+		return fmt.Errorf("%v: default target %q is not a descendant of %v", s, s.initial, p)
+	case s.kind == shallowHistory && t.parent != p:
+		return fmt.Errorf("%v: default target %q of shallow history is not a child of %v", s, s.initial, p)
+	case t.kind != notPseudo:
+		return fmt.Errorf("%v: default target %q is a pseudo-state", s, s.initial)
+	}
+	return nil
+}
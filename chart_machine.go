@@ -0,0 +1,701 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// ChartMachine is a Machine that executes a Chart. The entire chart runs
+	// within a single state func (see InitialState), which returns nil once a
+	// final top-level state is entered or once the Context is done; in the
+	// latter case all active states are exited first.
+	//
+	// Upon a transition, active states are exited innermost first, then the
+	// actions of the transition execute, then states are entered outermost
+	// first: entering a composite state enters its initial child, and so on;
+	// entering a parallel state enters all of its regions.
+	ChartMachine struct {
+		Events
+		chart    *Chart
+		mu       sync.Mutex
+		active   map[*ChartState]bool
+		history  map[*ChartState][]*ChartState // keyed by history pseudo-state
+		internal []Event
+		halted   bool
+		restore  *ChartSnapshot
+		data     interface{}
+		timers   map[*ChartTransition]*delayEvent // armed delayed transitions
+	}
+
+	// delayEvent is delivered by the timer of a delayed transition, see
+	// ChartTransition.After.
+	delayEvent struct {
+		AbstractEvent
+		transition *ChartTransition
+		source     *ChartState
+		cancel     chan struct{}
+	}
+
+	// ChartSnapshot captures the state of a ChartMachine, see Snapshot.
+	ChartSnapshot struct {
+		// Configuration lists the names of the active states, outermost first.
+		Configuration []string `json:"configuration"`
+		// History maps the names of history pseudo-states to the names of the
+		// states that they remember.
+		History map[string][]string `json:"history,omitempty"`
+	}
+
+	// enabled is a transition selected for execution, along with its source,
+	// its target (after evaluating the branches of junctions) and the actions
+	// that it executes.
+	enabled struct {
+		source *ChartState
+		*ChartTransition
+		target  *ChartState
+		actions []string
+	}
+)
+
+// ChartMachine implements Machine
+var _ Machine = &ChartMachine{}
+
+// Machine validates the chart and returns a new Machine that executes it,
+// with an event queue of the given length.
+func (c *Chart) Machine(queueLength int) (*ChartMachine, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &ChartMachine{
+		Events:  NewSimpleEvents(queueLength),
+		chart:   c,
+		active:  map[*ChartState]bool{},
+		history: map[*ChartState][]*ChartState{},
+		timers:  map[*ChartTransition]*delayEvent{},
+	}, nil
+}
+
+// EventName returns a name like "after(1s)#state".
+func (e *delayEvent) EventName() string {
+	return fmt.Sprintf("after(%v)#%s", e.transition.After, e.source.name)
+}
+
+// Chart returns the chart executed by the machine.
+func (m *ChartMachine) Chart() *Chart { return m.chart }
+
+func (m *ChartMachine) InitialState() Fn { return m.run }
+
+// Configuration returns the names of the active states, outermost first.
+func (m *ChartMachine) Configuration() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := m.activeStates()
+	names := make([]string, len(states))
+	for i, s := range states {
+		names[i] = s.name
+	}
+	return names
+}
+
+// In returns true if the named state is active.
+func (m *ChartMachine) In(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.chart.states[name]
+	return s != nil && m.active[s]
+}
+
+// Snapshot returns the active states and the remembered history of the machine.
+func (m *ChartMachine) Snapshot() ChartSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := ChartSnapshot{Configuration: []string{}}
+	for _, s := range m.activeStates() {
+		snap.Configuration = append(snap.Configuration, s.name)
+	}
+	for h, states := range m.history {
+		if snap.History == nil {
+			snap.History = map[string][]string{}
+		}
+		for _, s := range states {
+			snap.History[h.name] = append(snap.History[h.name], s.name)
+		}
+	}
+	return snap
+}
+
+// Restore arranges for the machine to resume from a snapshot the next time
+// that it runs: the states of the snapshot's configuration are entered
+// (executing their entry actions) instead of the initial states, and the
+// history is reinstated. Restore should be invoked before Run.
+func (m *ChartMachine) Restore(snap ChartSnapshot) error {
+	c := m.chart
+	for _, name := range snap.Configuration {
+		if s := c.states[name]; s == nil || s.kind != notPseudo {
+			return fmt.Errorf("chart %q: cannot restore undeclared state %q", c.name, name)
+		}
+	}
+	for name, states := range snap.History {
+		h := c.states[name]
+		if h == nil || !h.isHistory() {
+			return fmt.Errorf("chart %q: cannot restore undeclared history %q", c.name, name)
+		}
+		for _, x := range states {
+			if s := c.states[x]; s == nil || !s.isDescendantOf(h.parent) {
+				return fmt.Errorf("chart %q: history %q cannot remember state %q", c.name, name, x)
+			}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restore = &snap
+	return nil
+}
+
+// Data returns the extended state of the machine, see SetData.
+func (m *ChartMachine) Data() interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data
+}
+
+// SetData sets the extended state of the machine: arbitrary data that's
+// maintained by actions and that's evaluated by guards.
+func (m *ChartMachine) SetData(data interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = data
+}
+
+// Regions returns, for each region of the named parallel state, the name of
+// the active child of the region (or "" for an atomic region). Returns nil
+// unless the named state is an active parallel state.
+func (m *ChartMachine) Regions(name string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.chart.states[name]
+	if s == nil || !s.parallel || !m.active[s] {
+		return nil
+	}
+	regions := make(map[string]string, len(s.children))
+	for _, r := range s.children {
+		regions[r.name] = ""
+		for _, c := range r.children {
+			if m.active[c] {
+				regions[r.name] = c.name
+			}
+		}
+	}
+	return regions
+}
+
+// Raise queues an internal event. Internal events are processed, in order,
+// before the next event from Source. Raise should only be invoked by actions.
+func (m *ChartMachine) Raise(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.internal = append(m.internal, e)
+}
+
+func (m *ChartMachine) run(ctx Context, _ Machine) Fn {
+	m.mu.Lock()
+	m.active = map[*ChartState]bool{}
+	m.history = map[*ChartState][]*ChartState{}
+	m.timers = map[*ChartTransition]*delayEvent{}
+	m.internal = nil
+	m.halted = false
+	restore := m.restore
+	m.restore = nil
+	m.mu.Unlock()
+
+	entry := map[*ChartState]bool{}
+	if restore != nil && len(restore.Configuration) > 0 {
+		c := m.chart
+		for _, name := range restore.Configuration {
+			entry[c.states[name]] = true
+		}
+		m.mu.Lock()
+		for name, states := range restore.History {
+			h := c.states[name]
+			for _, x := range states {
+				m.history[h] = append(m.history[h], c.states[x])
+			}
+		}
+		m.mu.Unlock()
+	} else {
+		initial := m.chart.root.InitialChild()
+		m.addDescendants(initial, entry)
+		m.addAncestors(initial, m.chart.root, entry)
+	}
+	m.enterStates(ctx, nil, entry)
+
+	for !m.halted {
+		select {
+		case <-ctx.Done():
+			m.halted = true
+			continue
+		default:
+		}
+		if ts := m.selectTransitions(nil); len(ts) > 0 {
+			m.microstep(ctx, nil, ts)
+			continue
+		}
+		if e := m.nextInternal(); e != nil {
+			m.process(ctx, e)
+			continue
+		}
+		select {
+		case e := <-m.Source():
+			m.process(ctx, e)
+		case <-ctx.Done():
+			m.halted = true
+		}
+	}
+	m.exitStates(ctx, nil, m.activeStates())
+	return nil
+}
+
+func (m *ChartMachine) nextInternal() Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.internal) == 0 {
+		return nil
+	}
+	e := m.internal[0]
+	m.internal = m.internal[1:]
+	return e
+}
+
+// process executes the transitions enabled by an event; events that no
+// active state handles are dropped. Eventless transitions are taken before
+// any event is processed.
+func (m *ChartMachine) process(ctx Context, e Event) {
+	if ts := m.selectTransitions(e); len(ts) > 0 {
+		m.microstep(ctx, e, ts)
+	}
+}
+
+// selectTransitions returns the transitions enabled by an event, or the
+// enabled eventless transitions if the event is nil: for each active atomic
+// state, the first enabled transition of the state or of its nearest ancestor.
+func (m *ChartMachine) selectTransitions(e Event) (result []enabled) {
+	var (
+		name = EventName(e)
+		data = m.Data()
+	)
+	for _, atomic := range m.activeStates() {
+		if !atomic.isAtomic() {
+			continue
+		}
+	selection:
+		for s := atomic; s != nil; s = s.parent {
+			for _, t := range s.transitions {
+				if !m.enabledBy(t, e, name, data) {
+					continue
+				}
+				for _, prev := range result {
+					if prev.ChartTransition == t {
+						break selection // already selected via another descendant
+					}
+				}
+				result = m.preempt(result, m.resolve(e, enabled{source: s, ChartTransition: t}))
+				break selection
+			}
+		}
+	}
+	return
+}
+
+// enabledBy returns true if the transition is enabled by the event (with the
+// given name), or if the transition is eventless and the event is nil. Delayed
+// transitions are only enabled by the event of their (armed) timer.
+func (m *ChartMachine) enabledBy(t *ChartTransition, e Event, name string, data interface{}) bool {
+	if t.After > 0 {
+		if d, ok := e.(*delayEvent); !ok || m.timers[t] != d {
+			return false
+		}
+	}
+	switch {
+	case e == nil && (t.Event != "" || t.After > 0),
+		e != nil && t.After == 0 && !matches(t.Event, name),
+		t.In != "" && !m.active[m.chart.states[t.In]]:
+		return false
+	case t.Guard != "":
+		return m.chart.guards[t.Guard](e, data)
+	}
+	return true
+}
+
+// matches returns true if any of the event descriptors matches the name of an
+// event, see ChartState.On.
+func matches(descriptors, name string) bool {
+	for _, d := range strings.Fields(descriptors) {
+		d = strings.TrimSuffix(strings.TrimSuffix(d, "*"), ".")
+		if d == "" || d == name || strings.HasPrefix(name, d+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// preempt adds a transition to the selected transitions, unless it conflicts
+// with one of them: transitions conflict if they exit the same states. A
+// transition preempts conflicting transitions from ancestors of its source,
+// otherwise the transition that was selected first takes precedence.
+func (m *ChartMachine) preempt(selected []enabled, t enabled) []enabled {
+	var (
+		exits = m.exitSet(t)
+		keep  []enabled
+	)
+	for _, prev := range selected {
+		conflict := false
+		for x := range m.exitSet(prev) {
+			if exits[x] {
+				conflict = true
+				break
+			}
+		}
+		switch {
+		case !conflict:
+			keep = append(keep, prev)
+		case !t.source.isDescendantOf(prev.source):
+			return selected
+		}
+	}
+	return append(keep, t)
+}
+
+// resolve determines the target of a transition: the branches of junction
+// pseudo-states are evaluated up front, choice pseudo-states are left to
+// microstep.
+func (m *ChartMachine) resolve(e Event, t enabled) enabled {
+	t.actions = t.Actions
+	if t.Target == "" {
+		return t
+	}
+	t.target = m.chart.states[t.Target]
+	for t.target.kind == junctionPseudo {
+		b := m.branch(t.target, e)
+		t.actions = append(t.actions[:len(t.actions):len(t.actions)], b.Actions...)
+		t.target = m.chart.states[b.Target]
+	}
+	return t
+}
+
+// branch returns the first branch of a choice or junction pseudo-state whose
+// guard holds, or else the else branch.
+func (m *ChartMachine) branch(p *ChartState, e Event) *ChartBranch {
+	var (
+		data = m.Data()
+		dflt *ChartBranch
+	)
+	for _, b := range p.branches {
+		if b.Guard == "" {
+			dflt = b
+		} else if m.chart.guards[b.Guard](e, data) {
+			return b
+		}
+	}
+	return dflt
+}
+
+func (m *ChartMachine) microstep(ctx Context, e Event, ts []enabled) {
+	var (
+		exits = map[*ChartState]bool{}
+		entry = map[*ChartState]bool{}
+	)
+	for _, t := range ts {
+		for s := range m.exitSet(t) {
+			exits[s] = true
+		}
+	}
+	m.exitStates(ctx, e, sortStates(exits, true))
+
+	for _, t := range ts {
+		m.execute(ctx, e, t.actions)
+	}
+
+	for _, t := range ts {
+		if t.target == nil {
+			continue
+		}
+		target, domain := t.target, m.domain(t)
+		for target.kind == choicePseudo || target.kind == junctionPseudo {
+			// the transition continues from the pseudo-state along the
+			// selected branch, possibly leaving the scope of its domain.
+			m.addAncestors(target, domain, entry)
+			b := m.branch(target, e)
+			next := enabled{source: target, target: m.chart.states[b.Target]}
+			domain = m.domain(next)
+			for s := range entry {
+				if s.isDescendantOf(domain) {
+					delete(entry, s)
+				}
+			}
+			m.exitStates(ctx, e, sortStates(m.exitSet(next), true))
+			m.execute(ctx, e, b.Actions)
+			target = next.target
+		}
+		m.addDescendants(target, entry)
+		m.addAncestors(target, domain, entry)
+	}
+	m.enterStates(ctx, e, entry)
+}
+
+// domain returns the least common composite ancestor of the source and target
+// of a transition: the states that it exits and enters are all descendants of
+// the domain. Parallel states are never the domain of a transition, so that a
+// transition between regions exits and re-enters the parallel state; the
+// composite source of a local transition is the domain of the transition.
+// Returns nil for internal transitions.
+func (m *ChartMachine) domain(t enabled) *ChartState {
+	if t.target == nil {
+		return nil
+	}
+	target := t.target
+	if t.ChartTransition != nil && t.Local && !t.source.isAtomic() && !t.source.parallel && target.isDescendantOf(t.source) {
+		return t.source
+	}
+	for a := t.source.parent; a != nil; a = a.parent {
+		if !a.parallel && target.isDescendantOf(a) {
+			return a
+		}
+	}
+	return m.chart.root
+}
+
+// exitSet returns the active states that are exited by a transition.
+func (m *ChartMachine) exitSet(t enabled) map[*ChartState]bool {
+	set := map[*ChartState]bool{}
+	if d := m.domain(t); d != nil {
+		for s := range m.active {
+			if s.isDescendantOf(d) {
+				set[s] = true
+			}
+		}
+	}
+	return set
+}
+
+// addDescendants adds a state, and the states that are entered by default
+// along with it, to the entry set. History pseudo-states are replaced by the
+// states that they remember, or else by their default target.
+func (m *ChartMachine) addDescendants(s *ChartState, set map[*ChartState]bool) {
+	if s.isHistory() {
+		m.mu.Lock()
+		remembered := m.history[s]
+		m.mu.Unlock()
+		if len(remembered) == 0 {
+			if s.initial == "" {
+				m.addDescendants(s.parent, set)
+				return
+			}
+			remembered = []*ChartState{m.chart.states[s.initial]}
+		}
+		for _, r := range remembered {
+			m.addDescendants(r, set)
+			m.addAncestors(r, s.parent, set)
+		}
+		return
+	}
+	set[s] = true
+	if s.parallel {
+		for _, r := range s.children {
+			m.addDescendants(r, set)
+		}
+	} else if initial := s.InitialChild(); initial != nil {
+		m.addDescendants(initial, set)
+		m.addAncestors(initial, s, set)
+	}
+}
+
+// addAncestors adds the ancestors of a state, up to (excluding) the given
+// domain, to the entry set. The regions of parallel ancestors that the entry
+// set doesn't already enter are entered by default.
+func (m *ChartMachine) addAncestors(s, domain *ChartState, set map[*ChartState]bool) {
+	for a := s.parent; a != nil && a != domain && a != m.chart.root; a = a.parent {
+		set[a] = true
+		if !a.parallel {
+			continue
+		}
+		for _, r := range a.children {
+			if !enters(r, set) {
+				m.addDescendants(r, set)
+			}
+		}
+	}
+}
+
+// enters returns true if the set contains the state or any of its descendants.
+func enters(s *ChartState, set map[*ChartState]bool) bool {
+	for x := range set {
+		if x == s || x.isDescendantOf(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ChartMachine) enterStates(ctx Context, e Event, set map[*ChartState]bool) {
+	for _, s := range sortStates(set, false) {
+		m.mu.Lock()
+		m.active[s] = true
+		m.mu.Unlock()
+
+		m.execute(ctx, e, s.entry)
+		m.arm(ctx, s)
+
+		if !s.final {
+			continue
+		}
+		parent := s.parent
+		if parent == m.chart.root {
+			m.halted = true
+			continue
+		}
+		m.Raise(&NamedEvent{Name: "done.state." + parent.name})
+		if p := parent.parent; p.parallel && m.inFinalState(p) {
+			m.Raise(&NamedEvent{Name: "done.state." + p.name})
+		}
+	}
+}
+
+// inFinalState returns true if a composite state has an active final child,
+// or if every region of a parallel state is in a final state.
+func (m *ChartMachine) inFinalState(s *ChartState) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.completed(s)
+}
+
+func (m *ChartMachine) completed(s *ChartState) bool {
+	if s.parallel {
+		for _, r := range s.children {
+			if !m.completed(r) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, c := range s.children {
+		if c.final && m.active[c] {
+			return true
+		}
+	}
+	return false
+}
+
+// exitStates exits the given states, in order. The history of the exited
+// states is recorded before any state is exited.
+func (m *ChartMachine) exitStates(ctx Context, e Event, states []*ChartState) {
+	m.mu.Lock()
+	for _, s := range states {
+		for _, h := range s.pseudo {
+			if !h.isHistory() {
+				continue
+			}
+			var remembered []*ChartState
+			for _, a := range m.activeStates() {
+				if h.kind == deepHistory && a.isAtomic() && a.isDescendantOf(s) ||
+					h.kind == shallowHistory && a.parent == s {
+					remembered = append(remembered, a)
+				}
+			}
+			m.history[h] = remembered
+		}
+	}
+	m.mu.Unlock()
+
+	for _, s := range states {
+		m.disarm(s)
+		m.execute(ctx, e, s.exit)
+
+		m.mu.Lock()
+		delete(m.active, s)
+		m.mu.Unlock()
+	}
+}
+
+// arm starts the timers of the delayed transitions of a state; a timer
+// delivers its event to the Sink of the machine.
+func (m *ChartMachine) arm(ctx Context, s *ChartState) {
+	for _, t := range s.transitions {
+		if t.After == 0 {
+			continue
+		}
+		d := &delayEvent{transition: t, source: s, cancel: make(chan struct{})}
+		m.timers[t] = d
+		go func() {
+			timer := time.NewTimer(t.After)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-d.cancel:
+				return
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case m.Sink() <- d:
+			case <-d.cancel:
+			case <-ctx.Done():
+			}
+		}()
+	}
+}
+
+// disarm stops the timers of the delayed transitions of a state; the events of
+// timers that already fired no longer enable their transitions.
+func (m *ChartMachine) disarm(s *ChartState) {
+	for _, t := range s.transitions {
+		if d := m.timers[t]; d != nil {
+			close(d.cancel)
+			delete(m.timers, t)
+		}
+	}
+}
+
+func (m *ChartMachine) execute(ctx Context, e Event, actions []string) {
+	for _, name := range actions {
+		m.chart.actions[name](ctx, m, e)
+	}
+}
+
+// activeStates returns the active states in document order, i.e. parents
+// before their children.
+func (m *ChartMachine) activeStates() []*ChartState {
+	return sortStates(m.active, false)
+}
+
+func sortStates(set map[*ChartState]bool, reverse bool) []*ChartState {
+	states := make([]*ChartState, 0, len(set))
+	for s := range set {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if reverse {
+			return states[i].order > states[j].order
+		}
+		return states[i].order < states[j].order
+	})
+	return states
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/statetest"
+)
+
+type (
+	connectRequest    struct{ state.AbstractEvent }
+	disconnectRequest struct{ state.AbstractEvent }
+)
+
+// traced registers actions that print the entry and exit of every state.
+func traced(c *state.Chart, names ...string) {
+	for _, name := range names {
+		name := name
+		c.Action("enter "+name, func(state.Context, *state.ChartMachine, state.Event) { fmt.Println("enter", name) })
+		c.Action("exit "+name, func(state.Context, *state.ChartMachine, state.Event) { fmt.Println("exit", name) })
+		c.Lookup(name).OnEntry("enter " + name).OnExit("exit " + name)
+	}
+}
+
+func ExampleChart() {
+	c := state.NewChart("agent")
+	c.State("Offline").
+		On("connectRequest", "Online").
+		On("shutdown", "Terminated")
+	online := c.State("Online").
+		On("disconnectRequest", "Offline"). // handles the event for all descendants
+		On("shutdown", "Terminated")
+	online.State("Connecting").On("connected", "Ready")
+	ready := online.State("Ready")
+	ready.State("Idle").On("work", "Busy")
+	ready.State("Busy").On("done", "Idle")
+	c.State("Terminated").Final()
+	traced(c, "Offline", "Online", "Connecting", "Ready", "Idle", "Busy", "Terminated")
+
+	m, err := c.Machine(10)
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range []state.Event{
+		&connectRequest{},
+		&state.NamedEvent{Name: "connected"},
+		&state.NamedEvent{Name: "work"},
+		&disconnectRequest{},
+		&state.NamedEvent{Name: "shutdown"},
+	} {
+		m.Sink() <- e
+	}
+	state.Run(make(state.SimpleContext), m)
+
+	// Output:
+	// enter Offline
+	// exit Offline
+	// enter Online
+	// enter Connecting
+	// exit Connecting
+	// enter Ready
+	// enter Idle
+	// exit Idle
+	// enter Busy
+	// exit Busy
+	// exit Ready
+	// exit Online
+	// enter Offline
+	// exit Offline
+	// enter Terminated
+	// exit Terminated
+}
+
+func ExampleChartState_Parallel() {
+	c := state.NewChart("agent")
+	running := c.State("Running").
+		Parallel().
+		On("status", "", "status").
+		On("done.state.Running", "Terminated")
+	conn := running.State("Connection")
+	conn.State("Disconnected").On("connectRequest", "Connected")
+	conn.State("Connected").On("disconnectRequest", "Closed")
+	conn.State("Closed").Final()
+	lease := running.State("Lease")
+	lease.State("Valid").On("tick", "Renewing")
+	lease.State("Renewing").On("renewed", "Valid").On("tick", "Expired")
+	lease.State("Expired").Final()
+	c.State("Terminated").Final().OnEntry("terminated")
+
+	c.Action("status", func(_ state.Context, m *state.ChartMachine, _ state.Event) {
+		r := m.Regions("Running")
+		fmt.Printf("connection=%s lease=%s\n", r["Connection"], r["Lease"])
+	})
+	c.Action("terminated", func(state.Context, *state.ChartMachine, state.Event) { fmt.Println("terminated") })
+
+	m, err := c.Machine(10)
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range []state.Event{
+		&state.NamedEvent{Name: "status"},
+		&connectRequest{},
+		&state.NamedEvent{Name: "tick"}, // only handled by the lease region
+		&state.NamedEvent{Name: "status"},
+		&disconnectRequest{},
+		&state.NamedEvent{Name: "status"},
+		&state.NamedEvent{Name: "tick"}, // every region is now final: join
+	} {
+		m.Sink() <- e
+	}
+	state.Run(make(state.SimpleContext), m)
+
+	// Output:
+	// connection=Disconnected lease=Valid
+	// connection=Connected lease=Renewing
+	// connection=Closed lease=Renewing
+	// terminated
+}
+
+func ExampleChartState_History() {
+	c := state.NewChart("subagent")
+	c.State("Disconnected").
+		On("connectRequest", "ConnectedHistory").
+		On("shutdown", "Terminated")
+	connected := c.State("Connected").On("disconnectRequest", "Disconnected")
+	connected.State("Stage1").On("heartbeat", "Stage2")
+	connected.State("Stage2")
+	connected.History("ConnectedHistory", false)
+	c.State("Terminated").Final()
+	traced(c, "Stage1", "Stage2")
+
+	m, err := c.Machine(10)
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range []state.Event{
+		&connectRequest{},
+		&state.NamedEvent{Name: "heartbeat"},
+		&disconnectRequest{},
+		&connectRequest{}, // resumes Stage2
+		&disconnectRequest{},
+		&state.NamedEvent{Name: "shutdown"},
+	} {
+		m.Sink() <- e
+	}
+	state.Run(make(state.SimpleContext), m)
+	fmt.Println(m.Snapshot().History)
+
+	// Output:
+	// enter Stage1
+	// exit Stage1
+	// enter Stage2
+	// exit Stage2
+	// enter Stage2
+	// exit Stage2
+	// map[ConnectedHistory:[Stage2]]
+}
+
+func TestChartMachine_Restore(t *testing.T) {
+	chart := func() *state.Chart {
+		c := state.NewChart("deep")
+		c.State("Idle").On("resume", "Hist")
+		work := c.State("Work").On("pause", "Idle")
+		work.State("A").On("next", "B")
+		b := work.State("B")
+		b.State("B1").On("next", "B2")
+		b.State("B2")
+		work.History("Hist", true)
+		return c
+	}
+	m, err := chart().Machine(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := statetest.Start(t, m)
+	for _, name := range []string{"resume", "next", "next", "pause"} {
+		h.Send(&state.NamedEvent{Name: name})
+	}
+	// the queue is unbuffered: once the second (unhandled) sync event is
+	// accepted, every event before it has been processed.
+	h.Send(&state.NamedEvent{Name: "sync"})
+	h.Send(&state.NamedEvent{Name: "sync"})
+	h.Stop()
+
+	snap := m.Snapshot()
+	if got := snap.History["Hist"]; len(got) != 1 || got[0] != "B2" {
+		t.Fatalf("expected deep history [B2], got %v", got)
+	}
+
+	// resume a new machine from the snapshot
+	m2, err := chart().Machine(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Configuration = []string{"Idle"}
+	if err := m2.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	h2 := statetest.Start(t, m2)
+	h2.Send(&state.NamedEvent{Name: "resume"})
+	h2.Send(&state.NamedEvent{Name: "sync"})
+	h2.Send(&state.NamedEvent{Name: "sync"})
+	if got, want := fmt.Sprint(m2.Configuration()), "[Work B B2]"; got != want {
+		t.Fatalf("expected configuration %s, got %s", want, got)
+	}
+
+	if err := m2.Restore(state.ChartSnapshot{History: map[string][]string{"Idle": {"A"}}}); err == nil {
+		t.Fatal("expected an error restoring a non-history state")
+	}
+}
+
+func ExampleChartState_Choice() {
+	type retries struct{ attempts, max int }
+
+	c := state.NewChart("dialer")
+	c.State("Dialing").
+		OnEntry("dial").
+		On("failed", "ShouldRetry", "countAttempt").
+		On("connected", "Connected")
+	c.Choice("ShouldRetry").
+		When("canRetry", "Dialing").
+		Else("GaveUp")
+	c.State("Connected").Final()
+	c.State("GaveUp").Final().OnEntry("gaveUp")
+
+	c.Action("dial", func(_ state.Context, m *state.ChartMachine, _ state.Event) {
+		fmt.Println("dialing, attempt", m.Data().(*retries).attempts+1)
+	})
+	c.Action("countAttempt", func(_ state.Context, m *state.ChartMachine, _ state.Event) {
+		m.Data().(*retries).attempts++
+	})
+	c.Action("gaveUp", func(state.Context, *state.ChartMachine, state.Event) { fmt.Println("gave up") })
+	c.Guard("canRetry", func(_ state.Event, data interface{}) bool {
+		r := data.(*retries)
+		return r.attempts < r.max
+	})
+
+	m, err := c.Machine(10)
+	if err != nil {
+		panic(err)
+	}
+	m.SetData(&retries{max: 2})
+	for i := 0; i < 2; i++ {
+		m.Sink() <- &state.NamedEvent{Name: "failed"}
+	}
+	state.Run(make(state.SimpleContext), m)
+
+	// Output:
+	// dialing, attempt 1
+	// dialing, attempt 2
+	// gave up
+}
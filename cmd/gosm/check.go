@@ -0,0 +1,77 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jdef/state/graph"
+	"github.com/jdef/state/spec"
+)
+
+// checkMain reports unreachable states, dead states, unhandled events and sink
+// states of a state machine; exits with a non-zero status if any are found.
+// States that only terminate by cancellation are dead if the check is strict.
+func checkMain(args []string) {
+	var (
+		fs       = flag.NewFlagSet("check", flag.ExitOnError)
+		specFile = fs.String("spec", "", "path to the YAML/JSON state machine spec; if unspecified the graph is extracted from the package in -dir")
+		dir      = fs.String("dir", ".", "directory of the package that implements the state machine")
+		initial  = fs.String("initial", "", "name of the initial state, overrides the extracted or declared initial state")
+		dot      = fs.String("dot", "", "name of a file to write the transition graph to, in Graphviz DOT format")
+		strict   = fs.Bool("strict", false, "report states that only terminate by cancellation as dead")
+	)
+	fs.Parse(args)
+
+	g := loadGraph(*specFile, *dir)
+	if *initial != "" {
+		g.Initial = *initial
+	}
+	if g.Node(g.Initial) == nil {
+		fmt.Fprintf(os.Stderr, "unknown initial state %q\n", g.Initial)
+		os.Exit(2)
+	}
+
+	if *dot != "" {
+		f, err := os.Create(*dot)
+		dieUpon(err)
+		dieUpon(g.WriteDot(f))
+		dieUpon(f.Close())
+	}
+
+	r := graph.Check(g)
+	if *strict {
+		r = r.Strict()
+	}
+	if !r.Empty() {
+		fmt.Println(r)
+		os.Exit(1)
+	}
+}
+
+func loadGraph(specFile, dir string) *graph.Graph {
+	if specFile != "" {
+		s, err := spec.Load(specFile)
+		dieUpon(err)
+		return graph.FromSpec(s)
+	}
+	g, err := graph.Extract(dir)
+	dieUpon(err)
+	return g
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jdef/state/cover"
+)
+
+// coverMain merges transition profiles and reports the edges of a state
+// machine's transition graph that were never taken.
+func coverMain(args []string) {
+	var (
+		fs       = flag.NewFlagSet("cover", flag.ExitOnError)
+		specFile = fs.String("spec", "", "path to the YAML/JSON state machine spec; if unspecified the graph is extracted from the package in -dir")
+		dir      = fs.String("dir", ".", "directory of the package that implements the state machine")
+		pkg      = fs.String("pkg", "", "import path of the package that implements the state machine; if unspecified state funcs are matched by name only")
+		html     = fs.String("html", "", "name of a file to write an HTML report to")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gosm cover [flags] profile...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	p, err := cover.ReadProfileFile(fs.Args()...)
+	dieUpon(err)
+
+	r := cover.NewReport(loadGraph(*specFile, *dir), p, *pkg)
+	dieUpon(r.WriteText(os.Stdout))
+
+	if *html != "" {
+		f, err := os.Create(*html)
+		dieUpon(err)
+		dieUpon(r.WriteHTML(f))
+		dieUpon(f.Close())
+	}
+}
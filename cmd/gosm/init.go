@@ -0,0 +1,373 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/jdef/state/spec"
+)
+
+const specGeneratedFile = "spec_generated.go"
+
+type (
+	initContext struct {
+		StatePackage string
+		Package      string
+		Interface    string
+		Type         string
+		SpecFile     string
+		InitialFunc  string
+		States       []stateContext
+		Events       []string
+	}
+
+	stateContext struct {
+		Name         string
+		Interface    string
+		Func         string
+		Final        bool
+		Cancel       string
+		NeedsMachine bool
+		Transitions  []spec.Transition
+	}
+)
+
+// initMain scaffolds (or updates) a state machine package from a spec file.
+// Files that are meant to be edited by hand are only ever created, never
+// overwritten: re-running initMain regenerates spec_generated.go and adds stubs
+// for state funcs that don't exist yet.
+func initMain(args []string) {
+	var (
+		fs       = flag.NewFlagSet("init", flag.ExitOnError)
+		statepkg = fs.String("statepkg", "github.com/jdef/state", "fully-qualified name of the state package")
+		pkg      = fs.String("pkg", env("GOPACKAGE", ""), "name of the target package, overrides the package declared in the spec")
+		specFile = fs.String("spec", "", "path to the YAML/JSON state machine spec")
+		dir      = fs.String("dir", ".", "directory of the target package")
+	)
+	fs.Parse(args)
+
+	if *specFile == "" {
+		panic("spec is a required parameter")
+	}
+
+	s, err := spec.Load(*specFile)
+	dieUpon(err)
+
+	if *pkg != "" {
+		s.Package = *pkg
+	}
+	if s.Package == "" {
+		abs, err := filepath.Abs(*dir)
+		dieUpon(err)
+		s.Package = filepath.Base(abs)
+	}
+
+	dieUpon(os.MkdirAll(*dir, 0755))
+
+	rel, err := filepath.Rel(*dir, *specFile)
+	dieUpon(err)
+
+	ctx := newInitContext(s, *statepkg, filepath.ToSlash(rel))
+	funcs, types := declaredNames(*dir)
+
+	writeTemplate(filepath.Join(*dir, specGeneratedFile), specGeneratedTemplate, ctx)
+
+	if !types[s.Type] {
+		createTemplate(filepath.Join(*dir, fileName(s.Type)+".go"), machineTemplate, ctx)
+	}
+
+	for _, st := range ctx.States {
+		if funcs[st.Func] {
+			continue
+		}
+		f := filepath.Join(*dir, fileName(st.Name)+".go")
+		if _, err := os.Stat(f); err == nil {
+			appendTemplate(f, stubTemplate, st)
+		} else {
+			writeTemplate(f, stubFileTemplate, struct {
+				initContext
+				State stateContext
+			}{ctx, st})
+		}
+	}
+
+	createTemplate(filepath.Join(*dir, fileName(s.Type)+"_test.go"), testTemplate, ctx)
+}
+
+func newInitContext(s *spec.Spec, statepkg, specFile string) initContext {
+	ctx := initContext{
+		StatePackage: statepkg,
+		Package:      s.Package,
+		Interface:    s.Interface,
+		Type:         s.Type,
+		SpecFile:     specFile,
+		InitialFunc:  spec.FuncName(s.Initial),
+		Events:       s.Events,
+	}
+	for _, st := range s.States {
+		sc := stateContext{
+			Name:        st.Name,
+			Interface:   s.Interface,
+			Func:        spec.FuncName(st.Name),
+			Final:       st.Final,
+			Cancel:      s.Cancel,
+			Transitions: s.TransitionsFrom(st.Name),
+		}
+		sc.NeedsMachine = s.Cancel != ""
+		for _, t := range sc.Transitions {
+			if t.To != "" {
+				sc.NeedsMachine = true
+			}
+		}
+		ctx.States = append(ctx.States, sc)
+	}
+	return ctx
+}
+
+// declaredNames returns the names of the top-level funcs and types declared in
+// the non-test, non-generated Go files of the given directory.
+func declaredNames(dir string) (funcs, types map[string]bool) {
+	funcs, types = map[string]bool{}, map[string]bool{}
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	dieUpon(err)
+	fset := token.NewFileSet()
+	for _, f := range files {
+		if strings.HasSuffix(f, "_test.go") || filepath.Base(f) == specGeneratedFile {
+			continue
+		}
+		file, err := parser.ParseFile(fset, f, nil, 0)
+		dieUpon(err)
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					funcs[decl.Name.Name] = true
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if ts, ok := spec.(*ast.TypeSpec); ok {
+						types[ts.Name.Name] = true
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+func render(text string, data interface{}) []byte {
+	t, err := template.New("init").Parse(text)
+	dieUpon(err)
+	var buf bytes.Buffer
+	dieUpon(t.Execute(&buf, data))
+	return buf.Bytes()
+}
+
+func writeTemplate(path, text string, data interface{}) {
+	src, err := format.Source(render(text, data))
+	dieUpon(err)
+	dieUpon(os.WriteFile(path, src, 0644))
+}
+
+// createTemplate is like writeTemplate but never overwrites an existing file.
+func createTemplate(path, text string, data interface{}) {
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	writeTemplate(path, text, data)
+}
+
+func appendTemplate(path, text string, data interface{}) {
+	existing, err := os.ReadFile(path)
+	dieUpon(err)
+	src := append(existing, '\n')
+	src = append(src, render(text, data)...)
+	if src, err = format.Source(src); err != nil {
+		panic(path + ": " + err.Error())
+	}
+	dieUpon(os.WriteFile(path, src, 0644))
+}
+
+// fileName returns the base name of the hand-edited file of an identifier,
+// see snakeCase. Names that the go tool or gosm treat specially, i.e. test
+// files and generated files like spec_generated.go, get a "_sm" suffix so
+// that stubs never overwrite, or hide in, such files.
+func fileName(name string) string {
+	base := snakeCase(name)
+	if strings.HasSuffix(base, "_test") || strings.HasSuffix(base, "_generated") {
+		base += "_sm"
+	}
+	return base
+}
+
+// snakeCase converts an identifier to a file name: "TCPConnected" becomes "tcp_connected".
+func snakeCase(name string) string {
+	r := []rune(name)
+	var buf bytes.Buffer
+	for i, c := range r {
+		if unicode.IsUpper(c) && i > 0 && (unicode.IsLower(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+			buf.WriteRune('_')
+		}
+		buf.WriteRune(unicode.ToLower(c))
+	}
+	return buf.String()
+}
+
+const specGeneratedTemplate = `/*
+ * THIS IS AN AUTOMATICALLY GENERATED FILE. DO NOT EDIT THIS FILE MANUALLY.
+ * It was generated by "gosm init" from {{.SpecFile}}.
+ */
+
+package {{.Package}}
+
+import (
+	"{{.StatePackage}}"
+)
+
+type (
+	{{.Interface}} interface {
+		state.Machine
+{{range .States}}
+		{{.Name}}() state.Fn
+{{- end}}
+	}
+{{- if .Events}}
+
+	//
+	// events
+	//
+{{range .Events}}
+	{{.}} struct{ state.AbstractEvent }
+{{- end}}
+{{- end}}
+)
+{{range .States}}
+func (m *{{$.Type}}) {{.Name}}() state.Fn { return {{.Func}} }
+{{- end}}
+`
+
+const machineTemplate = `//go:generate gosm init -spec {{.SpecFile}}
+//go:generate gosm -o helpers_generated.go -iface {{.Interface}}
+
+package {{.Package}}
+
+import (
+	"{{.StatePackage}}"
+)
+
+// {{.Type}} is the concrete state machine; fields that hold the extended state
+// of the machine belong here.
+type {{.Type}} struct {
+	state.Machine
+}
+
+// {{.Type}} implements {{.Interface}}
+var _ {{.Interface}} = &{{.Type}}{}
+
+func New(backlog int) {{.Interface}} {
+	return &{{.Type}}{
+		Machine: state.NewSimpleMachine(backlog, {{.InitialFunc}}),
+	}
+}
+`
+
+const stubFileTemplate = `package {{.Package}}
+
+import (
+	"{{.StatePackage}}"
+)
+{{with .State}}` + stubTemplate + `{{end}}`
+
+const stubTemplate = `
+func {{.Func}}(ctx state.Context, m state.Machine) state.Fn {
+{{- if .Final}}
+	return nil
+{{- else}}
+{{- if .NeedsMachine}}
+	machine := m.({{.Interface}})
+{{- end}}
+	next := state.Next(m) // support hijackers
+	for {
+		select {
+{{- if .Transitions}}
+		case event := <-m.Source():
+			switch event.(type) {
+{{- range .Transitions}}
+			case *{{.Event}}:
+				// TODO: handle {{.Event}}
+{{- if .To}}
+				return machine.{{.To}}()
+{{- end}}
+{{- end}}
+			}
+{{- else}}
+		case <-m.Source():
+			// TODO: handle events
+{{- end}}
+		case fn := <-next:
+			return fn
+		case <-ctx.Done():
+{{- if .Cancel}}
+			return machine.{{.Cancel}}()
+{{- else}}
+			return nil
+{{- end}}
+		}
+	}
+{{- end}}
+}
+`
+
+const testTemplate = `package {{.Package}}
+
+import (
+	"testing"
+	"time"
+
+	"{{.StatePackage}}"
+)
+
+func TestRunTerminatesUponCancel(t *testing.T) {
+	var (
+		m    = New(1)
+		ctx  = make(state.SimpleContext)
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		state.Run(ctx, m)
+	}()
+
+	ctx.Cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("state machine failed to terminate after cancellation")
+	}
+}
+`
@@ -0,0 +1,110 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const initSpec = `package: light
+type: Light
+initial: Off
+states:
+  - name: Off
+  - name: On
+events: [Toggle]
+transitions:
+  - {from: Off, event: Toggle, to: On}
+  - {from: On, event: Toggle, to: Off}
+`
+
+func TestInitMain_rerun(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		specFile = filepath.Join(dir, "light.yaml")
+		path     = func(name string) string { return filepath.Join(dir, name) }
+	)
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(path(name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		t.Helper()
+		b, err := os.ReadFile(path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	write("light.yaml", initSpec)
+	initMain([]string{"-spec", specFile, "-dir", dir})
+	for _, name := range []string{specGeneratedFile, "light.go", "off.go", "on.go", "light_test.go"} {
+		if _, err := os.Stat(path(name)); err != nil {
+			t.Fatalf("expected %s to be scaffolded: %v", name, err)
+		}
+	}
+
+	// edit a stub by hand, and add a state whose file exists already
+	edited := strings.Replace(read("off.go"), "package light", "package light\n\n// hand-edited", 1)
+	write("off.go", edited)
+	write("broken.go", "package light\n\nfunc fixable() bool { return false }\n")
+	write("light.yaml", strings.Replace(initSpec, "  - name: On\n", "  - name: On\n  - name: Broken\n    final: true\n", 1))
+
+	initMain([]string{"-spec", specFile, "-dir", dir})
+	if got := read("off.go"); got != edited {
+		t.Errorf("expected the edited stub to survive, got:\n%s", got)
+	}
+	broken := read("broken.go")
+	if !strings.Contains(broken, "func fixable() bool") || !strings.Contains(broken, "func broken(") {
+		t.Errorf("expected a stub to be appended to broken.go, got:\n%s", broken)
+	}
+	if !strings.Contains(read(specGeneratedFile), "Broken() state.Fn") {
+		t.Errorf("expected %s to declare the new state", specGeneratedFile)
+	}
+}
+
+func TestInitMain_reservedNames(t *testing.T) {
+	dir := t.TempDir()
+	specFile := filepath.Join(dir, "light.yaml")
+	reserved := strings.Replace(initSpec, "  - name: On\n", "  - name: On\n  - name: SpecGenerated\n  - name: LoadTest\n", 1)
+	if err := os.WriteFile(specFile, []byte(reserved), 0644); err != nil {
+		t.Fatal(err)
+	}
+	initMain([]string{"-spec", specFile, "-dir", dir})
+	for name, want := range map[string]string{
+		specGeneratedFile:      "SpecGenerated() state.Fn",
+		"spec_generated_sm.go": "func specGenerated(",
+		"load_test_sm.go":      "func loadTest(",
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), want) {
+			t.Errorf("expected %s to contain %q, got:\n%s", name, want, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "load_test.go")); err == nil {
+		t.Error("expected no stub in a test file")
+	}
+}
@@ -0,0 +1,309 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package compose provides generic super-state and sub-state machine helpers,
+// with the behavior of the helpers that gosm generates, for any machine type
+// I. It spares machine packages the gosm step, and may be adopted one package
+// at a time.
+//
+// Go doesn't allow embedding a type parameter, so the helpers of this package
+// aren't themselves an I: the state funcs of a super-state machine obtain the
+// I that they run as via As, instead of by type assertion. As also supports
+// the masquerades generated by gosm.
+//
+// A sub-state machine is a type that embeds both a *SubMachine[I] and, one
+// level deeper, the I of its super-state machine, whose states it may
+// override:
+//
+//	type (
+//		Subagent struct {
+//			*compose.SubMachine[agent.Interface]
+//			defaults
+//		}
+//		defaults struct{ agent.Interface } // the super-states, by default
+//	)
+package compose
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+type (
+	// SuperMachine is a super-state machine that any number of sub-state
+	// machines may be attached to, see AsSuperMachine.
+	SuperMachine[I state.Machine] struct {
+		impl       I
+		hijackChan chan state.Fn
+
+		mu   sync.Mutex
+		subs []*SubMachine[I]
+	}
+
+	// lane is the super-state machine as seen by a single sub-state machine:
+	// it has its own event queue and hijack chan, so that the super-states
+	// that one sub-state machine delegates to (see Masquerade) never read the
+	// events, or the hijacks, of another.
+	lane[I state.Machine] struct {
+		*SuperMachine[I]
+		events     chan state.Event
+		hijackChan chan state.Fn
+	}
+
+	// SubMachine is a helper for building sub-state machines that extend an
+	// I: it has its own event queue and an optional initial state, and may
+	// be preempted by its super-state machine, see state.Preempt.
+	SubMachine[I state.Machine] struct {
+		lane         *lane[I]
+		events       chan state.Event
+		preempt      chan state.Fn
+		initialState state.Fn
+		middleware   state.Middleware
+	}
+
+	// masq is an imposter of the super-state machine, see Masquerade.
+	masq[I state.Machine] struct {
+		*SubMachine[I]
+		self I
+	}
+)
+
+var (
+	_ state.Machine      = &SuperMachine[state.Machine]{}
+	_ state.SuperMachine = &SuperMachine[state.Machine]{}
+	_ state.HijackPolicy = &SuperMachine[state.Machine]{}
+	_ state.Transition   = &SuperMachine[state.Machine]{}
+	_ state.Machine      = &SubMachine[state.Machine]{}
+	_ state.SubMachine   = &SubMachine[state.Machine]{}
+	_ state.Hijackable   = &SubMachine[state.Machine]{}
+	_ state.Handoff      = &SubMachine[state.Machine]{}
+)
+
+// AsSuperMachine returns a super-state machine for i. Every sub-state machine
+// has a lane of its own: a hijack by a sub-state machine (via its Super) is
+// only received by the super-states that it delegates to, and events that it
+// dispatches are only read by those super-states. Hijacks that are sent to the
+// Hijack chan of the super-state machine itself, which is read by its states
+// if it's run directly, are accepted first-come, first-served. Likewise, events
+// that are sent to its Sink are only read by its own states: send events for
+// the sub-state machines to them instead, see Broadcast.
+func AsSuperMachine[I state.Machine](i I) *SuperMachine[I] {
+	return &SuperMachine[I]{impl: i, hijackChan: make(chan state.Fn)}
+}
+
+func (a *SuperMachine[I]) Source() <-chan state.Event                    { return a.impl.Source() }
+func (a *SuperMachine[I]) Sink() chan<- state.Event                      { return a.impl.Sink() }
+func (a *SuperMachine[I]) InitialState() state.Fn                        { return a.impl.InitialState() }
+func (a *SuperMachine[I]) NextState() <-chan state.Fn                    { return a.hijackChan }
+func (a *SuperMachine[I]) Hijack() chan<- state.Fn                       { return a.hijackChan }
+func (a *SuperMachine[I]) SubMachine(l int, f state.Fn) state.SubMachine { return a.Sub(l, f) }
+func (a *SuperMachine[I]) unwrap() I                                     { return a.impl }
+
+// Sub attaches a new sub-state machine with the given queue length and
+// (optional) initial state; the queue of its lane is as long as the queue of
+// the super-state machine.
+func (a *SuperMachine[I]) Sub(queueLength int, initialState state.Fn) *SubMachine[I] {
+	m := &SubMachine[I]{
+		lane: &lane[I]{
+			SuperMachine: a,
+			events:       make(chan state.Event, cap(a.impl.Sink())),
+			hijackChan:   make(chan state.Fn),
+		},
+		events:       make(chan state.Event, queueLength),
+		preempt:      make(chan state.Fn),
+		initialState: initialState,
+	}
+	a.attach(m)
+	return m
+}
+
+// AcceptHijack vetoes hijacks (see state.Hijack) if the underlying I
+// implements state.HijackPolicy, otherwise all hijacks are accepted. The
+// policy is consulted by the state that receives the hijack, see state.Accept.
+func (a *SuperMachine[I]) AcceptHijack(target state.Fn) error {
+	if p, ok := state.Machine(a.impl).(state.HijackPolicy); ok {
+		return p.AcceptHijack(target)
+	}
+	return nil
+}
+
+// SubMachines returns the attached sub-state machines, in the order that they
+// were attached.
+func (a *SuperMachine[I]) SubMachines() []*SubMachine[I] {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*SubMachine[I](nil), a.subs...)
+}
+
+// Broadcast sends an event to every attached sub-state machine, in the order
+// that they were attached, until the Context is done.
+func (a *SuperMachine[I]) Broadcast(ctx state.Context, e state.Event) {
+	for _, m := range a.SubMachines() {
+		select {
+		case <-ctx.Done():
+			return
+		case m.Sink() <- e:
+		}
+	}
+}
+
+// Preempt redirects every attached sub-state machine to the given state (see
+// state.Preempt), for example to shut them down in an emergency. The sub-state
+// machines are preempted concurrently, each within the timeout; the errors of
+// those that aren't preempted are joined, see errors.Join.
+func (a *SuperMachine[I]) Preempt(ctx state.Context, target state.Fn, timeout time.Duration) error {
+	var (
+		subs = a.SubMachines()
+		errs = make([]error, len(subs))
+		wg   sync.WaitGroup
+	)
+	for i, m := range subs {
+		wg.Add(1)
+		go func(i int, m *SubMachine[I]) {
+			defer wg.Done()
+			errs[i] = state.Preempt(ctx, m, target, timeout)
+		}(i, m)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (a *SuperMachine[I]) attach(m *SubMachine[I]) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.subs = append(a.subs, m)
+}
+
+func (a *SuperMachine[I]) detach(m *SubMachine[I]) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, x := range a.subs {
+		if x == m {
+			a.subs = append(a.subs[:i:i], a.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *lane[I]) Source() <-chan state.Event { return l.events }
+func (l *lane[I]) Sink() chan<- state.Event   { return l.events }
+func (l *lane[I]) NextState() <-chan state.Fn { return l.hijackChan }
+func (l *lane[I]) Hijack() chan<- state.Fn    { return l.hijackChan }
+
+// Detach detaches the sub-state machine from its super-state machine: it no
+// longer receives broadcasts. Its lane remains usable, so that the sub-state
+// machine may be run to completion.
+func (m *SubMachine[I]) Detach() { m.lane.detach(m) }
+
+// Use processes the events that the sub-state machine dispatches (see
+// Dispatch) by the given middleware, e.g. a middleware.Chain. Use is meant to
+// be invoked before the sub-state machine runs.
+func (m *SubMachine[I]) Use(mw state.Middleware) { m.middleware = mw }
+
+func (m *SubMachine[I]) InitialState() state.Fn {
+	if m.initialState != nil {
+		return m.initialState
+	}
+	return m.lane.InitialState()
+}
+
+// Dispatch sends an event to the super-states that the sub-state machine
+// delegates to, via its lane; it blocks until the lane's queue has room, or
+// until the Context is done. Events that are dropped by middleware (see Use)
+// aren't sent.
+func (m *SubMachine[I]) Dispatch(ctx state.Context, e state.Event) {
+	if m.middleware != nil {
+		var err error
+		if e, err = m.middleware.Process(ctx, e); err != nil {
+			return
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case m.lane.Sink() <- e:
+	}
+}
+
+// Handoff detaches the sub-state machine, and hands the events that remain
+// queued by its lane over to the lane of its successor, provided that's a
+// sub-state machine of the same super-state machine. See state.Host.
+func (m *SubMachine[I]) Handoff(ctx state.Context, to state.Machine) {
+	m.Detach()
+	next, ok := to.(interface{ sub() *SubMachine[I] })
+	if !ok || next.sub().lane.SuperMachine != m.lane.SuperMachine {
+		return
+	}
+	sink := next.sub().lane.Sink()
+	for {
+		select {
+		case e := <-m.lane.Source():
+			select {
+			case sink <- e:
+			case <-ctx.Done():
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (m *SubMachine[I]) Source() <-chan state.Event                { return m.events }
+func (m *SubMachine[I]) Sink() chan<- state.Event                  { return m.events }
+func (m *SubMachine[I]) Super() state.SuperMachine                 { return m.lane }
+func (m *SubMachine[I]) Hijack() chan<- state.Fn                   { return m.preempt }
+func (m *SubMachine[I]) NextState() <-chan state.Fn                { return m.preempt }
+func (m *SubMachine[I]) SubMachine(int, state.Fn) state.SubMachine { return nil } // is not extensible
+func (m *SubMachine[I]) sub() *SubMachine[I]                       { return m }
+
+// AcceptHijack accepts all hijacks: the super-state machine's policy (see
+// state.HijackPolicy) applies to hijacks of the super-state machine only.
+func (m *SubMachine[I]) AcceptHijack(state.Fn) error { return nil }
+
+// Masquerade returns an imposter of the super-state machine that may be passed
+// to the super-machine's state funcs for upstream event delegation: its Source
+// and NextState are those of the sub-state machine's lane, and As returns m
+// for it, so that the states of m override those of the super-state machine.
+func Masquerade[I state.Machine](m I) state.Machine {
+	return &masq[I]{SubMachine: AsSub[I](m), self: m}
+}
+
+func (m *masq[I]) Source() <-chan state.Event { return m.lane.Source() }
+func (m *masq[I]) NextState() <-chan state.Fn { return m.lane.NextState() }
+func (m *masq[I]) unwrap() I                  { return m.self }
+
+// SuperOf returns the I of the super-state machine of sub.
+func SuperOf[I state.Machine](sub *SubMachine[I]) I { return sub.lane.impl }
+
+// AsSub returns the *SubMachine[I] that m is built from; it panics if m
+// doesn't embed one.
+func AsSub[I state.Machine](m state.Machine) *SubMachine[I] {
+	return m.(interface{ sub() *SubMachine[I] }).sub()
+}
+
+// As returns the I that a state func runs as: the sub-state machine that m
+// stands in for if it's a Masquerade, the I of the super-state machine if m is
+// a *SuperMachine[I], otherwise m itself; it panics if m isn't an I.
+func As[I state.Machine](m state.Machine) I {
+	if u, ok := m.(interface{ unwrap() I }); ok {
+		return u.unwrap()
+	}
+	return m.(I)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compose_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/compose"
+	"github.com/jdef/state/demo/agent"
+	"github.com/jdef/state/statetest"
+)
+
+func TestSuperMachine_Broadcast(t *testing.T) {
+	var (
+		a     = agent.New(make(chan struct{}, 1), 1)
+		super = compose.AsSuperMachine(a)
+		sub1  = NewSubagent(super, relay)
+		sub2  = NewSubagent(super, relay)
+		h1    = statetest.Start(t, sub1)
+		h2    = statetest.Start(t, sub2)
+		ctx   = make(state.SimpleContext)
+	)
+	defer ctx.Cancel()
+	if subs := super.SubMachines(); len(subs) != 2 || subs[0] != sub1.SubMachine || subs[1] != sub2.SubMachine {
+		t.Fatalf("unexpected sub-state machines %v", subs)
+	}
+
+	super.Broadcast(ctx, &agent.ConnectRequest{})
+	h1.Expect(celebrating)
+	h2.Expect(celebrating)
+
+	sub2.Detach()
+	if subs := super.SubMachines(); len(subs) != 1 || subs[0] != sub1.SubMachine {
+		t.Fatalf("expected sub2 to be detached, got %v", subs)
+	}
+}
+
+func TestSuperMachine_Preempt(t *testing.T) {
+	var (
+		a      = agent.New(make(chan struct{}, 1), 1)
+		super  = compose.AsSuperMachine(a)
+		h1     = statetest.Start(t, NewSubagent(super, relay))
+		h2     = statetest.Start(t, NewSubagent(super, relay))
+		ctx    = make(state.SimpleContext)
+		resume = make(chan struct{})
+		paused = state.Pause(resume, nil)
+	)
+	defer ctx.Cancel()
+	h1.Expect(relay)
+	h2.Expect(relay)
+
+	if err := super.Preempt(ctx, paused, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	h1.Expect(paused)
+	h2.Expect(paused)
+	close(resume)
+	if !h1.WaitTerminated(time.Second) || !h2.WaitTerminated(time.Second) {
+		t.Fatal("expected resumed machines to terminate")
+	}
+}
+
+// stalled dispatches the events that it receives to its lane, but doesn't
+// delegate to the super-state machine: the events remain queued by the lane.
+func stalled(dispatched chan<- struct{}) state.Fn {
+	return func(ctx state.Context, m state.Machine) state.Fn {
+		sub := compose.AsSub[agent.Interface](m)
+		for {
+			select {
+			case e := <-m.Source():
+				sub.Dispatch(ctx, e)
+				dispatched <- struct{}{}
+			case f := <-state.Next(m):
+				return f
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func TestSubMachine_Handoff(t *testing.T) {
+	var (
+		super      = compose.AsSuperMachine(agent.New(make(chan struct{}, 1), 1))
+		dispatched = make(chan struct{}, 1)
+		host       = state.NewHost(0, NewSubagent(super, stalled(dispatched)))
+		r          = statetest.NewRecorder()
+		ctx        = make(state.SimpleContext)
+		exited     = make(chan struct{})
+	)
+	go func() {
+		defer close(exited)
+		host.Run(ctx, r)
+	}()
+	defer func() {
+		ctx.Cancel()
+		<-exited
+	}()
+
+	host.Sink() <- &agent.ConnectRequest{}
+	<-dispatched
+
+	sub2 := NewSubagent(super, relay)
+	if err := host.Swap(ctx, sub2); err != nil {
+		t.Fatal(err)
+	}
+	if !r.WaitFor(celebrating, time.Second) {
+		t.Fatalf("expected %s, visited %s", statetest.Name(celebrating), r)
+	}
+	if subs := super.SubMachines(); len(subs) != 1 || subs[0] != sub2.SubMachine {
+		t.Fatalf("expected the stalled sub-state machine to be detached, got %v", subs)
+	}
+}
+
+func TestAs(t *testing.T) {
+	var (
+		a     = agent.New(make(chan struct{}, 1), 1)
+		super = compose.AsSuperMachine(a)
+		sub   = NewSubagent(super, relay)
+	)
+	if compose.As[agent.Interface](super) != a {
+		t.Fatal("expected the agent of the super-state machine")
+	}
+	if compose.As[agent.Interface](sub) != agent.Interface(sub) {
+		t.Fatal("expected the sub-state machine itself")
+	}
+	if compose.As[agent.Interface](compose.Masquerade[agent.Interface](sub)) != agent.Interface(sub) {
+		t.Fatal("expected the sub-state machine that's masqueraded")
+	}
+}
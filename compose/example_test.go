@@ -0,0 +1,99 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compose_test
+
+import (
+	"fmt"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/compose"
+	"github.com/jdef/state/demo/agent"
+)
+
+type (
+	// Subagent extends the demo agent: it overrides the Connected state.
+	Subagent struct {
+		*compose.SubMachine[agent.Interface]
+		defaults
+	}
+
+	// defaults are the states of the super-state machine.
+	defaults struct{ agent.Interface }
+)
+
+func NewSubagent(super *compose.SuperMachine[agent.Interface], initialState state.Fn) *Subagent {
+	sub := super.Sub(0, initialState)
+	return &Subagent{sub, defaults{compose.SuperOf(sub)}}
+}
+
+func (s *Subagent) Connected() state.Fn { return celebrating }
+
+// relay delegates to the Disconnected state of the super-state machine.
+func relay(ctx state.Context, m state.Machine) state.Fn {
+	var (
+		sub = compose.AsSub[agent.Interface](m)
+		t   = state.Delegate(ctx, compose.SuperOf(sub).Disconnected(), compose.Masquerade(compose.As[agent.Interface](m)))
+	)
+	defer t.Stop()
+	next := state.Next(m) // support preemption by the super-state machine
+	for {
+		select {
+		case e := <-m.Source():
+			sub.Dispatch(ctx, e)
+		case f := <-t.NextState():
+			return f
+		case f := <-next:
+			return f
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func celebrating(ctx state.Context, _ state.Machine) state.Fn {
+	fmt.Println("connected!")
+	<-ctx.Done()
+	return nil
+}
+
+func ExampleAsSuperMachine() {
+	var (
+		ctx       = make(state.SimpleContext)
+		super     = compose.AsSuperMachine(agent.New(make(chan struct{}, 1), 1))
+		sub       = NewSubagent(super, relay)
+		connected = make(chan struct{})
+		done      = make(chan struct{})
+	)
+	observer := state.ObserverFunc(func(_ state.Fn, _ state.Event, to state.Fn) {
+		if state.FuncName(to) == state.FuncName(celebrating) {
+			close(connected)
+		}
+	})
+	go func() {
+		defer close(done)
+		state.Run(ctx, sub, observer)
+	}()
+
+	// the Disconnected state of the agent transitions to the Connected state
+	// of the sub-state machine
+	sub.Sink() <- &agent.ConnectRequest{}
+	<-connected
+	ctx.Cancel()
+	<-done
+	// Output:
+	// connected!
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cover records the state transitions exercised by tests and reports
+// the edges of a transition graph that were never covered.
+//
+// Transitions are recorded by packages that run their tests via Main:
+//
+//	func TestMain(m *testing.M) { os.Exit(cover.Main(m)) }
+//
+// and are written to the profile named by the STATECOVERPROFILE environment
+// variable. Profiles of several packages accumulate in the same file, which is
+// reported upon by `gosm cover`:
+//
+//	STATECOVERPROFILE=$PWD/edges.out go test ./...
+//	gosm cover -dir ./demo/agent -html edges.html edges.out
+package cover
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jdef/state"
+)
+
+// ProfileEnv names the environment variable that Main reads the path of the
+// profile from.
+const ProfileEnv = "STATECOVERPROFILE"
+
+const profileHeader = "mode: transitions"
+
+type (
+	// Edge is a recorded transition: From and To are fully-qualified state func
+	// names (see state.FuncName), To is empty if the machine terminated. Event
+	// is the name of the event that triggered the transition (see state.EventName),
+	// empty if unknown.
+	Edge struct {
+		From, Event, To string
+	}
+
+	// Profile counts the number of times that each Edge was taken.
+	Profile map[Edge]int
+
+	// Recorder is a state.Observer that records transitions.
+	Recorder struct {
+		mu      sync.Mutex
+		profile Profile
+	}
+)
+
+// Recorder implements state.Observer
+var _ state.Observer = &Recorder{}
+
+func NewRecorder() *Recorder { return &Recorder{profile: Profile{}} }
+
+func (r *Recorder) Observe(from state.Fn, e state.Event, to state.Fn) {
+	if from == nil {
+		return // entering the initial state isn't a transition
+	}
+	edge := Edge{From: state.FuncName(from), Event: state.EventName(e), To: state.FuncName(to)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.profile[edge]++
+}
+
+// Profile returns a copy of the transitions recorded so far.
+func (r *Recorder) Profile() Profile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := Profile{}
+	p.Merge(r.profile)
+	return p
+}
+
+// Main runs the tests of a package while recording the transitions of every
+// state.Run. If ProfileEnv names a file then recorded transitions are appended
+// to it. Returns the exit code for os.Exit.
+func Main(m *testing.M) int {
+	path := os.Getenv(ProfileEnv)
+	if path == "" {
+		return m.Run()
+	}
+
+	state.TraceEvents()
+	rec := NewRecorder()
+	remove := state.AddObserver(rec)
+	code := m.Run()
+	remove()
+
+	if err := rec.Profile().AppendTo(path); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write transition profile: %v\n", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+// Merge adds the counts of another profile to this one.
+func (p Profile) Merge(other Profile) {
+	for e, n := range other {
+		p[e] += n
+	}
+}
+
+// WriteTo writes the profile in text form, one edge per line, ordered by edge.
+func (p Profile) WriteTo(w io.Writer) (int64, error) {
+	edges := make([]Edge, 0, len(p))
+	for e := range p {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		a, b := edges[i], edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.Event != b.Event {
+			return a.Event < b.Event
+		}
+		return a.To < b.To
+	})
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, profileHeader)
+	for _, e := range edges {
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%d\n", field(e.From), field(e.Event), field(e.To), p[e])
+	}
+	return buf.WriteTo(w)
+}
+
+// AppendTo appends the profile to the named file, creating it if necessary.
+// The profile is written with a single write so that concurrently running test
+// binaries may share a file.
+func (p Profile) AppendTo(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadProfile parses a profile written by WriteTo or AppendTo; profiles that
+// were appended to the same file are merged.
+func ReadProfile(r io.Reader) (Profile, error) {
+	var (
+		p    = Profile{}
+		scan = bufio.NewScanner(r)
+		line = 0
+	)
+	for scan.Scan() {
+		line++
+		text := strings.TrimSpace(scan.Text())
+		if text == "" || text == profileHeader {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected 4 fields, found %d", line, len(fields))
+		}
+		n, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		p[Edge{From: unfield(fields[0]), Event: unfield(fields[1]), To: unfield(fields[2])}] += n
+	}
+	return p, scan.Err()
+}
+
+// ReadProfileFile reads and merges the named profiles.
+func ReadProfileFile(paths ...string) (Profile, error) {
+	p := Profile{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		q, err := ReadProfile(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		p.Merge(q)
+	}
+	return p, nil
+}
+
+func field(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func unfield(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
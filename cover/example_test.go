@@ -0,0 +1,88 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cover_test
+
+import (
+	"os"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/cover"
+	"github.com/jdef/state/graph"
+	"github.com/jdef/state/spec"
+)
+
+type (
+	Start struct{ state.AbstractEvent }
+	Stop  struct{ state.AbstractEvent }
+)
+
+func idle(ctx state.Context, m state.Machine) state.Fn {
+	select {
+	case e := <-m.Source():
+		if _, ok := e.(*Start); ok {
+			return running
+		}
+		return idle
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func running(ctx state.Context, m state.Machine) state.Fn {
+	select {
+	case <-m.Source():
+		return stopped
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func stopped(state.Context, state.Machine) state.Fn { return nil }
+
+func Example() {
+	state.TraceEvents()
+
+	m := state.NewSimpleMachine(2, idle)
+	m.Sink() <- &Start{}
+	m.Sink() <- &Stop{}
+
+	rec := cover.NewRecorder()
+	state.Run(make(state.SimpleContext), m, rec)
+
+	s, err := spec.Parse([]byte(`
+type: Runner
+initial: Idle
+states: [{name: Idle}, {name: Running}, {name: Stopped, final: true}]
+events: [Start, Stop]
+transitions:
+  - {from: Idle, event: Start, to: Running}
+  - {from: Running, event: Stop, to: Stopped}
+`))
+	if err != nil {
+		panic(err)
+	}
+	rec.Profile().WriteTo(os.Stdout)
+	cover.NewReport(graph.FromSpec(s), rec.Profile(), "github.com/jdef/state/cover_test").WriteText(os.Stdout)
+	// Output:
+	// mode: transitions
+	// github.com/jdef/state/cover_test.idle	Start	github.com/jdef/state/cover_test.running	1
+	// github.com/jdef/state/cover_test.running	Stop	github.com/jdef/state/cover_test.stopped	1
+	// github.com/jdef/state/cover_test.stopped	-	-	1
+	// transition coverage: 50.0% of edges (2/4)
+	// not covered: Idle -(cancel)-> nil
+	// not covered: Running -(cancel)-> nil
+}
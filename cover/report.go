@@ -0,0 +1,178 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cover
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+
+	"github.com/jdef/state/graph"
+)
+
+type (
+	// EdgeCoverage is the number of times that an edge of a graph was taken.
+	EdgeCoverage struct {
+		graph.Edge
+		Count int
+	}
+
+	Report struct {
+		Edges []EdgeCoverage
+	}
+)
+
+// NewReport matches the transition edges of a graph against a profile. Nodes
+// of the graph are matched to recorded state funcs by their Func name; if pkg
+// isn't empty then only state funcs of the package with that import path are
+// matched. Internal edges aren't transitions and so aren't reported.
+//
+// A transition that's triggered by cancellation may be recorded with an event
+// that was handled earlier in the same state, so cancel edges are covered by
+// any recorded transition between the same states that isn't explained by an
+// event edge of the graph.
+func NewReport(g *graph.Graph, p Profile, pkg string) *Report {
+	funcOf := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		if n := g.Node(name); n != nil {
+			return n.Func
+		}
+		return "\x00" // unknown node, never matches
+	}
+	matches := func(recorded, fn string) bool {
+		if fn == "" {
+			return recorded == ""
+		}
+		if pkg != "" {
+			return recorded == pkg+"."+fn
+		}
+		return strings.HasSuffix(recorded, "."+fn)
+	}
+	explained := func(e Edge, from, to string) bool {
+		for _, ge := range g.Edges {
+			if !ge.Cancel && !ge.Internal && ge.From == from && ge.To == to && ge.Event == e.Event {
+				return true
+			}
+		}
+		return false
+	}
+
+	r := &Report{}
+	for _, ge := range g.Edges {
+		if ge.Internal {
+			continue
+		}
+		ec := EdgeCoverage{Edge: ge}
+		from, to := funcOf(ge.From), funcOf(ge.To)
+		for e, n := range p {
+			if !matches(e.From, from) || !matches(e.To, to) {
+				continue
+			}
+			if ge.Cancel && (e.Event == "" || !explained(e, ge.From, ge.To)) || !ge.Cancel && e.Event == ge.Event {
+				ec.Count += n
+			}
+		}
+		r.Edges = append(r.Edges, ec)
+	}
+	return r
+}
+
+// Covered returns the number of covered edges.
+func (r *Report) Covered() (n int) {
+	for _, e := range r.Edges {
+		if e.Count > 0 {
+			n++
+		}
+	}
+	return
+}
+
+// Percent returns the percentage of covered edges.
+func (r *Report) Percent() float64 {
+	if len(r.Edges) == 0 {
+		return 100
+	}
+	return 100 * float64(r.Covered()) / float64(len(r.Edges))
+}
+
+// Uncovered returns the edges that were never taken.
+func (r *Report) Uncovered() (result []graph.Edge) {
+	for _, e := range r.Edges {
+		if e.Count == 0 {
+			result = append(result, e.Edge)
+		}
+	}
+	return
+}
+
+// WriteText writes a summary line followed by the uncovered edges.
+func (r *Report) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "transition coverage: %.1f%% of edges (%d/%d)\n", r.Percent(), r.Covered(), len(r.Edges))
+	for _, e := range r.Uncovered() {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintf(w, "not covered: %s\n", describe(e))
+	}
+	return err
+}
+
+// WriteHTML writes a page that lists every edge along with its count.
+func (r *Report) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, r)
+}
+
+func describe(e graph.Edge) string {
+	to := e.To
+	if to == "" {
+		to = "nil"
+	}
+	if e.Cancel {
+		return fmt.Sprintf("%s -(cancel)-> %s", e.From, to)
+	}
+	if e.Event == "" {
+		return fmt.Sprintf("%s -> %s", e.From, to)
+	}
+	return fmt.Sprintf("%s -(%s)-> %s", e.From, e.Event, to)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{"describe": describe}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Transition coverage</title>
+<style>
+body { font-family: sans-serif; }
+td, th { padding: 0.2em 1em; text-align: left; }
+tr.covered { background: #dfd; }
+tr.uncovered { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Transition coverage: {{printf "%.1f" .Percent}}%</h1>
+<table>
+<tr><th>Edge</th><th>Count</th></tr>
+{{- range .Edges}}
+<tr class="{{if .Count}}covered{{else}}uncovered{{end}}"><td>{{describe .Edge}}</td><td>{{.Count}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
@@ -20,6 +20,7 @@ package agent
 
 import (
 	"github.com/jdef/state"
+	"github.com/jdef/state/compose"
 )
 
 type (
@@ -43,8 +44,12 @@ type (
 	//
 
 	DisconnectRequest struct{ state.AbstractEvent }
-	ConnectRequest    struct{ state.AbstractEvent }
 	Heartbeat         struct{ state.AbstractEvent }
+
+	// ConnectRequest may be sent via state.Ask; the reply is true once the
+	// agent has connected. Agents that are already connected discard the
+	// request, see state.Loop.
+	ConnectRequest struct{ state.Request }
 )
 
 // Agent implements Interface
@@ -66,47 +71,33 @@ func (a *Agent) get() *Agent { return a }
 func disconnected(ctx state.Context, m state.Machine) state.Fn {
 	println("disconnected")
 	defer println("<leaving disconnected>")
-	agent := m.(Interface)
-	next := state.Next(m) // support hijackers
-	for {
-		select {
-		case event := <-m.Source():
-			switch event := event.(type) {
-			case *ConnectRequest:
+	return state.Loop{
+		Handlers: []state.EventHandler{
+			state.On(func(_ state.Context, m state.Machine, event *ConnectRequest) state.Fn {
+				agent := compose.As[Interface](m)
 				agent.get().doConnect(event)
 				return agent.Connected()
-			case *Heartbeat:
-				agent.get().doHeartbeat(ctx, event)
-			}
-		case fn := <-next:
-			return fn
-		case <-ctx.Done():
-			return agent.Terminating()
-		}
-	}
+			}),
+			state.On(heartbeat),
+		},
+		OnCancel: terminate,
+	}.Run(ctx, m)
 }
 
 func connected(ctx state.Context, m state.Machine) state.Fn {
 	println("connected")
 	defer println("<leaving connected>")
-	agent := m.(Interface)
-	next := state.Next(m) // support hijackers
-	for {
-		select {
-		case event := <-m.Source():
-			switch event := event.(type) {
-			case *DisconnectRequest:
+	return state.Loop{
+		Handlers: []state.EventHandler{
+			state.On(func(_ state.Context, m state.Machine, event *DisconnectRequest) state.Fn {
+				agent := compose.As[Interface](m)
 				agent.get().doDisconnect(event)
 				return agent.Disconnected()
-			case *Heartbeat:
-				agent.get().doHeartbeat(ctx, event)
-			}
-		case fn := <-next:
-			return fn
-		case <-ctx.Done():
-			return agent.Terminating()
-		}
-	}
+			}),
+			state.On(heartbeat),
+		},
+		OnCancel: terminate,
+	}.Run(ctx, m)
 }
 
 func terminating(ctx state.Context, m state.Machine) state.Fn {
@@ -115,8 +106,18 @@ func terminating(ctx state.Context, m state.Machine) state.Fn {
 	return nil
 }
 
-func (a *Agent) doConnect(_ *ConnectRequest) {
+func heartbeat(ctx state.Context, m state.Machine, event *Heartbeat) state.Fn {
+	compose.As[Interface](m).get().doHeartbeat(ctx, event)
+	return state.Stay
+}
+
+func terminate(_ state.Context, m state.Machine) state.Fn {
+	return compose.As[Interface](m).Terminating()
+}
+
+func (a *Agent) doConnect(e *ConnectRequest) {
 	println("do-connect")
+	e.Reply(true)
 }
 
 func (a *Agent) doDisconnect(_ *DisconnectRequest) {
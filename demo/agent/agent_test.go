@@ -0,0 +1,45 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent_test
+
+import (
+	"testing"
+
+	"github.com/jdef/state/demo/agent"
+	"github.com/jdef/state/statetest"
+)
+
+func TestConnectDisconnect(t *testing.T) {
+	var (
+		pulse = make(chan struct{}, 1)
+		a     = agent.New(pulse, 1)
+		h     = statetest.Start(t, a)
+	)
+
+	h.Expect(a.Disconnected())
+	h.Send(&agent.ConnectRequest{})
+	h.Expect(a.Connected())
+
+	h.Send(&agent.Heartbeat{})
+	<-pulse
+
+	h.Send(&agent.DisconnectRequest{})
+	h.Expect(a.Disconnected())
+
+	h.Stop()
+	h.ExpectVisited(a.Disconnected(), a.Connected(), a.Disconnected(), a.Terminating())
+}
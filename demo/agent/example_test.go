@@ -17,13 +17,21 @@ limitations under the License.
 package agent_test
 
 import (
+	"fmt"
+
 	"github.com/jdef/state/demo"
 	"github.com/jdef/state/demo/agent"
+	"github.com/jdef/state/statetest"
 )
 
 func ExampleRunWith_agent() {
-	pulse := make(chan struct{})
-	agent := agent.New(pulse, 10)
-	demo.RunWith(agent, pulse)
+	var (
+		pulse   = make(chan struct{})
+		agent   = agent.New(pulse, 10)
+		visited = statetest.NewRecorder()
+	)
+	demo.RunWith(agent, pulse, visited)
+	fmt.Println(visited)
 	// Output:
+	// agent.disconnected -> agent.connected -> agent.disconnected -> agent.terminating
 }
@@ -21,6 +21,10 @@ limitations under the License.
 package agent
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/jdef/state"
 )
 
@@ -34,18 +38,62 @@ type (
 		Interface
 		state.Transition
 		state.SuperMachine
+		state.HijackPolicy
 
 		// SubMachineInterface is a convenience func to create package-
 		// specific sub-state machines.
 		SubMachineInterface(int, state.Fn) SubMachineInterface
+
+		// SubMachines returns the attached sub-state machines, in the order
+		// that they were attached.
+		SubMachines() []SubMachineInterface
+
+		// Broadcast sends an event to every attached sub-state machine, in
+		// the order that they were attached, until the Context is done.
+		Broadcast(state.Context, state.Event)
+
+		// Preempt redirects every attached sub-state machine to the given
+		// state (see state.Preempt), for example to shut them down in an
+		// emergency. The sub-state machines are preempted concurrently, each
+		// within the timeout; the errors of those that aren't preempted are
+		// joined, see errors.Join.
+		Preempt(state.Context, state.Fn, time.Duration) error
 	}
 
 	superMachineInterfaceImpl struct {
 		Interface
 		hijackChan chan state.Fn
+
+		mu   sync.Mutex
+		subs []*subMachineInterfaceImpl
+	}
+
+	// laneInterface is the super-state machine as seen by a single sub-state
+	// machine: it has its own event queue and hijack chan, so that the
+	// super-states that one sub-state machine delegates to (see Masquerade)
+	// never read the events, or the hijacks, of another.
+	laneInterface struct {
+		*superMachineInterfaceImpl
+		events     chan state.Event
+		hijackChan chan state.Fn
 	}
 )
 
+// AsSuperMachine returns a super-state machine that any number of sub-state
+// machines may be attached to, see SubMachine. Every sub-state machine has a
+// lane of its own: a hijack by a sub-state machine (via its Super) is only
+// received by the super-states that it delegates to, and events that it
+// dispatches are only read by those super-states. Hijacks that are sent to the
+// Hijack chan of the super-state machine itself, which is read by its states
+// if it's run directly, are accepted first-come, first-served.
+//
+// Events that are sent to the Sink of the super-state machine itself are only
+// read by its own states, if it's run directly: they don't reach the
+// super-states that sub-state machines delegate to (see Masquerade), which read
+// their lanes instead. This is a breaking change for code that fed the
+// super-states of sub-state machines via the Sink of the super-state machine;
+// send such events to the sub-state machines instead (see Broadcast), or
+// dispatch them from the sub-state machines (see Dispatch).
 func AsSuperMachine(i Interface) SuperMachineInterface {
 	return &superMachineInterfaceImpl{Interface: i, hijackChan: make(chan state.Fn)}
 }
@@ -58,6 +106,74 @@ func (a *superMachineInterfaceImpl) SubMachineInterface(queueLen int, initialFn
 	return a.SubMachine(queueLen, initialFn).(SubMachineInterface)
 }
 
+// AcceptHijack vetoes hijacks (see state.Hijack) if the underlying Interface
+// implements state.HijackPolicy, otherwise all hijacks are accepted.
+func (a *superMachineInterfaceImpl) AcceptHijack(target state.Fn) error {
+	if p, ok := a.Interface.(state.HijackPolicy); ok {
+		return p.AcceptHijack(target)
+	}
+	return nil
+}
+
+func (a *superMachineInterfaceImpl) SubMachines() []SubMachineInterface {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	subs := make([]SubMachineInterface, 0, len(a.subs))
+	for _, m := range a.subs {
+		subs = append(subs, m)
+	}
+	return subs
+}
+
+func (a *superMachineInterfaceImpl) Broadcast(ctx state.Context, e state.Event) {
+	for _, m := range a.SubMachines() {
+		select {
+		case <-ctx.Done():
+			return
+		case m.Sink() <- e:
+		}
+	}
+}
+
+func (a *superMachineInterfaceImpl) Preempt(ctx state.Context, target state.Fn, timeout time.Duration) error {
+	var (
+		subs = a.SubMachines()
+		errs = make([]error, len(subs))
+		wg   sync.WaitGroup
+	)
+	for i, m := range subs {
+		wg.Add(1)
+		go func(i int, m SubMachineInterface) {
+			defer wg.Done()
+			errs[i] = state.Preempt(ctx, m, target, timeout)
+		}(i, m)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (a *superMachineInterfaceImpl) attach(m *subMachineInterfaceImpl) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.subs = append(a.subs, m)
+}
+
+func (a *superMachineInterfaceImpl) detach(m *subMachineInterfaceImpl) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, x := range a.subs {
+		if x == m {
+			a.subs = append(a.subs[:i:i], a.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *laneInterface) Source() <-chan state.Event { return l.events }
+func (l *laneInterface) Sink() chan<- state.Event   { return l.events }
+func (l *laneInterface) NextState() <-chan state.Fn { return l.hijackChan }
+func (l *laneInterface) Hijack() chan<- state.Fn    { return l.hijackChan }
+
 /*
  * sub-state machine helper code follows
  */
@@ -67,27 +183,88 @@ type (
 	SubMachineInterface interface {
 		Interface
 		state.Transition
+		state.Hijackable
 		state.SubMachine
+		state.Handoff
+
+		// Detach detaches the sub-state machine from its super-state machine:
+		// it no longer receives broadcasts. Its lane remains usable, so that
+		// the sub-state machine may be run to completion.
+		Detach()
+
+		// Use processes the events that the sub-state machine dispatches (see
+		// Dispatch) by the given middleware, e.g. a middleware.Chain. Use is
+		// meant to be invoked before the sub-state machine runs.
+		Use(state.Middleware)
+
+		impl() *subMachineInterfaceImpl
 	}
 
 	// subMachineInterfaceImpl is a helper for quickly building sub-state machines that
 	// extend Agent functionality. Sub-state machines typically need their
-	// own event queue and may want to override the initial state func.
+	// own event queue and may want to override the initial state func. They
+	// may be preempted by their super-state machine, see state.Preempt.
 	subMachineInterfaceImpl struct {
 		SuperMachineInterface
+		super        *superMachineInterfaceImpl
 		events       chan state.Event
+		preempt      chan state.Fn
 		initialState state.Fn
+		middleware   state.Middleware
 	}
 )
 
 // subMachineInterfaceImpl implements state.SubMachineInterface
 var _ SubMachineInterface = &subMachineInterfaceImpl{}
 
-func newSubMachine(super SuperMachineInterface, queueLength int, initialState state.Fn) state.SubMachine {
-	return &subMachineInterfaceImpl{
-		SuperMachineInterface: super,
-		events:                make(chan state.Event, queueLength),
-		initialState:          initialState,
+// newSubMachine attaches a new sub-state machine to the super-state machine. The
+// queue of its lane is as long as the queue of the super-state machine.
+func newSubMachine(super *superMachineInterfaceImpl, queueLength int, initialState state.Fn) state.SubMachine {
+	m := &subMachineInterfaceImpl{
+		SuperMachineInterface: &laneInterface{
+			superMachineInterfaceImpl: super,
+			events:                    make(chan state.Event, cap(super.Interface.Sink())),
+			hijackChan:                make(chan state.Fn),
+		},
+		super:        super,
+		events:       make(chan state.Event, queueLength),
+		preempt:      make(chan state.Fn),
+		initialState: initialState,
+	}
+	super.attach(m)
+	return m
+}
+
+func (m *subMachineInterfaceImpl) Detach() { m.super.detach(m) }
+
+func (m *subMachineInterfaceImpl) Use(mw state.Middleware) { m.middleware = mw }
+
+func (m *subMachineInterfaceImpl) impl() *subMachineInterfaceImpl { return m }
+
+// Handoff detaches the sub-state machine, and hands the events that remain
+// queued by its lane over to the lane of its successor, provided that's a
+// sub-state machine of the same super-state machine. See state.Host.
+func (m *subMachineInterfaceImpl) Handoff(ctx state.Context, to state.Machine) {
+	m.Detach()
+	next, ok := to.(interface{ impl() *subMachineInterfaceImpl })
+	if !ok || next.impl().super != m.super {
+		return
+	}
+	var (
+		from = m.SuperMachineInterface.Source()
+		sink = next.impl().SuperMachineInterface.Sink()
+	)
+	for {
+		select {
+		case e := <-from:
+			select {
+			case sink <- e:
+			case <-ctx.Done():
+				return
+			}
+		default:
+			return
+		}
 	}
 }
 
@@ -98,11 +275,19 @@ func (m *subMachineInterfaceImpl) InitialState() state.Fn {
 	return m.SuperMachineInterface.InitialState()
 }
 
-// Dispatch sends an event to the super-state machine. The super-state machine should
-// probably have a buffered event queue if there's a party external to the state
-// machine substrate that's also feeding events into the machine, otherwise this
-// may block indefinitely.
+// Dispatch sends an event to the super-states that the sub-state machine delegates
+// to, via its lane. The super-state machine should probably have a buffered event
+// queue (which determines the length of the lane's queue) if there's a party external
+// to the state machine substrate that's also feeding events into the machine, otherwise
+// this may block indefinitely. Events that are dropped by middleware (see Use)
+// aren't sent.
 func (m *subMachineInterfaceImpl) Dispatch(ctx state.Context, e state.Event) {
+	if m.middleware != nil {
+		var err error
+		if e, err = m.middleware.Process(ctx, e); err != nil {
+			return
+		}
+	}
 	select {
 	case <-ctx.Done():
 		return
@@ -113,14 +298,18 @@ func (m *subMachineInterfaceImpl) Dispatch(ctx state.Context, e state.Event) {
 func (m *subMachineInterfaceImpl) Source() <-chan state.Event                { return m.events }
 func (m *subMachineInterfaceImpl) Sink() chan<- state.Event                  { return m.events }
 func (m *subMachineInterfaceImpl) Super() state.SuperMachine                 { return m.SuperMachineInterface }
-func (m *subMachineInterfaceImpl) Hijack() chan<- state.Fn                   { return nil } // is not hijackable
-func (m *subMachineInterfaceImpl) NextState() <-chan state.Fn                { return nil } // is not hijackable
-func (m *subMachineInterfaceImpl) SubMachine(int, state.Fn) state.SubMachine { return nil } // is not hijackable
+func (m *subMachineInterfaceImpl) Hijack() chan<- state.Fn                   { return m.preempt }
+func (m *subMachineInterfaceImpl) NextState() <-chan state.Fn                { return m.preempt }
+func (m *subMachineInterfaceImpl) SubMachine(int, state.Fn) state.SubMachine { return nil } // is not extensible
+
+// AcceptHijack accepts all hijacks: the super-state machine's policy (see
+// state.HijackPolicy) applies to hijacks of the super-state machine only.
+func (m *subMachineInterfaceImpl) AcceptHijack(state.Fn) error { return nil }
 
 // Masquerade returns a reference to an imposter of the super-machine that may
 // be passed to the super-machine's state handlers for upstream event delegation.
-// The Source of the returned instance is expected to reference the source event
-// stream of the actual super-machine. All other interface funcs may be overridden
+// The Source of the returned instance references the source event stream of the
+// sub-machine's lane of the super-machine. All other interface funcs may be overridden
 // by the sub-machine implementation.
 func Masquerade(m SubMachineInterface) state.Machine { return &masqInterface{m} }
 
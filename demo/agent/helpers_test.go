@@ -0,0 +1,271 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/demo/agent"
+	"github.com/jdef/state/middleware"
+	"github.com/jdef/state/statetest"
+)
+
+type hijackRequest struct{ state.AbstractEvent }
+
+// relay delegates to the Disconnected state of the super-state machine, which
+// it extends by hijacking upon request.
+func relay(ctx state.Context, m state.Machine) state.Fn {
+	sub := agent.AsSub(m)
+	t := state.Delegate(ctx, agent.SuperOf(sub).Disconnected(), agent.Masquerade(sub))
+	defer t.Stop()
+	for {
+		select {
+		case e := <-m.Source():
+			if _, ok := e.(*hijackRequest); ok {
+				if f, ok := state.TryHijack(sub.Super(), ctx, hijacked, t); ok {
+					return f
+				}
+				return nil
+			}
+			sub.Dispatch(ctx, e)
+		case f := <-t.NextState():
+			return f
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func hijacked(ctx state.Context, _ state.Machine) state.Fn {
+	<-ctx.Done()
+	return nil
+}
+
+func TestSuperMachine_Broadcast(t *testing.T) {
+	var (
+		a     = agent.New(make(chan struct{}, 1), 1)
+		super = agent.AsSuperMachine(a)
+		sub1  = super.SubMachineInterface(0, relay)
+		sub2  = super.SubMachineInterface(0, relay)
+		h1    = statetest.Start(t, sub1)
+		h2    = statetest.Start(t, sub2)
+		ctx   = make(state.SimpleContext)
+	)
+	defer ctx.Cancel()
+	if subs := super.SubMachines(); len(subs) != 2 || subs[0] != sub1 || subs[1] != sub2 {
+		t.Fatalf("unexpected sub-state machines %v", subs)
+	}
+
+	// every sub-state machine receives the event, and dispatches it to the
+	// super-state that it delegates to
+	super.Broadcast(ctx, &agent.ConnectRequest{})
+	h1.Expect(a.Connected())
+	h2.Expect(a.Connected())
+
+	sub2.Detach()
+	super.Broadcast(ctx, &agent.DisconnectRequest{})
+	h1.Expect(a.Disconnected())
+
+	h1.Stop()
+	h2.Stop()
+	h1.ExpectVisited(relay, a.Connected(), a.Disconnected(), a.Terminating())
+	h2.ExpectVisited(relay, a.Connected(), a.Terminating())
+}
+
+func TestSuperMachine_concurrentHijacks(t *testing.T) {
+	var (
+		super = agent.AsSuperMachine(agent.New(make(chan struct{}, 1), 1))
+		sub1  = super.SubMachineInterface(0, relay)
+		sub2  = super.SubMachineInterface(0, relay)
+		h1    = statetest.Start(t, sub1)
+		h2    = statetest.Start(t, sub2)
+		ctx   = make(state.SimpleContext)
+	)
+	defer ctx.Cancel()
+
+	// the hijack of each sub-state machine is received by the super-state
+	// that it delegates to, and no other
+	super.Broadcast(ctx, &hijackRequest{})
+	h1.Expect(hijacked)
+	h2.Expect(hijacked)
+}
+
+// cautiousAgent vetoes hijacks while it's connected.
+type cautiousAgent struct {
+	agent.Interface
+	connected chan bool
+}
+
+func (a *cautiousAgent) AcceptHijack(target state.Fn) error {
+	if <-a.connected {
+		return errors.New("connected")
+	}
+	return nil
+}
+
+func TestSuperMachine_AcceptHijack(t *testing.T) {
+	var (
+		a     = &cautiousAgent{Interface: agent.New(make(chan struct{}, 1), 1), connected: make(chan bool, 1)}
+		super = agent.AsSuperMachine(a)
+		sub   = super.SubMachineInterface(0, relay)
+		h     = statetest.Start(t, sub)
+	)
+	a.connected <- true
+	h.Send(&hijackRequest{})
+	h.ExpectVisited(relay) // vetoed: relay terminates
+
+	sub = super.SubMachineInterface(0, relay)
+	h = statetest.Start(t, sub)
+	a.connected <- false
+	h.Send(&hijackRequest{})
+	h.Expect(hijacked)
+}
+
+func TestSuperMachine_Preempt(t *testing.T) {
+	var (
+		a      = agent.New(make(chan struct{}, 1), 1)
+		super  = agent.AsSuperMachine(a)
+		sub1   = super.SubMachineInterface(0, a.Connected())
+		sub2   = super.SubMachineInterface(0, a.Connected())
+		h1     = statetest.Start(t, sub1)
+		h2     = statetest.Start(t, sub2)
+		ctx    = make(state.SimpleContext)
+		resume = make(chan struct{})
+		paused = state.Pause(resume, a.Disconnected())
+	)
+	defer ctx.Cancel()
+	h1.Expect(a.Connected())
+	h2.Expect(a.Connected())
+
+	// forced reconnect, by way of a pause
+	if err := super.Preempt(ctx, paused, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	h1.Expect(paused)
+	h2.Expect(paused)
+	close(resume)
+	h1.Expect(a.Disconnected())
+	h2.Expect(a.Disconnected())
+
+	// emergency shutdown
+	if err := super.Preempt(ctx, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	h1.ExpectVisited(a.Connected(), paused, a.Disconnected())
+	h2.ExpectVisited(a.Connected(), paused, a.Disconnected())
+	if !h1.WaitTerminated(time.Second) || !h2.WaitTerminated(time.Second) {
+		t.Fatal("expected preempted machines to terminate")
+	}
+	sub1.Detach()
+	sub2.Detach()
+
+	// hijacked doesn't support preemption, which doesn't keep the others
+	// from being preempted
+	var (
+		h  = statetest.Start(t, super.SubMachineInterface(0, hijacked))
+		h3 = statetest.Start(t, super.SubMachineInterface(0, a.Connected()))
+	)
+	h3.Expect(a.Connected())
+	if err := super.Preempt(ctx, nil, 10*time.Millisecond); !errors.Is(err, state.ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if !h3.WaitTerminated(time.Second) {
+		t.Fatal("expected the preemptable machine to terminate")
+	}
+	h.Stop()
+}
+
+// stalled dispatches the events that it receives to its lane, but doesn't
+// delegate to the super-state machine: the events remain queued by the lane.
+func stalled(dispatched chan<- struct{}) state.Fn {
+	return func(ctx state.Context, m state.Machine) state.Fn {
+		sub := agent.AsSub(m)
+		for {
+			select {
+			case e := <-m.Source():
+				sub.Dispatch(ctx, e)
+				dispatched <- struct{}{}
+			case f := <-state.Next(m):
+				return f
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func TestSuperMachine_Handoff(t *testing.T) {
+	var (
+		a          = agent.New(make(chan struct{}, 1), 1)
+		super      = agent.AsSuperMachine(a)
+		dispatched = make(chan struct{}, 1)
+		sub1       = super.SubMachineInterface(0, stalled(dispatched))
+		host       = state.NewHost(0, sub1)
+		r          = statetest.NewRecorder()
+		ctx        = make(state.SimpleContext)
+		exited     = make(chan struct{})
+	)
+	go func() {
+		defer close(exited)
+		host.Run(ctx, r)
+	}()
+	defer func() {
+		ctx.Cancel()
+		<-exited
+	}()
+
+	host.Sink() <- &agent.ConnectRequest{}
+	<-dispatched
+
+	// the connect request that's queued by the lane of sub1 is received by
+	// the super-state that sub2 delegates to
+	sub2 := super.SubMachineInterface(0, relay)
+	if err := host.Swap(ctx, sub2); err != nil {
+		t.Fatal(err)
+	}
+	if !r.WaitFor(a.Connected(), time.Second) {
+		t.Fatalf("expected %s, visited %s", statetest.Name(a.Connected()), r)
+	}
+	if subs := super.SubMachines(); len(subs) != 1 || subs[0] != sub2 {
+		t.Fatalf("expected sub1 to be detached, got %v", subs)
+	}
+}
+
+func TestSubMachine_Use(t *testing.T) {
+	var (
+		a       = agent.New(make(chan struct{}, 1), 1)
+		super   = agent.AsSuperMachine(a)
+		sub     = super.SubMachineInterface(0, relay)
+		dropped = make(chan middleware.Drop, 1)
+		chain   = middleware.New(middleware.Except("ConnectRequest"))
+	)
+	chain.OnDrop = func(d middleware.Drop) { dropped <- d }
+	sub.Use(chain)
+	h := statetest.Start(t, sub)
+
+	// the connect request is dropped on its way to the super-state
+	h.Send(&agent.ConnectRequest{})
+	if d := <-dropped; d.Reason != middleware.ErrFiltered {
+		t.Fatalf("unexpected drop %+v", d)
+	}
+	h.Send(&hijackRequest{})
+	h.Expect(hijacked)
+	h.ExpectVisited(relay, hijacked)
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/jdef/state"
 	"github.com/jdef/state/demo/agent"
+	"github.com/jdef/state/middleware"
 )
 
 func logPulse(ctx state.Context, pulse <-chan struct{}) {
@@ -50,18 +51,25 @@ func sendHeartbeat(ctx state.Context, sink state.EventSink) {
 	}
 }
 
-func RunWith(a agent.Interface, pulse chan struct{}) {
+// RunWith runs the agent through a scripted scenario: connect, disconnect and
+// terminate. The observers are notified of every state transition.
+func RunWith(a agent.Interface, pulse chan struct{}, observers ...state.Observer) {
 	ctx := make(state.SimpleContext)
 
 	ch := make(chan struct{})
 	go func() {
 		defer close(ch)
-		state.Run(ctx, a)
+		state.Run(ctx, a, observers...)
 	}()
 
 	// ping pong
 	go logPulse(ctx, pulse)
-	go sendHeartbeat(ctx, a)
+	// heartbeats that arrive while the agent is busy are merged, so that they
+	// don't back up its queue
+	shaper := &middleware.Shaper{
+		Policies: map[string]middleware.Policy{"Heartbeat": middleware.Coalesce()},
+	}
+	go sendHeartbeat(ctx, shaper.Sink(ctx, a, 0))
 
 	time.Sleep(2 * time.Second)
 
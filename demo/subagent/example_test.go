@@ -17,14 +17,22 @@ limitations under the License.
 package subagent_test
 
 import (
+	"fmt"
+
 	"github.com/jdef/state/demo"
 	"github.com/jdef/state/demo/agent"
 	"github.com/jdef/state/demo/subagent"
+	"github.com/jdef/state/statetest"
 )
 
 func ExampleRunWith_subagent() {
-	pulse := make(chan struct{})
-	agent := subagent.New(agent.AsSuperMachine(agent.New(pulse, 10)))
-	demo.RunWith(agent, pulse)
+	var (
+		pulse   = make(chan struct{})
+		agent   = subagent.New(agent.AsSuperMachine(agent.New(pulse, 10)))
+		visited = statetest.NewRecorder()
+	)
+	demo.RunWith(agent, pulse, visited)
+	fmt.Println(visited)
 	// Output:
+	// subagent.happilyDisconnected -> subagent.connectedStage1 -> subagent.connectedStage2 -> subagent.happilyDisconnected -> subagent.happilyTerminating
 }
@@ -60,9 +60,11 @@ func happilyTerminating(ctx state.Context, m state.Machine) state.Fn {
 
 	// we'd normally clean up any resources here.
 	// there's no good reason for overriding the terminating state in this
-	// case, we just do it for demo purposes.
+	// case, we just do it for demo purposes. the terminating state of the
+	// super-state machine is final, so this one is too.
 
-	return agent.SuperOf(subagent).Terminating()(ctx, agent.Masquerade(subagent))
+	agent.SuperOf(subagent).Terminating()(ctx, agent.Masquerade(subagent))
+	return nil
 }
 
 func happilyDisconnected(ctx state.Context, m state.Machine) state.Fn {
@@ -71,28 +73,22 @@ func happilyDisconnected(ctx state.Context, m state.Machine) state.Fn {
 
 	var (
 		subagent = agent.AsSub(m)
-		t        = state.Upon(agent.SuperOf(subagent).Disconnected(), ctx, agent.Masquerade(subagent))
+		t        = state.Delegate(ctx, agent.SuperOf(subagent).Disconnected(), agent.Masquerade(subagent))
 	)
+	defer t.Stop() // wait for the delegated super-state to exit
 
-	for {
-		select {
-		case event := <-m.Source():
-
-			switch event.(type) {
-			case *agent.ConnectRequest:
+	return state.Loop{
+		Handlers: []state.EventHandler{
+			state.On(func(ctx state.Context, _ state.Machine, event *agent.ConnectRequest) state.Fn {
 				println(".. happily connecting")
-
-			default:
-				// noop
-			}
-
-			// forward the event upstream
-			subagent.Dispatch(ctx, event)
-
-		case f := <-t.NextState():
-			return f
-		}
-	}
+				subagent.Dispatch(ctx, event)
+				return state.Stay
+			}),
+		},
+		Handle:   forward(subagent),
+		OnCancel: terminate,
+		Until:    t,
+	}.Run(ctx, m)
 }
 
 func connectedStage1(ctx state.Context, m state.Machine) state.Fn {
@@ -101,34 +97,30 @@ func connectedStage1(ctx state.Context, m state.Machine) state.Fn {
 
 	var (
 		subagent = agent.AsSub(m)
-		t        = state.Upon(agent.SuperOf(subagent).Connected(), ctx, agent.Masquerade(subagent))
+		t        = state.Delegate(ctx, agent.SuperOf(subagent).Connected(), agent.Masquerade(subagent))
 	)
+	defer t.Stop() // wait for the delegated super-state to exit
 
-	for {
-		select {
-		case event := <-m.Source():
-
-			switch event.(type) {
-			case *agent.DisconnectRequest:
+	return state.Loop{
+		Handlers: []state.EventHandler{
+			state.On(func(ctx state.Context, _ state.Machine, event *agent.DisconnectRequest) state.Fn {
 				println(".. happily disconnecting")
-
-			case *agent.Heartbeat:
+				subagent.Dispatch(ctx, event)
+				return state.Stay
+			}),
+			state.On(func(ctx state.Context, _ state.Machine, event *agent.Heartbeat) state.Fn {
 				println(".. happily entering connectedStage2")
-				f, ok := state.TryHijack(subagent.Super(), ctx, connectedStage2, t)
-				if ok {
+				if f, ok := state.TryHijack(subagent.Super(), ctx, connectedStage2, t); ok {
 					return f
 				}
-
-			default:
-			}
-
-			// forward the event upstream
-			subagent.Dispatch(ctx, event)
-
-		case f := <-t.NextState():
-			return f
-		}
-	}
+				subagent.Dispatch(ctx, event)
+				return state.Stay
+			}),
+		},
+		Handle:   forward(subagent),
+		OnCancel: terminate,
+		Until:    t,
+	}.Run(ctx, m)
 }
 
 func connectedStage2(ctx state.Context, m state.Machine) state.Fn {
@@ -137,26 +129,36 @@ func connectedStage2(ctx state.Context, m state.Machine) state.Fn {
 
 	var (
 		subagent = agent.AsSub(m)
-		t        = state.Upon(agent.SuperOf(subagent).Connected(), ctx, agent.Masquerade(subagent))
+		t        = state.Delegate(ctx, agent.SuperOf(subagent).Connected(), agent.Masquerade(subagent))
 	)
+	defer t.Stop() // wait for the delegated super-state to exit
 
-	for {
-		select {
-		case event := <-m.Source():
-
-			switch event.(type) {
-			case *agent.DisconnectRequest:
+	return state.Loop{
+		Handlers: []state.EventHandler{
+			state.On(func(ctx state.Context, _ state.Machine, event *agent.DisconnectRequest) state.Fn {
 				println(".. happily disconnecting")
+				subagent.Dispatch(ctx, event)
+				return state.Stay
+			}),
+		},
+		Handle:   forward(subagent),
+		OnCancel: terminate,
+		Until:    t,
+	}.Run(ctx, m)
+}
 
-			default:
-				// noop
-			}
-
-			// forward the event upstream
-			subagent.Dispatch(ctx, event)
+//
+// event handlers of the sub-state machine
+//
 
-		case f := <-t.NextState():
-			return f
-		}
+// forward forwards events upstream, to the delegated super-state.
+func forward(subagent agent.SubMachineInterface) state.Handler {
+	return func(ctx state.Context, _ state.Machine, event state.Event) state.Fn {
+		subagent.Dispatch(ctx, event)
+		return state.Stay
 	}
 }
+
+func terminate(_ state.Context, m state.Machine) state.Fn {
+	return agent.AsSub(m).Terminating()
+}
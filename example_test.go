@@ -46,7 +46,12 @@ func awaitEvent(ctx state.Context, m state.Machine) state.Fn {
 		default:
 		}
 
-		event := <-m.Source()
+		var event state.Event
+		select {
+		case event = <-m.Source():
+		case <-ctx.Done():
+			return nil
+		}
 
 		switch event.(type) {
 		case *pingEvent:
@@ -89,3 +94,67 @@ func Example() {
 	// pong
 	// ping
 }
+
+func ExampleDelegate() {
+	var (
+		m   = state.NewSimpleMachine(0, nil)
+		ctx = make(state.SimpleContext)
+	)
+	waitForever := func(ctx state.Context, m state.Machine) state.Fn {
+		<-ctx.Done()
+		fmt.Println("delegated state cancelled")
+		return nil
+	}
+
+	f := state.Delegate(ctx, waitForever, m)
+	f.Stop() // cancel the delegated state, and wait for it to exit
+	fmt.Println("delegator moves on")
+
+	// Output:
+	// delegated state cancelled
+	// delegator moves on
+}
+
+func ExampleRun_scopedContext() {
+	stopped := make(chan struct{})
+	watching := func(ctx state.Context, m state.Machine) state.Fn {
+		go func() {
+			// work tied to the state: stops once the state returns
+			<-ctx.Done()
+			fmt.Println("watcher stopped")
+			close(stopped)
+		}()
+		return nil
+	}
+
+	// the Context of the machine is never cancelled
+	state.Run(make(state.SimpleContext), state.NewSimpleMachine(0, watching))
+	<-stopped
+
+	// Output:
+	// watcher stopped
+}
+
+// requestContext is a custom Context that carries a request ID.
+type requestContext struct {
+	state.SimpleContext
+	id string
+}
+
+func (c requestContext) RequestID() string { return c.id }
+
+func ExampleRun_customContext() {
+	greeting := func(ctx state.Context, m state.Machine) state.Fn {
+		// the state's Context is derived from the custom Context
+		if r, ok := state.ContextAs[requestContext](ctx); ok {
+			fmt.Println("handling request", r.RequestID())
+		}
+		return nil
+	}
+
+	ctx := requestContext{SimpleContext: make(state.SimpleContext), id: "42"}
+	state.Run(ctx, state.NewSimpleMachine(0, greeting))
+
+	// Output:
+	// handling request 42
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+// Future is the eventual result of a state func that's been delegated to
+// another goroutine via Delegate. The delegated state func runs with its own
+// Context, derived from the Context of the delegator, that's cancelled by
+// Cancel or Stop. The delegator typically defers Stop so that the delegated
+// state has exited by the time the delegator transitions to another state:
+//
+//	t := state.Delegate(ctx, super.Connected(), agent.Masquerade(sub))
+//	defer t.Stop()
+type Future struct {
+	cancel CancelFunc
+	result chan Fn
+	exited chan struct{}
+}
+
+// Future implements Transition
+var _ Transition = &Future{}
+
+// Delegate invokes state func `f` in a new goroutine with a Context derived
+// from `ctx`, and returns a Future for the state func's result.
+func Delegate(ctx Context, f Fn, m Machine) *Future {
+	ctx, cancel := WithCancel(ctx)
+	fu := &Future{
+		cancel: cancel,
+		result: make(chan Fn, 1),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		defer close(fu.exited)
+		defer cancel()
+		fu.result <- f(ctx, m)
+	}()
+	return fu
+}
+
+// NextState returns a chan that yields the state returned by the delegated
+// state func, exactly once.
+func (fu *Future) NextState() <-chan Fn { return fu.result }
+
+// Done returns a chan that closes once the delegated state func has returned.
+func (fu *Future) Done() <-chan struct{} { return fu.exited }
+
+// Cancel cancels the Context of the delegated state func. It doesn't wait for
+// the state func to return, see Stop.
+func (fu *Future) Cancel() { fu.cancel() }
+
+// Stop cancels the Context of the delegated state func and waits for it to
+// return. It's safe to invoke Stop multiple times, or after the result of the
+// state func has been read.
+func (fu *Future) Stop() {
+	fu.cancel()
+	<-fu.exited
+}
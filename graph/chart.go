@@ -0,0 +1,104 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"fmt"
+
+	"github.com/jdef/state"
+)
+
+// FromChart returns the transition graph of a statechart. Every state and
+// pseudo-state is a node; the Parent of a nested node is the name of its
+// parent state. Besides the transitions of the chart, the graph has edges
+// without an event: from composite states to the child states that they
+// enter by default, from history pseudo-states to their parent state and
+// default target, and from choice and junction pseudo-states along each of
+// their branches, labeled with the guard of the branch. Delayed transitions
+// are labeled with an "after(<delay>)" event.
+//
+// Cancellation always terminates a chart machine, so the graph has no cancel
+// edges: dead states are those that have no path to a final top-level state.
+func FromChart(c *state.Chart) *Graph {
+	g := &Graph{}
+	if s := c.InitialChild(); s != nil {
+		g.Initial = s.Name()
+	}
+	events := map[string]bool{}
+	for _, s := range c.States() {
+		n := Node{Name: s.Name(), Final: s.IsFinal(), Kind: kindOf(s)}
+		if p := s.Parent(); p != nil {
+			n.Parent = p.Name()
+		}
+		g.Nodes = append(g.Nodes, n)
+
+		switch n.Kind {
+		case KindComposite:
+			if i := s.InitialChild(); i != nil {
+				g.Edges = append(g.Edges, Edge{From: n.Name, To: i.Name()})
+			}
+		case KindParallel:
+			for _, r := range s.Children() {
+				g.Edges = append(g.Edges, Edge{From: n.Name, To: r.Name()})
+			}
+		case KindHistory, KindDeepHistory:
+			g.Edges = append(g.Edges, Edge{From: n.Name, To: n.Parent})
+			if t := s.InitialChild(); t != nil {
+				g.Edges = append(g.Edges, Edge{From: n.Name, To: t.Name()})
+			}
+		case KindChoice, KindJunction:
+			for _, b := range s.Branches() {
+				guard := b.Guard
+				if guard == "" {
+					guard = "else"
+				}
+				g.Edges = append(g.Edges, Edge{From: n.Name, To: b.Target, Guard: guard})
+			}
+		}
+		for _, t := range s.Transitions() {
+			if t.After > 0 {
+				g.Edges = append(g.Edges, Edge{From: n.Name, Event: fmt.Sprintf("after(%v)", t.After), To: t.Target, Internal: t.Target == ""})
+				continue
+			}
+			g.Edges = append(g.Edges, Edge{From: n.Name, Event: t.Event, To: t.Target, Internal: t.Target == ""})
+			if t.Event != "" && !events[t.Event] {
+				events[t.Event] = true
+				g.Events = append(g.Events, t.Event)
+			}
+		}
+	}
+	return g
+}
+
+func kindOf(s *state.ChartState) string {
+	history, deep := s.IsHistory()
+	switch {
+	case history && deep:
+		return KindDeepHistory
+	case history:
+		return KindHistory
+	case s.IsChoice():
+		return KindChoice
+	case s.IsJunction():
+		return KindJunction
+	case s.IsParallel():
+		return KindParallel
+	case len(s.Children()) > 0:
+		return KindComposite
+	}
+	return KindState
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph_test
+
+import (
+	"fmt"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/graph"
+	"github.com/jdef/state/spec"
+)
+
+func ExampleCheck() {
+	s, err := spec.Parse([]byte(`
+type: Agent
+initial: Disconnected
+cancel: Terminating
+states:
+  - name: Disconnected
+  - name: Connected
+  - name: Degraded
+  - name: Orphaned
+  - name: Terminating
+    final: true
+events: [ConnectRequest, DisconnectRequest, Heartbeat, Reset, Shutdown]
+transitions:
+  - {from: Disconnected, event: ConnectRequest, to: Connected}
+  - {from: Disconnected, event: Shutdown, to: Terminating}
+  - {from: Connected, event: DisconnectRequest, to: Disconnected}
+  - {from: Connected, event: Heartbeat, to: Degraded}
+  - {from: Degraded, event: Heartbeat}
+`))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(graph.Check(graph.FromSpec(s)))
+	// Output:
+	// unreachable states: Orphaned
+	// states only terminated by cancellation: Degraded, Orphaned
+	// unhandled events: Reset
+	// states only left by cancellation: Degraded, Orphaned
+}
+
+func ExampleExtract() {
+	g, err := graph.Extract("../demo/agent")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("initial:", g.Initial)
+	for _, e := range g.Edges {
+		switch {
+		case e.Cancel:
+			fmt.Println(e.From, "-> (cancel) ->", e.To)
+		case e.Internal:
+			fmt.Println(e.From, "handles", e.Event)
+		default:
+			fmt.Println(e.From, "->", e.Event, "->", e.To)
+		}
+	}
+	// the agent only terminates upon cancellation, which isn't a problem
+	// unless the check is strict
+	r := graph.Check(g)
+	fmt.Println(r)
+	fmt.Println("ok:", r.Empty(), "strict:", r.Strict().Empty())
+	// Output:
+	// initial: Disconnected
+	// Disconnected -> ConnectRequest -> Connected
+	// Disconnected handles Heartbeat
+	// Disconnected -> (cancel) -> Terminating
+	// Connected -> DisconnectRequest -> Disconnected
+	// Connected handles Heartbeat
+	// Connected -> (cancel) -> Terminating
+	// states only terminated by cancellation: Connected, Disconnected
+	// ok: true strict: false
+}
+
+func ExampleFromChart() {
+	c := state.NewChart("dialer")
+	c.Guard("canRetry", func(state.Event, interface{}) bool { return true })
+	c.State("Dialing").
+		On("failed", "ShouldRetry").
+		On("connected", "Connected")
+	c.Choice("ShouldRetry").
+		When("canRetry", "Dialing").
+		Else("GaveUp")
+	connected := c.State("Connected")
+	connected.State("Idle").On("request", "Busy")
+	connected.State("Busy").On("response", "Idle")
+	connected.State("Closing").On("closed", "Closed") // never entered
+	connected.State("Closed").Final()                 // nothing handles done.state.Connected
+	c.State("GaveUp").Final()
+
+	g := graph.FromChart(c)
+	for _, e := range g.Edges {
+		if e.Guard != "" {
+			fmt.Printf("%s -> [%s] -> %s\n", e.From, e.Guard, e.To)
+		}
+	}
+	fmt.Println(graph.Check(g))
+	// Output:
+	// ShouldRetry -> [canRetry] -> Dialing
+	// ShouldRetry -> [else] -> GaveUp
+	// unreachable states: Closed, Closing
+	// states without a path to a terminal state: Busy, Closed, Closing, Connected, Idle
+}
@@ -0,0 +1,610 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Extract builds the transition graph of the state machine implemented by the
+// Go package in dir. Extraction is purely syntactic and follows the conventions
+// of the demo agent (and of `gosm init` stubs):
+//
+//   - states are declared by accessor methods that return a state func, e.g.
+//     `func (a *Agent) Connected() state.Fn { return connected }`;
+//   - events are struct types that embed state.AbstractEvent or state.Request,
+//     and types that declare the Event method of state.Event;
+//   - the initial state is the first state func passed to a call outside of
+//     any state func, e.g. `state.NewSimpleMachine(backlog, disconnected)`;
+//   - a state func reacts to an event in a type switch case, and transitions
+//     by returning a state func or the result of an accessor, e.g.
+//     `return agent.Connected()`; cases without a return handle the event
+//     internally, returns from a select case that receives from Done() are
+//     cancel edges;
+//   - a state func may run a state.Loop literal: the handlers of its Handlers
+//     (see state.On) react to the type of their event parameter, returns from
+//     OnCancel are cancel edges and handlers that return state.Stay handle
+//     their events internally; handlers are followed when they're func
+//     literals, funcs of the package, or calls of funcs of the package that
+//     return a func literal;
+//   - a Loop whose Until is the Transition of a delegated state, e.g.
+//     `t := state.Delegate(ctx, agent.SuperOf(sub).Connected(), m)`, inherits
+//     the edges of that state (Connected) from the graph of the package that
+//     declares it (agent), as the transitions of a sub-state machine;
+//   - a state func whose returns are all nil is final.
+//
+// Returns of anything else (for example hijacked states) aren't represented
+// in the graph.
+func Extract(dir string) (*Graph, error) {
+	return extract(dir, map[string]*Graph{})
+}
+
+// extract extracts the graph of the package in dir; graphs caches the graphs
+// of the packages that are delegated to, by directory.
+func extract(dir string, graphs map[string]*Graph) (*Graph, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var (
+		fset      = token.NewFileSet()
+		funcs     = map[string]*ast.FuncDecl{}
+		accessors = map[string]string{} // accessor (state) name -> state func name
+		stateOf   = map[string]string{} // state func name -> state name
+		imports   = map[string]string{} // package name -> import path
+		others    []*ast.FuncDecl
+		types     []*ast.TypeSpec
+		marked    = map[string]bool{} // types with an Event method
+		g         = &Graph{}
+		parsed    []*ast.File
+	)
+	for _, f := range files {
+		if strings.HasSuffix(f, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, f, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, file)
+		for _, imp := range file.Imports {
+			p := strings.Trim(imp.Path.Value, `"`)
+			if imp.Name != nil {
+				imports[imp.Name.Name] = p
+			} else {
+				imports[path.Base(p)] = p
+			}
+		}
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					funcs[decl.Name.Name] = decl
+				} else if decl.Name.Name == "Event" && decl.Type.Params.NumFields() == 0 {
+					recv := decl.Recv.List[0].Type
+					if star, ok := recv.(*ast.StarExpr); ok {
+						recv = star.X
+					}
+					marked[name(recv)] = true
+				}
+			case *ast.GenDecl:
+				for _, s := range decl.Specs {
+					if ts, ok := s.(*ast.TypeSpec); ok {
+						types = append(types, ts)
+					}
+				}
+			}
+		}
+	}
+	for _, ts := range types {
+		if marked[ts.Name.Name] || isEvent(ts) {
+			g.Events = append(g.Events, ts.Name.Name)
+		}
+	}
+	for _, file := range parsed {
+		for _, decl := range file.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv == nil {
+				continue
+			}
+			if fn := accessorFunc(fd); fn != "" && funcs[fn] != nil {
+				if _, dup := accessors[fd.Name.Name]; !dup {
+					accessors[fd.Name.Name] = fn
+					stateOf[fn] = fd.Name.Name
+					g.Nodes = append(g.Nodes, Node{Name: fd.Name.Name, Func: fn})
+				}
+			}
+		}
+	}
+	if len(g.Nodes) == 0 {
+		return nil, fmt.Errorf("no state accessors found in %s", dir)
+	}
+	for _, file := range parsed {
+		for _, decl := range file.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && stateOf[fd.Name.Name] == "" {
+				others = append(others, fd)
+			}
+		}
+	}
+
+	x := &extractor{g: g, dir: dir, funcs: funcs, imports: imports, graphs: graphs, accessors: accessors, stateOf: stateOf}
+	g.Initial = x.initialState(others)
+	for i := range g.Nodes {
+		n := &g.Nodes[i]
+		n.Final = x.extractState(n.Name, funcs[n.Func].Body)
+	}
+	return g, nil
+}
+
+type (
+	extractor struct {
+		g         *Graph
+		dir       string
+		funcs     map[string]*ast.FuncDecl
+		imports   map[string]string
+		graphs    map[string]*Graph
+		accessors map[string]string
+		stateOf   map[string]string
+	}
+
+	// scope describes where a return statement occurs within a state func.
+	scope struct {
+		events []string
+		cancel bool
+	}
+)
+
+func (x *extractor) initialState(decls []*ast.FuncDecl) (initial string) {
+	for _, fd := range decls {
+		if fd.Body == nil {
+			continue
+		}
+		ast.Inspect(fd.Body, func(n ast.Node) bool {
+			if call, ok := n.(*ast.CallExpr); ok && initial == "" {
+				for _, arg := range call.Args {
+					if id, ok := arg.(*ast.Ident); ok && x.stateOf[id.Name] != "" {
+						initial = x.stateOf[id.Name]
+						break
+					}
+				}
+			}
+			return initial == ""
+		})
+		if initial != "" {
+			return
+		}
+	}
+	return
+}
+
+// extractState adds the edges of the named state to the graph; returns true if
+// the state is final.
+func (x *extractor) extractState(name string, body *ast.BlockStmt) bool {
+	var (
+		returns, nils int
+		edges         int
+	)
+	addEdge := func(e Edge) {
+		for _, x := range x.g.Edges {
+			if x == e {
+				return
+			}
+		}
+		x.g.Edges = append(x.g.Edges, e)
+		edges++
+	}
+	var walk func(n ast.Node, sc scope)
+	walk = func(n ast.Node, sc scope) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CompositeLit:
+				if !isLoop(n.Type) {
+					return true
+				}
+				for _, elt := range n.Elts {
+					kv, ok := elt.(*ast.KeyValueExpr)
+					if !ok {
+						continue
+					}
+					key, _ := kv.Key.(*ast.Ident)
+					switch {
+					case key == nil:
+					case key.Name == "Handlers":
+						if lit, ok := kv.Value.(*ast.CompositeLit); ok {
+							for _, h := range lit.Elts {
+								if events, body := x.eventHandler(h); body != nil {
+									walk(body, scope{events: events})
+								}
+							}
+						}
+					case key.Name == "Handle":
+						if body := x.funcBody(kv.Value); body != nil {
+							walk(body, scope{})
+						}
+					case key.Name == "OnCancel":
+						if body := x.funcBody(kv.Value); body != nil {
+							walk(body, scope{cancel: true})
+						}
+					case key.Name == "Until":
+						super, from := x.delegated(body, kv.Value)
+						if super == nil {
+							continue
+						}
+						for _, e := range super.Edges {
+							if e.From != from || (e.To != "" && x.accessors[e.To] == "") {
+								continue
+							}
+							e.From = name
+							addEdge(e)
+						}
+					}
+				}
+				return false
+			case *ast.TypeSwitchStmt:
+				for _, s := range n.Body.List {
+					cc := s.(*ast.CaseClause)
+					events := caseEvents(cc)
+					if len(events) == 0 {
+						// default case
+						for _, st := range cc.Body {
+							walk(st, sc)
+						}
+						continue
+					}
+					if !hasReturn(cc.Body) {
+						for _, e := range events {
+							addEdge(Edge{From: name, Event: e, Internal: true})
+						}
+					}
+					for _, st := range cc.Body {
+						walk(st, scope{events: events, cancel: sc.cancel})
+					}
+				}
+				return false
+			case *ast.CommClause:
+				inner := sc
+				if receivesDone(n.Comm) {
+					inner = scope{cancel: true}
+				}
+				for _, st := range n.Body {
+					walk(st, inner)
+				}
+				return false
+			case *ast.ReturnStmt:
+				if len(n.Results) == 1 && isStay(n.Results[0]) {
+					for _, e := range sc.events {
+						addEdge(Edge{From: name, Event: e, Internal: true})
+					}
+					return false
+				}
+				returns++
+				if len(n.Results) != 1 {
+					return false
+				}
+				to, ok := x.target(n.Results[0])
+				if !ok {
+					return true // e.g. `return state.Loop{...}.Run(ctx, m)`
+				}
+				if to == "" {
+					nils++
+				}
+				switch {
+				case len(sc.events) > 0:
+					for _, e := range sc.events {
+						addEdge(Edge{From: name, Event: e, To: to})
+					}
+				case sc.cancel:
+					addEdge(Edge{From: name, To: to, Cancel: true})
+				case to != "":
+					addEdge(Edge{From: name, To: to})
+				}
+				return false
+			}
+			return true
+		})
+	}
+	walk(body, scope{})
+	return edges == 0 && returns > 0 && returns == nils
+}
+
+// target classifies the result of a return statement: returns the name of the
+// state transitioned to ("" for nil) and true, or false if the result can't be
+// determined statically.
+func (x *extractor) target(e ast.Expr) (string, bool) {
+	switch e := ast.Unparen(e).(type) {
+	case *ast.Ident:
+		if e.Name == "nil" {
+			return "", true
+		}
+		if s := x.stateOf[e.Name]; s != "" {
+			return s, true
+		}
+	case *ast.CallExpr:
+		if sel, ok := e.Fun.(*ast.SelectorExpr); ok && len(e.Args) == 0 {
+			if _, ok := x.accessors[sel.Sel.Name]; ok {
+				return sel.Sel.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// eventHandler returns the events and the body of an EventHandler, e.g.
+// `state.On(func(ctx state.Context, m state.Machine, e *Heartbeat) state.Fn {...})`;
+// body is nil if the handler can't be followed.
+func (x *extractor) eventHandler(e ast.Expr) (events []string, body *ast.BlockStmt) {
+	call, ok := e.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return nil, nil
+	}
+	fun := call.Fun
+	if ix, ok := fun.(*ast.IndexExpr); ok {
+		fun = ix.X
+	}
+	if name(fun) != "On" {
+		return nil, nil
+	}
+	var typ *ast.FuncType
+	switch h := call.Args[0].(type) {
+	case *ast.FuncLit:
+		typ, body = h.Type, h.Body
+	case *ast.Ident:
+		if fd := x.funcs[h.Name]; fd != nil {
+			typ, body = fd.Type, fd.Body
+		}
+	}
+	if typ == nil {
+		return nil, nil
+	}
+	var params []ast.Expr
+	for _, f := range typ.Params.List {
+		for n := max(len(f.Names), 1); n > 0; n-- {
+			params = append(params, f.Type)
+		}
+	}
+	if len(params) != 3 {
+		return nil, nil
+	}
+	t := params[2]
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
+	}
+	if n := name(t); n != "" {
+		return []string{n}, body
+	}
+	return nil, nil
+}
+
+// delegated returns the graph, and the name of the state, that's delegated to
+// by the Transition `until` of a state func, see Extract; returns nil if
+// `until` isn't the result of state.Delegate, or if the graph of the package
+// can't be extracted.
+func (x *extractor) delegated(body *ast.BlockStmt, until ast.Expr) (*Graph, string) {
+	id, ok := until.(*ast.Ident)
+	if !ok {
+		return nil, ""
+	}
+	var value ast.Expr
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for i, l := range n.Lhs {
+				if l, ok := l.(*ast.Ident); ok && l.Name == id.Name && i < len(n.Rhs) {
+					value = n.Rhs[i]
+				}
+			}
+		case *ast.ValueSpec:
+			for i, l := range n.Names {
+				if l.Name == id.Name && i < len(n.Values) {
+					value = n.Values[i]
+				}
+			}
+		}
+		return value == nil
+	})
+	call, ok := value.(*ast.CallExpr)
+	if !ok || name(call.Fun) != "Delegate" || len(call.Args) < 2 {
+		return nil, ""
+	}
+	target, ok := call.Args[1].(*ast.CallExpr)
+	if !ok || len(target.Args) != 0 {
+		return nil, ""
+	}
+	sel, ok := target.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return nil, ""
+	}
+	root := sel.X
+	for {
+		switch e := root.(type) {
+		case *ast.CallExpr:
+			root = e.Fun
+			continue
+		case *ast.SelectorExpr:
+			root = e.X
+			continue
+		}
+		break
+	}
+	pkg, ok := root.(*ast.Ident)
+	if !ok || x.imports[pkg.Name] == "" {
+		return nil, ""
+	}
+	bp, err := build.Import(x.imports[pkg.Name], x.dir, build.FindOnly)
+	if err != nil {
+		return nil, ""
+	}
+	g, seen := x.graphs[bp.Dir]
+	if !seen {
+		x.graphs[bp.Dir] = nil // guards against cycles
+		if g, err = extract(bp.Dir, x.graphs); err != nil {
+			g = nil
+		}
+		x.graphs[bp.Dir] = g
+	}
+	if g == nil {
+		return nil, ""
+	}
+	return g, sel.Sel.Name
+}
+
+// funcBody returns the body of a func literal, of a func of the package, or of
+// the func literal returned by a call of a func of the package; returns nil
+// otherwise.
+func (x *extractor) funcBody(e ast.Expr) *ast.BlockStmt {
+	switch e := e.(type) {
+	case *ast.FuncLit:
+		return e.Body
+	case *ast.Ident:
+		if fd := x.funcs[e.Name]; fd != nil {
+			return fd.Body
+		}
+	case *ast.CallExpr:
+		id, ok := e.Fun.(*ast.Ident)
+		if !ok || x.funcs[id.Name] == nil || x.funcs[id.Name].Body == nil {
+			return nil
+		}
+		for _, st := range x.funcs[id.Name].Body.List {
+			if ret, ok := st.(*ast.ReturnStmt); ok && len(ret.Results) == 1 {
+				if fl, ok := ret.Results[0].(*ast.FuncLit); ok {
+					return fl.Body
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// name returns the name of an identifier, or the selected name of a selector
+// expression; "" otherwise.
+func name(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.SelectorExpr:
+		return e.Sel.Name
+	}
+	return ""
+}
+
+func isLoop(typ ast.Expr) bool { return name(typ) == "Loop" }
+
+func isStay(e ast.Expr) bool { return name(ast.Unparen(e)) == "Stay" }
+
+// accessorFunc returns the name of the state func returned by an accessor
+// method, or "" if fd isn't an accessor.
+func accessorFunc(fd *ast.FuncDecl) string {
+	if fd.Body == nil || len(fd.Type.Params.List) != 0 || fd.Type.Results == nil || len(fd.Type.Results.List) != 1 {
+		return ""
+	}
+	if sel, ok := fd.Type.Results.List[0].Type.(*ast.SelectorExpr); !ok || sel.Sel.Name != "Fn" {
+		return ""
+	}
+	if len(fd.Body.List) != 1 {
+		return ""
+	}
+	ret, ok := fd.Body.List[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Results) != 1 {
+		return ""
+	}
+	if id, ok := ret.Results[0].(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// isEvent returns true for struct types that embed state.AbstractEvent or
+// state.Request.
+func isEvent(ts *ast.TypeSpec) bool {
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		return false
+	}
+	for _, f := range st.Fields.List {
+		if len(f.Names) != 0 {
+			continue
+		}
+		if n := name(f.Type); n == "AbstractEvent" || n == "Request" {
+			return true
+		}
+	}
+	return false
+}
+
+func caseEvents(cc *ast.CaseClause) (events []string) {
+	for _, e := range cc.List {
+		if star, ok := e.(*ast.StarExpr); ok {
+			e = star.X
+		}
+		switch e := e.(type) {
+		case *ast.Ident:
+			events = append(events, e.Name)
+		case *ast.SelectorExpr:
+			events = append(events, e.Sel.Name)
+		}
+	}
+	return
+}
+
+func hasReturn(stmts []ast.Stmt) (found bool) {
+	for _, st := range stmts {
+		ast.Inspect(st, func(n ast.Node) bool {
+			switch n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.ReturnStmt:
+				found = true
+			}
+			return !found
+		})
+	}
+	return
+}
+
+func receivesDone(comm ast.Stmt) bool {
+	var x ast.Expr
+	switch comm := comm.(type) {
+	case *ast.ExprStmt:
+		x = comm.X
+	case *ast.AssignStmt:
+		x = comm.Rhs[0]
+	default:
+		return false
+	}
+	u, ok := ast.Unparen(x).(*ast.UnaryExpr)
+	if !ok || u.Op != token.ARROW {
+		return false
+	}
+	call, ok := u.X.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "Done"
+}
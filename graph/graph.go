@@ -0,0 +1,368 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package graph models the transition graph of a state machine, either as
+// declared by a spec or a statechart, or as extracted from the state funcs of a
+// package, and checks it for unreachable states, dead states, unhandled events
+// and sinks.
+package graph
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jdef/state/spec"
+)
+
+type (
+	Graph struct {
+		Initial string
+		Nodes   []Node
+		Events  []string
+		Edges   []Edge
+	}
+
+	Node struct {
+		Name string
+		// Func is the name of the state func that implements the state, if known.
+		Func string
+		// Final nodes terminate the machine: their state func returns nil.
+		// Nested final nodes (see Parent) complete their parent state instead.
+		Final bool
+		// Kind is the kind of node, KindState unless the graph was built from a
+		// statechart.
+		Kind string
+		// Parent is the name of the enclosing state of a nested node. A nested
+		// node handles the events that its ancestors handle.
+		Parent string
+	}
+
+	// Edge is a transition From a state upon an Event. Cancel edges are taken
+	// when the Context signals completion and have no Event. An empty To
+	// indicates that the machine terminates (the state func returns nil), unless
+	// the edge is Internal: the event is handled without changing state.
+	// Edges of statecharts may have neither Event nor Cancel: they're taken
+	// upon entry of a composite state or of a pseudo-state, see FromChart.
+	Edge struct {
+		From     string
+		Event    string
+		To       string
+		Cancel   bool
+		Internal bool
+		// Guard is the name of the guard of a branch of a choice or junction
+		// pseudo-state, "else" for the else branch.
+		Guard string
+	}
+
+	// Report lists the problems found by Check; all lists are sorted.
+	Report struct {
+		// Unreachable states can't be reached from the initial state.
+		Unreachable []string
+		// Dead states have no path to a terminal state, not even by
+		// cancellation.
+		Dead []string
+		// CancelOnly states have a path to a terminal state only by
+		// cancellation, like the states of machines that run until they're
+		// cancelled. They aren't problems, see Empty, unless the check is
+		// strict (see Strict).
+		CancelOnly []string
+		// Unhandled events aren't handled by any state.
+		Unhandled []string
+		// Sinks are (non-final) states that can only be left by cancellation.
+		Sinks []string
+	}
+)
+
+// Kinds of nodes.
+const (
+	KindState       = ""
+	KindComposite   = "composite"
+	KindParallel    = "parallel"
+	KindChoice      = "choice"
+	KindJunction    = "junction"
+	KindHistory     = "history"
+	KindDeepHistory = "deep history"
+)
+
+// FromSpec returns the transition graph declared by a spec.
+func FromSpec(s *spec.Spec) *Graph {
+	g := &Graph{Initial: s.Initial, Events: append([]string(nil), s.Events...)}
+	for _, st := range s.States {
+		g.Nodes = append(g.Nodes, Node{Name: st.Name, Func: spec.FuncName(st.Name), Final: st.Final})
+	}
+	for _, t := range s.Transitions {
+		g.Edges = append(g.Edges, Edge{From: t.From, Event: t.Event, To: t.To, Internal: t.To == ""})
+	}
+	for _, st := range s.States {
+		if !st.Final {
+			g.Edges = append(g.Edges, Edge{From: st.Name, To: s.Cancel, Cancel: true})
+		}
+	}
+	return g
+}
+
+// Node returns the named node, or nil if there's no such node.
+func (g *Graph) Node(name string) *Node {
+	for i := range g.Nodes {
+		if g.Nodes[i].Name == name {
+			return &g.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// NodeByFunc returns the node implemented by the named state func, or nil if
+// there's no such node.
+func (g *Graph) NodeByFunc(fn string) *Node {
+	for i := range g.Nodes {
+		if g.Nodes[i].Func == fn {
+			return &g.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// isPseudo returns true for pseudo-state nodes, which are never active.
+func (n *Node) isPseudo() bool {
+	switch n.Kind {
+	case KindChoice, KindJunction, KindHistory, KindDeepHistory:
+		return true
+	}
+	return false
+}
+
+// Check analyzes the graph. Nested nodes inherit the edges of their ancestors
+// that are taken upon an event or upon cancellation.
+func Check(g *Graph) (r Report) {
+	var (
+		succ     = map[string][]string{}
+		pred     = map[string][]string{} // excluding cancel edges
+		cpred    = map[string][]string{} // of cancel edges
+		terminal = map[string]bool{}
+		handled  = map[string]bool{}
+		leaves   = map[string]bool{} // states that may be left upon some event
+	)
+	for _, n := range g.Nodes {
+		if n.Final && n.Parent == "" {
+			terminal[n.Name] = true
+		}
+	}
+	for _, e := range g.inherited() {
+		if e.Event != "" {
+			handled[e.Event] = true
+		}
+		if e.Internal {
+			continue
+		}
+		if !e.Cancel && e.To != e.From {
+			leaves[e.From] = true
+		}
+		if e.To != "" {
+			succ[e.From] = append(succ[e.From], e.To)
+		}
+		if e.Cancel {
+			if e.To != "" {
+				cpred[e.To] = append(cpred[e.To], e.From)
+			}
+			continue
+		}
+		if e.To == "" {
+			terminal[e.From] = true
+		} else {
+			pred[e.To] = append(pred[e.To], e.From)
+		}
+	}
+
+	reachable := closure([]string{g.Initial}, succ)
+	var roots []string
+	for name := range terminal {
+		roots = append(roots, name)
+	}
+	live := closure(roots, pred)
+	for to, from := range pred {
+		cpred[to] = append(cpred[to], from...)
+	}
+	cancellable := closure(roots, cpred)
+
+	for _, n := range g.Nodes {
+		if !reachable[n.Name] {
+			r.Unreachable = append(r.Unreachable, n.Name)
+		}
+		switch {
+		case !cancellable[n.Name]:
+			r.Dead = append(r.Dead, n.Name)
+		case !live[n.Name]:
+			r.CancelOnly = append(r.CancelOnly, n.Name)
+		}
+		if !n.Final && !n.isPseudo() && !leaves[n.Name] {
+			r.Sinks = append(r.Sinks, n.Name)
+		}
+	}
+	for _, e := range g.Events {
+		if !handled[e] {
+			r.Unhandled = append(r.Unhandled, e)
+		}
+	}
+	sort.Strings(r.Unreachable)
+	sort.Strings(r.Dead)
+	sort.Strings(r.CancelOnly)
+	sort.Strings(r.Unhandled)
+	sort.Strings(r.Sinks)
+	return
+}
+
+// inherited returns the edges of the graph, along with copies of the event and
+// cancel edges of every ancestor of a nested node, from that node.
+func (g *Graph) inherited() []Edge {
+	var (
+		edges  = append([]Edge(nil), g.Edges...)
+		from   = map[string][]Edge{}
+		parent = map[string]string{}
+	)
+	for _, e := range g.Edges {
+		if e.Event != "" || e.Cancel {
+			from[e.From] = append(from[e.From], e)
+		}
+	}
+	for _, n := range g.Nodes {
+		parent[n.Name] = n.Parent
+	}
+	for _, n := range g.Nodes {
+		if n.isPseudo() {
+			continue
+		}
+		for a := n.Parent; a != ""; a = parent[a] {
+			for _, e := range from[a] {
+				e.From = n.Name
+				edges = append(edges, e)
+			}
+		}
+	}
+	return edges
+}
+
+// closure returns the set of nodes reachable from the given roots.
+func closure(roots []string, adj map[string][]string) map[string]bool {
+	seen := map[string]bool{}
+	roots = append([]string(nil), roots...) // don't clobber the caller's
+	for len(roots) > 0 {
+		n := roots[len(roots)-1]
+		roots = roots[:len(roots)-1]
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		roots = append(roots, adj[n]...)
+	}
+	return seen
+}
+
+// Empty returns true if no problems were reported; CancelOnly states aren't
+// problems.
+func (r Report) Empty() bool {
+	return len(r.Unreachable)+len(r.Dead)+len(r.Unhandled)+len(r.Sinks) == 0
+}
+
+// Strict returns the report of a strict check: CancelOnly states are reported
+// as Dead.
+func (r Report) Strict() Report {
+	r.Dead = append(append([]string(nil), r.Dead...), r.CancelOnly...)
+	r.CancelOnly = nil
+	sort.Strings(r.Dead)
+	return r
+}
+
+func (r Report) String() string {
+	var lines []string
+	add := func(what string, names []string) {
+		if len(names) > 0 {
+			lines = append(lines, fmt.Sprintf("%s: %s", what, strings.Join(names, ", ")))
+		}
+	}
+	add("unreachable states", r.Unreachable)
+	add("states without a path to a terminal state", r.Dead)
+	add("states only terminated by cancellation", r.CancelOnly)
+	add("unhandled events", r.Unhandled)
+	add("states only left by cancellation", r.Sinks)
+	return strings.Join(lines, "\n")
+}
+
+// WriteDot writes the graph in Graphviz DOT format. Cancel edges are dashed,
+// edges to the nil state end in a point node. Composite states are boxes, the
+// edges to the states that they enter by default are dotted; choices are
+// diamonds, junctions are small filled circles and history pseudo-states are
+// circles labeled H (or H* for deep history).
+func (g *Graph) WriteDot(w io.Writer) error {
+	p := &printer{w: w}
+	p.printf("digraph {\n")
+	p.printf("\t%q [shape=point];\n", "")
+	p.printf("\t%q -> %q;\n", "", g.Initial)
+	for _, n := range g.Nodes {
+		attrs := "shape=ellipse"
+		switch {
+		case n.Final:
+			attrs = "shape=doublecircle"
+		case n.Kind == KindComposite:
+			attrs = `shape=box,style=rounded`
+		case n.Kind == KindParallel:
+			attrs = `shape=box,style="rounded,dashed"`
+		case n.Kind == KindChoice:
+			attrs = "shape=diamond"
+		case n.Kind == KindJunction:
+			attrs = `shape=circle,style=filled,width=0.2,label=""`
+		case n.Kind == KindHistory:
+			attrs = `shape=circle,label="H"`
+		case n.Kind == KindDeepHistory:
+			attrs = `shape=circle,label="H*"`
+		}
+		p.printf("\t%q [%s];\n", n.Name, attrs)
+	}
+	for i, e := range g.Edges {
+		if e.Internal {
+			continue
+		}
+		to := e.To
+		if to == "" {
+			to = fmt.Sprintf("nil%d", i)
+			p.printf("\t%q [shape=point,label=nil];\n", to)
+		}
+		switch {
+		case e.Cancel:
+			p.printf("\t%q -> %q [style=dashed,label=%q];\n", e.From, to, "<cancel>")
+		case e.Guard != "":
+			p.printf("\t%q -> %q [label=%q];\n", e.From, to, "["+e.Guard+"]")
+		case e.Event == "":
+			p.printf("\t%q -> %q [style=dotted];\n", e.From, to)
+		default:
+			p.printf("\t%q -> %q [label=%q];\n", e.From, to, e.Event)
+		}
+	}
+	p.printf("}\n")
+	return p.err
+}
+
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jdef/state/graph"
+	"github.com/jdef/state/spec"
+)
+
+func TestCheck_trappedCycle(t *testing.T) {
+	const trap = `
+type: Trap
+initial: A
+states:
+  - name: A
+  - name: B
+  - name: C
+  - name: Done
+    final: true
+events: [Go, Back, Quit]
+transitions:
+  - {from: A, event: Quit, to: Done}
+  - {from: A, event: Go, to: B}
+  - {from: B, event: Go, to: C}
+  - {from: C, event: Back, to: B}
+`
+	for _, tc := range []struct {
+		name             string
+		cancel           string
+		dead, cancelOnly []string
+	}{
+		{name: "uncancellable", dead: []string{"B", "C"}},
+		{name: "cancellable", cancel: "cancel: Done\n", cancelOnly: []string{"B", "C"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := spec.Parse([]byte(tc.cancel + trap))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := graph.Check(graph.FromSpec(s))
+			if !reflect.DeepEqual(r.Dead, tc.dead) {
+				t.Fatalf("expected dead states %v, got %v", tc.dead, r.Dead)
+			}
+			if !reflect.DeepEqual(r.CancelOnly, tc.cancelOnly) {
+				t.Fatalf("expected cancel-only states %v, got %v", tc.cancelOnly, r.CancelOnly)
+			}
+			if len(r.Unreachable)+len(r.Unhandled)+len(r.Sinks) != 0 {
+				t.Fatalf("unexpected problems:\n%s", r)
+			}
+			if want := []string{"B", "C"}; !reflect.DeepEqual(r.Strict().Dead, want) {
+				t.Fatalf("expected strictly dead states %v, got %v", want, r.Strict().Dead)
+			}
+		})
+	}
+}
+
+func TestExtract_loop(t *testing.T) {
+	g, err := graph.Extract("../demo/subagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []graph.Edge{
+		{From: "Disconnected", Event: "ConnectRequest", Internal: true},
+		{From: "Disconnected", To: "Terminating", Cancel: true},
+		// inherited from the delegated agent.Disconnected state
+		{From: "Disconnected", Event: "ConnectRequest", To: "Connected"},
+		{From: "Disconnected", Event: "Heartbeat", Internal: true},
+		{From: "Connected", Event: "DisconnectRequest", Internal: true},
+		{From: "Connected", Event: "Heartbeat", Internal: true},
+		{From: "Connected", To: "Terminating", Cancel: true},
+		// inherited from the delegated agent.Connected state
+		{From: "Connected", Event: "DisconnectRequest", To: "Disconnected"},
+	}
+	for _, n := range g.Nodes {
+		if n.Final != (n.Name == "Terminating") {
+			t.Fatalf("unexpected finality of state %q: %v", n.Name, n.Final)
+		}
+	}
+	if !reflect.DeepEqual(g.Edges, want) {
+		t.Fatalf("expected edges %+v, got %+v", want, g.Edges)
+	}
+}
+
+func TestExtract_events(t *testing.T) {
+	g, err := graph.Extract("../demo/agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := map[string]bool{}
+	for _, e := range g.Events {
+		events[e] = true
+	}
+	// ConnectRequest embeds state.Request rather than state.AbstractEvent
+	for _, e := range []string{"ConnectRequest", "DisconnectRequest", "Heartbeat"} {
+		if !events[e] {
+			t.Errorf("expected event %q in %v", e, g.Events)
+		}
+	}
+}
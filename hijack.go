@@ -0,0 +1,227 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type (
+	// HijackPolicy is implemented by super-state machines that decide which
+	// hijacks they accept, typically based upon their current state.
+	// AcceptHijack returns the reason for vetoing a hijack to the target
+	// state, or nil to accept it.
+	//
+	// The policy is consulted by the state that receives the hijack, before
+	// it transitions, in the goroutine that runs the state (see Accept): it
+	// may depend upon the current state of the machine without racing its
+	// transitions. The super-states of distinct sub-state machines run in
+	// distinct goroutines though, so the policy of a super-state machine with
+	// sub-state machines may be consulted concurrently.
+	HijackPolicy interface {
+		AcceptHijack(target Fn) error
+	}
+
+	// HijackPolicyFunc adapts a func to the HijackPolicy interface.
+	HijackPolicyFunc func(target Fn) error
+
+	// RejectedError is returned by Hijack when the super-state machine vetoes
+	// a hijack; it matches ErrRejected, see errors.Is.
+	RejectedError struct {
+		Reason error
+	}
+
+	// hijackOffer is sent by Hijack to super-state machines with a
+	// HijackPolicy, in the guise of a state func (see run), so that the policy
+	// is consulted by the state that accepts the hijack, see Accept.
+	hijackOffer struct {
+		target Fn
+		policy HijackPolicy
+		once   sync.Once
+		err    error
+		reply  chan error
+	}
+
+	// offerProbe is the Context with which offerOf invokes the guise of an
+	// offer.
+	offerProbe struct {
+		Context
+		offer *hijackOffer
+	}
+)
+
+var (
+	// ErrRejected matches the errors of hijacks that are vetoed by the
+	// super-state machine.
+	ErrRejected = errors.New("hijack rejected")
+	// ErrNotHijackable is returned by Hijack for machines that don't accept
+	// hijacks at all.
+	ErrNotHijackable = errors.New("machine is not hijackable")
+)
+
+func (f HijackPolicyFunc) AcceptHijack(target Fn) error { return f(target) }
+
+func (e *RejectedError) Error() string { return ErrRejected.Error() + ": " + e.Reason.Error() }
+
+func (e *RejectedError) Unwrap() error { return e.Reason }
+
+func (e *RejectedError) Is(target error) bool { return target == ErrRejected }
+
+// Hijack attempts to hijack state transition from the super-state machine
+// `super` to state `target`, like TryHijack, and returns the state that the
+// machine should transition to. The super-state machine may veto the hijack,
+// see HijackPolicy: the state that receives the hijack decides upon it (see
+// Accept), and Hijack waits for the decision. Unless zero, the timeout bounds
+// the wait for a state of the super-state machine to receive the hijack; once
+// received and accepted, Hijack waits for the `next` Transition until the
+// Context is done. Errors are:
+//
+//   - ErrNotHijackable if the super-state machine has no Hijack chan;
+//   - a *RejectedError if the super-state machine vetoes the hijack;
+//   - ErrTimeout if the hijack isn't accepted in time;
+//   - ErrCancelled if the Context is done first.
+func Hijack(ctx Context, super SuperMachine, target Fn, next Transition, timeout time.Duration) (Fn, error) {
+	if super == nil || super.Hijack() == nil {
+		return nil, ErrNotHijackable
+	}
+	var (
+		offered = target
+		decided <-chan error
+	)
+	if p, ok := super.(HijackPolicy); ok {
+		o := &hijackOffer{target: target, policy: p, reply: make(chan error, 1)}
+		offered, decided = o.run, o.reply
+	}
+	if err := offer(ctx, super, offered, timeout); err != nil {
+		return nil, err
+	}
+	if decided != nil {
+		select {
+		case err := <-decided:
+			if err != nil {
+				return nil, &RejectedError{Reason: err}
+			}
+		case <-ctx.Done():
+			return nil, ErrCancelled
+		}
+	}
+	select {
+	case f := <-next.NextState():
+		return f, nil
+	case <-ctx.Done():
+		return nil, ErrCancelled
+	}
+}
+
+// Accept decides upon a state f that a state func received from Next(m),
+// before it transitions to f: if f is a hijack that's offered by Hijack then
+// the HijackPolicy of the hijacked super-state machine is consulted, and the
+// hijacker is told the outcome. Returns the state to transition to, or false if
+// the hijack is rejected, in which case the state func should remain in its
+// state; other states are returned as is. Loop accepts hijacks this way. Run
+// decides upon the hijacks that state funcs return without Accept: it
+// re-enters the state func if the hijack is rejected.
+func Accept(f Fn) (Fn, bool) {
+	if o := offerOf(f); o != nil {
+		return o.decide()
+	}
+	return f, true
+}
+
+// run is the guise of a hijack offer. It isn't meant to be run as a state
+// (see Accept), but tells offerOf which offer it belongs to.
+func (o *hijackOffer) run(ctx Context, _ Machine) Fn {
+	if p, ok := ctx.(*offerProbe); ok {
+		p.offer = o
+	}
+	return nil
+}
+
+var offerRun = reflect.ValueOf((&hijackOffer{}).run).Pointer()
+
+// offerOf returns the hijack offer that state f is the guise of, or nil.
+func offerOf(f Fn) *hijackOffer {
+	if f == nil || reflect.ValueOf(f).Pointer() != offerRun {
+		return nil
+	}
+	var p offerProbe
+	f(&p, nil)
+	return p.offer
+}
+
+// decide consults the policy once, and tells the hijacker the outcome.
+func (o *hijackOffer) decide() (Fn, bool) {
+	o.once.Do(func() {
+		o.err = o.policy.AcceptHijack(o.target)
+		o.reply <- o.err
+	})
+	if o.err != nil {
+		return nil, false
+	}
+	return o.target, true
+}
+
+// Preempt redirects machine m to state target on behalf of its super-state
+// machine (or whichever party is in charge of m): the current state func of m
+// receives target from Next(m) and is expected to return it, so a nil target
+// terminates m. Preemption can't be vetoed. Unless zero, the timeout bounds
+// the wait for the current state of m to accept. Errors are ErrNotHijackable,
+// ErrTimeout and ErrCancelled, see Hijack.
+func Preempt(ctx Context, m Hijackable, target Fn, timeout time.Duration) error {
+	if m == nil || m.Hijack() == nil {
+		return ErrNotHijackable
+	}
+	return offer(ctx, m, target, timeout)
+}
+
+// offer sends a state to the Hijack chan of a machine.
+func offer(ctx Context, m Hijackable, target Fn, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case m.Hijack() <- target:
+		return nil
+	case <-ctx.Done():
+		return ErrCancelled
+	case <-expired:
+		return ErrTimeout
+	}
+}
+
+// Pause returns a state func that pauses a machine until `resume` closes, and
+// then returns state `then`. A paused machine doesn't read events, which are
+// queued meanwhile; it may be preempted (see Next) and it terminates once its
+// Context is done. Pause is typically the target of Preempt.
+func Pause(resume <-chan struct{}, then Fn) Fn {
+	return func(ctx Context, m Machine) Fn {
+		select {
+		case <-resume:
+			return then
+		case f := <-Next(m):
+			return f
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
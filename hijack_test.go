@@ -0,0 +1,182 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+// testSuper is a minimal super-state machine with an optional hijack policy.
+type testSuper struct {
+	hijack chan state.Fn
+	policy state.HijackPolicy
+}
+
+func (s *testSuper) Hijack() chan<- state.Fn                   { return s.hijack }
+func (s *testSuper) SubMachine(int, state.Fn) state.SubMachine { return nil }
+func (s *testSuper) AcceptHijack(target state.Fn) error        { return s.policy.AcceptHijack(target) }
+func (s *testSuper) accept() state.Transition                  { return state.Upon(s.next, nil, nil) }
+func (s *testSuper) next(state.Context, state.Machine) state.Fn {
+	f, _ := state.Accept(<-s.hijack)
+	return f
+}
+func target(state.Context, state.Machine) state.Fn { return nil }
+func acceptAll(state.Fn) error                     { return nil }
+
+func TestHijack(t *testing.T) {
+	busy := errors.New("busy")
+	for _, tc := range []struct {
+		name    string
+		super   *testSuper
+		accept  bool
+		cancel  bool
+		timeout time.Duration
+		err     error
+	}{
+		{name: "accepted", super: &testSuper{make(chan state.Fn), state.HijackPolicyFunc(acceptAll)}, accept: true},
+		{name: "not hijackable", super: &testSuper{nil, state.HijackPolicyFunc(acceptAll)}, err: state.ErrNotHijackable},
+		{name: "rejected", super: &testSuper{make(chan state.Fn), state.HijackPolicyFunc(func(state.Fn) error { return busy })}, accept: true, err: busy},
+		{name: "timed out", super: &testSuper{make(chan state.Fn), state.HijackPolicyFunc(acceptAll)}, timeout: time.Millisecond, err: state.ErrTimeout},
+		{name: "cancelled", super: &testSuper{make(chan state.Fn), state.HijackPolicyFunc(acceptAll)}, cancel: true, err: state.ErrCancelled},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := make(state.SimpleContext)
+			if tc.cancel {
+				ctx.Cancel()
+			}
+			next := state.NoTransition()
+			if tc.accept {
+				next = tc.super.accept()
+			}
+			f, err := state.Hijack(ctx, tc.super, target, next, tc.timeout)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if tc.err == busy && !errors.Is(err, state.ErrRejected) {
+				t.Fatalf("expected a rejection, got %v", err)
+			}
+			if (err == nil) != (f != nil) {
+				t.Fatalf("unexpected state %v with error %v", state.FuncName(f), err)
+			}
+		})
+	}
+}
+
+// policyMachine is a super-state machine that only accepts hijacks while it's
+// idle.
+type policyMachine struct {
+	state.Machine
+	hijack chan state.Fn
+	idle   bool // accessed by the states of the machine only
+}
+
+func (m *policyMachine) Hijack() chan<- state.Fn                   { return m.hijack }
+func (m *policyMachine) NextState() <-chan state.Fn                { return m.hijack }
+func (m *policyMachine) SubMachine(int, state.Fn) state.SubMachine { return nil }
+
+func (m *policyMachine) AcceptHijack(state.Fn) error {
+	if !m.idle {
+		return errors.New("busy")
+	}
+	return nil
+}
+
+func TestHijack_policy(t *testing.T) {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	var (
+		idle = func(ctx state.Context, m state.Machine) state.Fn {
+			m.(*policyMachine).idle = true
+			return state.Loop{}.Run(ctx, m)
+		}
+		busy = func(ctx state.Context, m state.Machine) state.Fn {
+			m.(*policyMachine).idle = false
+			return state.Loop{Handlers: []state.EventHandler{
+				state.On(func(state.Context, state.Machine, *incEvent) state.Fn { return idle }),
+			}}.Run(ctx, m)
+		}
+		entered = 0
+		raw     = func(ctx state.Context, m state.Machine) state.Fn {
+			// returns hijacks without deciding upon them, see Accept
+			entered++
+			select {
+			case f := <-state.Next(m):
+				return f
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		reached = make(transition, 1)
+		hijack  = func(state.Context, state.Machine) state.Fn { reached <- nil; return nil }
+		run     = func(initial state.Fn) (*policyMachine, chan struct{}) {
+			m := &policyMachine{Machine: state.NewSimpleMachine(0, initial), hijack: make(chan state.Fn)}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				state.Run(ctx, m)
+			}()
+			return m, done
+		}
+	)
+
+	// the policy is consulted by the current state: a busy machine remains
+	// busy, and accepts the hijack once it's idle
+	m, done := run(busy)
+	if _, err := state.Hijack(ctx, m, hijack, reached, time.Second); !errors.Is(err, state.ErrRejected) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	m.Sink() <- &incEvent{}
+	if _, err := state.Hijack(ctx, m, hijack, reached, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// Run decides upon the hijacks that states return without Accept, and
+	// re-enters the state upon rejection
+	m, done = run(raw)
+	if _, err := state.Hijack(ctx, m, hijack, reached, time.Second); !errors.Is(err, state.ErrRejected) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	if _, err := state.Hijack(ctx, m, hijack, reached, time.Second); !errors.Is(err, state.ErrRejected) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	ctx.Cancel()
+	<-done
+	if entered != 3 {
+		t.Fatalf("expected the state to be entered 3 times, got %d", entered)
+	}
+}
+
+func ExampleHijack() {
+	super := &testSuper{
+		hijack: make(chan state.Fn),
+		policy: state.HijackPolicyFunc(func(state.Fn) error { return errors.New("shutting down") }),
+	}
+	// the current state of the super-state machine receives the hijack, and
+	// consults the policy (see Accept)
+	go super.next(nil, nil)
+	_, err := state.Hijack(make(state.SimpleContext), super, target, state.NoTransition(), time.Second)
+	fmt.Println(err, errors.Is(err, state.ErrRejected))
+	// Output:
+	// hijack rejected: shutting down true
+}
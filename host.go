@@ -0,0 +1,197 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Host runs one machine at a time, and lets it be replaced at runtime
+	// (see Swap) without loss of events: producers send events to the Sink of
+	// the Host, which forwards them to the Sink of the current machine.
+	Host struct {
+		events  chan Event
+		swaps   chan *swap
+		done    chan struct{} // closed once Run returns
+		current Machine
+		// StopTimeout bounds the wait for a hijackable machine to accept
+		// being preempted upon Swap (see Preempt), after which its Context is
+		// cancelled instead. Machines that aren't hijackable are always
+		// stopped by cancellation. Defaults to one second.
+		StopTimeout time.Duration
+	}
+
+	// Handoff is implemented by machines that queue events beyond their
+	// Source, like the lanes of sub-state machines (see gosm): Handoff
+	// transfers such events to the machine that replaces it, see Host.Swap.
+	Handoff interface {
+		Handoff(ctx Context, to Machine)
+	}
+
+	swap struct {
+		m    Machine
+		done chan struct{}
+	}
+)
+
+// Host implements Events
+var _ Events = &Host{}
+
+// NewHost returns a Host for machine m; the Host's own queue has the given
+// length.
+func NewHost(queueLength int, m Machine) *Host {
+	return &Host{
+		events:  make(chan Event, queueLength),
+		swaps:   make(chan *swap),
+		done:    make(chan struct{}),
+		current: m,
+	}
+}
+
+func (h *Host) Source() <-chan Event { return h.events }
+func (h *Host) Sink() chan<- Event   { return h.events }
+
+// Swap replaces the current machine with machine m, and returns once m runs:
+// the current machine is stopped, the events that it left queued are handed
+// over to m, in order, ahead of events that were sent to the Host since; if
+// the current machine implements Handoff then it hands its other events over
+// to m. Swap blocks until the Host runs; returns ErrCancelled if the Context
+// is done first, or once Run has returned.
+func (h *Host) Swap(ctx Context, m Machine) error {
+	s := &swap{m: m, done: make(chan struct{})}
+	select {
+	case h.swaps <- s:
+	case <-h.done:
+		return ErrCancelled
+	case <-ctx.Done():
+		return ErrCancelled
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-h.done:
+		return ErrCancelled
+	case <-ctx.Done():
+		return ErrCancelled
+	}
+}
+
+// Run runs the current machine, and its replacements, until one of them
+// terminates of its own accord or until the Context is done. The observers
+// are notified of the transitions of every machine, see Run, except for the
+// termination of machines that are replaced. Events that are left queued once
+// Run returns are discarded, see DiscardQueued. Run may be invoked only once.
+func (h *Host) Run(ctx Context, observers ...Observer) {
+	defer close(h.done)
+	var (
+		backlog []Event // events that are yet to be forwarded, in order
+		swapped chan struct{}
+	)
+	for {
+		var (
+			m            = h.current
+			mctx, cancel = WithCancel(ctx)
+			done         = make(chan struct{})
+			replaced     int32
+		)
+		go func() {
+			defer close(done)
+			Run(mctx, m, unlessReplaced(&replaced, observers)...)
+		}()
+		if swapped != nil {
+			close(swapped)
+			swapped = nil
+		}
+	forward:
+		for {
+			var (
+				recv  = h.events
+				send  chan<- Event
+				first Event
+			)
+			if len(backlog) > 0 {
+				recv, send, first = nil, m.Sink(), backlog[0]
+			}
+			select {
+			case e := <-recv:
+				backlog = append(backlog, e)
+			case send <- first:
+				backlog = backlog[1:]
+			case s := <-h.swaps:
+				atomic.StoreInt32(&replaced, 1)
+				h.stop(ctx, m, cancel, done)
+				backlog = append(drain(m), backlog...)
+				if ho, ok := m.(Handoff); ok {
+					ho.Handoff(ctx, s.m)
+				}
+				h.current, swapped = s.m, s.done
+				break forward
+			case <-done:
+				cancel()
+				for _, e := range backlog {
+					Discard(e)
+				}
+				DiscardQueued(m)
+				DiscardQueued(h)
+				return
+			}
+		}
+	}
+}
+
+// unlessReplaced wraps observers so that they're not notified of the
+// termination of a machine once it's being replaced.
+func unlessReplaced(replaced *int32, observers []Observer) []Observer {
+	wrapped := make([]Observer, len(observers))
+	for i, o := range observers {
+		o := o
+		wrapped[i] = ObserverFunc(func(from Fn, e Event, to Fn) {
+			if to == nil && atomic.LoadInt32(replaced) != 0 {
+				return
+			}
+			o.Observe(from, e, to)
+		})
+	}
+	return wrapped
+}
+
+// stop stops a machine, preferably by preemption, and waits for it to exit.
+func (h *Host) stop(ctx Context, m Machine, cancel CancelFunc, done <-chan struct{}) {
+	if hm, ok := m.(Hijackable); ok {
+		timeout := h.StopTimeout
+		if timeout <= 0 {
+			timeout = time.Second
+		}
+		Preempt(ctx, hm, nil, timeout)
+	}
+	cancel()
+	<-done
+}
+
+// drain returns the events that are queued by the Source of a stopped machine.
+func drain(m EventSource) (events []Event) {
+	for {
+		select {
+		case e := <-m.Source():
+			events = append(events, e)
+		default:
+			return
+		}
+	}
+}
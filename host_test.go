@@ -0,0 +1,100 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+// printer returns a state that prints, and counts down, the events that it
+// receives; it stops receiving events once the count reaches zero.
+func printer(name string, count int, done chan<- struct{}) state.Fn {
+	return func(ctx state.Context, m state.Machine) state.Fn {
+		for ; count > 0; count-- {
+			select {
+			case e := <-m.Source():
+				fmt.Println(name, e.(*state.NamedEvent).Name)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		close(done)
+		<-ctx.Done()
+		return nil
+	}
+}
+
+func ExampleHost() {
+	var (
+		ctx     = make(state.SimpleContext)
+		exited  = make(chan struct{})
+		handled = make(chan struct{})
+		v1      = state.NewSimpleMachine(1, printer("v1", 1, handled))
+		host    = state.NewHost(1, v1)
+	)
+	go func() {
+		defer close(exited)
+		host.Run(ctx)
+	}()
+
+	host.Sink() <- &state.NamedEvent{Name: "a"}
+	<-handled
+
+	// v1 stalls: b and c are in flight when v2 takes over
+	host.Sink() <- &state.NamedEvent{Name: "b"}
+	host.Sink() <- &state.NamedEvent{Name: "c"}
+
+	handled = make(chan struct{})
+	v2 := state.NewSimpleMachine(1, printer("v2", 3, handled))
+	if err := host.Swap(ctx, v2); err != nil {
+		fmt.Println(err)
+	}
+	host.Sink() <- &state.NamedEvent{Name: "d"}
+	<-handled
+
+	ctx.Cancel()
+	<-exited
+	// Output:
+	// v1 a
+	// v2 b
+	// v2 c
+	// v2 d
+}
+
+func TestHost_Swap(t *testing.T) {
+	var (
+		ctx  = make(state.SimpleContext)
+		host = state.NewHost(0, state.NewSimpleMachine(0, nil)) // terminates at once
+	)
+	defer ctx.Cancel()
+	host.Run(ctx)
+
+	swapped := make(chan error)
+	go func() { swapped <- host.Swap(ctx, state.NewSimpleMachine(0, nil)) }()
+	select {
+	case err := <-swapped:
+		if err != state.ErrCancelled {
+			t.Fatalf("expected ErrCancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Swap blocks once the Host doesn't run anymore")
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import "reflect"
+
+type (
+	// Handler reacts to an event that's received by a Loop: it returns the
+	// next state, Stay to remain in the current state, or nil to terminate
+	// the machine.
+	Handler func(ctx Context, m Machine, e Event) Fn
+
+	// EventHandler handles the events of a single type, see On.
+	EventHandler struct {
+		handle func(ctx Context, m Machine, e Event) (Fn, bool)
+	}
+
+	// Loop implements the event loop of a typical state func: it reacts to
+	// the events of the machine's Source until a handler returns the next
+	// state, the machine is hijacked (see Next; hijacks that the policy of
+	// the machine rejects are ignored, see Accept) or the Context is done. The
+	// defaults accept hijacks and terminate upon cancellation.
+	//
+	// Observers and tooling identify states by the name of their func, so
+	// Run is best invoked by a named state func:
+	//
+	//	func connected(ctx state.Context, m state.Machine) state.Fn {
+	//		return state.Loop{
+	//			Handlers: []state.EventHandler{state.On(disconnect)},
+	//			OnCancel: terminate,
+	//		}.Run(ctx, m)
+	//	}
+	//
+	// where `disconnect` is a func(state.Context, state.Machine,
+	// *DisconnectRequest) state.Fn.
+	Loop struct {
+		// Handlers handle events by type, see On: the first of the
+		// Handlers that accepts an event handles it.
+		Handlers []EventHandler
+		// Handle handles the events that Handlers doesn't; if it's nil then
+		// such events are discarded, see Discard.
+		Handle Handler
+		// OnCancel returns the next state once the Context is done, or once
+		// the Source of the machine is closed; if it's nil then the machine
+		// terminates.
+		OnCancel func(ctx Context, m Machine) Fn
+		// OnHijack returns the next state, given the state requested by a
+		// hijacker; if it's nil then the hijacker's state is the next state.
+		OnHijack func(ctx Context, m Machine, f Fn) Fn
+		// Until, if set, ends the loop with the state that it yields, e.g.
+		// the Future of a state that's been delegated to.
+		Until Transition
+	}
+)
+
+// On returns an EventHandler for the events of type E, e.g.
+// `state.On(func(ctx state.Context, m state.Machine, e *ConnectRequest) state.Fn {...})`.
+func On[E Event](h func(ctx Context, m Machine, e E) Fn) EventHandler {
+	return EventHandler{func(ctx Context, m Machine, e Event) (Fn, bool) {
+		if x, ok := e.(E); ok {
+			return h(ctx, m, x), true
+		}
+		return nil, false
+	}}
+}
+
+// Stay is returned by the handlers of a Loop to remain in the current state.
+// It's a marker rather than a state: if it's run then the machine terminates.
+func Stay(Context, Machine) Fn { return nil }
+
+var stay = reflect.ValueOf(Stay).Pointer()
+
+func isStay(f Fn) bool { return f != nil && reflect.ValueOf(f).Pointer() == stay }
+
+// Run runs the loop; it has the signature of a state func.
+func (l Loop) Run(ctx Context, m Machine) Fn {
+	var (
+		next  = Next(m)
+		until <-chan Fn
+	)
+	if l.Until != nil {
+		until = l.Until.NextState()
+	}
+	for {
+		select {
+		case e, ok := <-m.Source():
+			if !ok {
+				return l.cancel(ctx, m)
+			}
+			f, ok := l.handle(ctx, m, e)
+			if !ok {
+				Discard(e)
+				continue
+			}
+			if !isStay(f) {
+				return f
+			}
+		case f := <-until:
+			return f
+		case f := <-next:
+			f, ok := Accept(f)
+			if !ok {
+				continue // the hijack is rejected
+			}
+			if l.OnHijack != nil {
+				return l.OnHijack(ctx, m, f)
+			}
+			return f
+		case <-ctx.Done():
+			return l.cancel(ctx, m)
+		}
+	}
+}
+
+// cancel returns the result of OnCancel, if any.
+func (l Loop) cancel(ctx Context, m Machine) Fn {
+	if l.OnCancel != nil {
+		return l.OnCancel(ctx, m)
+	}
+	return nil
+}
+
+// handle returns the result of the handler of an event, and false if there's
+// no handler.
+func (l Loop) handle(ctx Context, m Machine, e Event) (Fn, bool) {
+	for _, h := range l.Handlers {
+		if f, ok := h.handle(ctx, m, e); ok {
+			return f, true
+		}
+	}
+	if l.Handle != nil {
+		return l.Handle(ctx, m, e), true
+	}
+	return nil, false
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+type (
+	incEvent  struct{ state.AbstractEvent }
+	stopEvent struct{ state.AbstractEvent }
+)
+
+func counting(ctx state.Context, m state.Machine) state.Fn {
+	count := 0
+	return state.Loop{
+		Handlers: []state.EventHandler{
+			state.On(func(state.Context, state.Machine, *incEvent) state.Fn {
+				count++
+				return state.Stay
+			}),
+			state.On(func(state.Context, state.Machine, *stopEvent) state.Fn {
+				fmt.Println("count:", count)
+				return stopped
+			}),
+		},
+	}.Run(ctx, m)
+}
+
+func stopped(state.Context, state.Machine) state.Fn { return nil }
+
+func ExampleLoop() {
+	m := state.NewSimpleMachine(5, counting)
+	for _, e := range []state.Event{&incEvent{}, &incEvent{}, &state.NamedEvent{Name: "ignored"}, &incEvent{}, &stopEvent{}} {
+		m.Sink() <- e
+	}
+	state.Run(make(state.SimpleContext), m)
+	// Output:
+	// count: 3
+}
+
+// hijackableMachine is a machine that supports hijacks.
+type hijackableMachine struct {
+	state.Machine
+	hijack chan state.Fn
+}
+
+func (m *hijackableMachine) NextState() <-chan state.Fn { return m.hijack }
+
+// transition is a Transition that's fed by hand.
+type transition chan state.Fn
+
+func (t transition) NextState() <-chan state.Fn { return t }
+
+func TestLoop(t *testing.T) {
+	var (
+		cancelled = make(state.SimpleContext)
+		until     = make(transition, 1)
+		m         = &hijackableMachine{state.NewSimpleMachine(0, nil), make(chan state.Fn, 1)}
+		closed    = state.NewSimpleMachine(0, nil)
+	)
+	cancelled.Cancel()
+	close(closed.Sink())
+	until <- stopped
+	for _, tc := range []struct {
+		name   string
+		ctx    state.Context
+		loop   state.Loop
+		hijack bool
+		closed bool
+		want   state.Fn
+	}{
+		{name: "cancelled", ctx: cancelled},
+		{name: "on cancel", ctx: cancelled, loop: state.Loop{OnCancel: func(state.Context, state.Machine) state.Fn { return stopped }}, want: stopped},
+		{name: "hijacked", hijack: true, want: stopped},
+		{name: "on hijack", hijack: true, loop: state.Loop{OnHijack: func(_ state.Context, _ state.Machine, f state.Fn) state.Fn { return counting }}, want: counting},
+		{name: "until", loop: state.Loop{Until: until}, want: stopped},
+		{name: "closed", closed: true},
+		{name: "on close", closed: true, loop: state.Loop{OnCancel: func(state.Context, state.Machine) state.Fn { return stopped }}, want: stopped},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := tc.ctx
+			if ctx == nil {
+				ctx = make(state.SimpleContext)
+			}
+			if tc.hijack {
+				m.hijack <- stopped
+			}
+			var machine state.Machine = m
+			if tc.closed {
+				machine = closed
+			}
+			if got := tc.loop.Run(ctx, machine); state.FuncName(got) != state.FuncName(tc.want) {
+				t.Fatalf("expected state %q, got %q", state.FuncName(tc.want), state.FuncName(got))
+			}
+		})
+	}
+}
+
+func TestLoop_handlers(t *testing.T) {
+	var (
+		handled []string
+		loop    = state.Loop{
+			Handlers: []state.EventHandler{
+				state.On(func(_ state.Context, _ state.Machine, e *state.NamedEvent) state.Fn {
+					handled = append(handled, e.Name)
+					if e.Name == "stop" {
+						return nil // terminates
+					}
+					return state.Stay
+				}),
+			},
+			Handle: func(_ state.Context, _ state.Machine, e state.Event) state.Fn {
+				handled = append(handled, state.EventName(e))
+				return state.Stay
+			},
+		}
+		m = state.NewSimpleMachine(4, nil)
+	)
+	for _, e := range []state.Event{&state.NamedEvent{Name: "a"}, &incEvent{}, &state.NamedEvent{Name: "stop"}, &incEvent{}} {
+		m.Sink() <- e
+	}
+	if f := loop.Run(make(state.SimpleContext), m); f != nil {
+		t.Fatalf("expected the machine to terminate, got state %q", state.FuncName(f))
+	}
+	if want := "[a incEvent stop]"; fmt.Sprint(handled) != want {
+		t.Fatalf("expected %s handled, got %v", want, handled)
+	}
+}
+
+func TestLoop_discarded(t *testing.T) {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	// Loop discards the events that it has no Handler for
+	m := state.NewSimpleMachine(0, state.Loop{}.Run)
+	go state.Run(ctx, m)
+	if _, err := state.Ask[bool](ctx, m, &lookupRequest{}, time.Second); !errors.Is(err, state.ErrDropped) {
+		t.Fatalf("expected ErrDropped, got %v", err)
+	}
+}
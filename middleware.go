@@ -0,0 +1,31 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+type (
+	// Middleware processes an event on its way to a machine (see package
+	// middleware): it returns the event to pass on, which may differ from e,
+	// or an error, which is the reason for dropping e.
+	Middleware interface {
+		Process(ctx Context, e Event) (Event, error)
+	}
+
+	// MiddlewareFunc adapts a func to the Middleware interface.
+	MiddlewareFunc func(ctx Context, e Event) (Event, error)
+)
+
+func (f MiddlewareFunc) Process(ctx Context, e Event) (Event, error) { return f(ctx, e) }
@@ -0,0 +1,102 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware_test
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/middleware"
+)
+
+type reading struct {
+	state.AbstractEvent
+	Celsius float64
+	Source  string
+}
+
+func Example() {
+	var (
+		ctx    = make(state.SimpleContext)
+		events = state.NewSimpleEvents(10)
+		drops  = &middleware.Drops{}
+		chain  = middleware.New(
+			middleware.Only("reading"),
+			middleware.Validate(func(e state.Event) error {
+				if e.(*reading).Celsius < -273.15 {
+					return errors.New("below absolute zero")
+				}
+				return nil
+			}),
+			middleware.Map(func(_ state.Context, e state.Event) state.Event {
+				r := *e.(*reading)
+				r.Source = "sensor-1"
+				return &r
+			}),
+		)
+	)
+	defer ctx.Cancel()
+	chain.OnDrop = drops.Record
+
+	// producers send to the sink of the chain, which forwards to events
+	sink := chain.Sink(ctx, events, 0)
+	sink.Sink() <- &reading{Celsius: 21.5}
+	sink.Sink() <- &state.NamedEvent{Name: "noise"}
+	sink.Sink() <- &reading{Celsius: -300}
+	sink.Sink() <- &reading{Celsius: 22}
+
+	for i := 0; i < 2; i++ {
+		r := (<-events.Source()).(*reading)
+		fmt.Println(r.Source, r.Celsius)
+	}
+	for _, d := range drops.List() {
+		fmt.Printf("dropped %s at stage %d: %v\n", state.EventName(d.Event), d.Stage, d.Reason)
+	}
+	// Output:
+	// sensor-1 21.5
+	// sensor-1 22
+	// dropped noise at stage 0: filtered
+	// dropped reading at stage 1: below absolute zero
+}
+
+func ExampleShaper() {
+	var (
+		ctx    = make(state.SimpleContext)
+		events = state.NewSimpleEvents(0) // a busy machine, that reads nothing for now
+		shaper = &middleware.Shaper{
+			Policies: map[string]middleware.Policy{"progress": middleware.Coalesce()},
+		}
+		sink = shaper.Sink(ctx, events, 0)
+	)
+	defer ctx.Cancel()
+	for _, e := range []*state.NamedEvent{
+		{Name: "progress", Data: 10},
+		{Name: "progress", Data: 50},
+		{Name: "progress", Data: 100},
+		{Name: "done"},
+	} {
+		sink.Sink() <- e
+	}
+	for i := 0; i < 2; i++ {
+		e := (<-events.Source()).(*state.NamedEvent)
+		fmt.Println(e.Name, e.Data)
+	}
+	// Output:
+	// progress 100
+	// done <nil>
+}
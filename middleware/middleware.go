@@ -0,0 +1,234 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package middleware processes the events that flow through an EventSink or an
+// EventSource by a chain of middleware: to filter, map, log, validate or sample
+// them. Middleware may drop events; a Chain records why.
+package middleware
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jdef/state"
+)
+
+var (
+	// ErrFiltered is the reason of the drops of Filter, Only and Except.
+	ErrFiltered = errors.New("filtered")
+	// ErrSampled is the reason of the drops of Sample.
+	ErrSampled = errors.New("sampled out")
+	// ErrNoEvent is the reason of a drop by middleware that returns neither
+	// an event nor an error.
+	ErrNoEvent = errors.New("no event")
+)
+
+type (
+	// Chain processes events by its middleware, in order: an event that's
+	// dropped by one middleware isn't processed by those that follow.
+	Chain struct {
+		Middleware []state.Middleware
+		// OnDrop, if set, is notified of every event that's dropped.
+		OnDrop func(Drop)
+	}
+
+	// Drop records why an event was dropped, and by which middleware of a
+	// Chain (its index).
+	Drop struct {
+		Event  state.Event
+		Stage  int
+		Reason error
+	}
+
+	// Drops records the drops that it's notified of, see Chain.OnDrop.
+	Drops struct {
+		mu   sync.Mutex
+		list []Drop
+	}
+
+	sink   chan<- state.Event
+	source <-chan state.Event
+)
+
+var (
+	// Chain implements state.Middleware
+	_ state.Middleware = &Chain{}
+	// sink implements state.EventSink
+	_ state.EventSink = sink(nil)
+	// source implements state.EventSource
+	_ state.EventSource = source(nil)
+)
+
+// New returns a Chain of the given middleware, in order.
+func New(middleware ...state.Middleware) *Chain {
+	return &Chain{Middleware: middleware}
+}
+
+// Process passes an event through the middleware of the chain, in order, and
+// returns the resulting event. If a middleware drops the event, or returns no
+// event (ErrNoEvent), then the drop is reported to OnDrop, the event is
+// discarded (see state.Discard, so that the asker of a dropped request isn't
+// left waiting) and the reason of the drop is returned.
+func (c *Chain) Process(ctx state.Context, e state.Event) (state.Event, error) {
+	for i, m := range c.Middleware {
+		out, err := m.Process(ctx, e)
+		if err == nil && out == nil {
+			err = ErrNoEvent
+		}
+		if err != nil {
+			if c.OnDrop != nil {
+				c.OnDrop(Drop{Event: e, Stage: i, Reason: err})
+			}
+			state.Discard(e)
+			return nil, err
+		}
+		e = out
+	}
+	return e, nil
+}
+
+// Sink returns a sink, with a queue of the given length, whose events are
+// processed by the chain and then forwarded to `to`, until the Context is
+// done or the sink is closed. Events are processed by a single goroutine, in
+// order.
+func (c *Chain) Sink(ctx state.Context, to state.EventSink, queueLength int) state.EventSink {
+	in := make(chan state.Event, queueLength)
+	go c.pump(ctx, in, to.Sink())
+	return sink(in)
+}
+
+// Source returns a source that yields the events of `from` that pass through
+// the chain, until the Context is done or `from` is closed, upon which the
+// source is closed. Events are processed by a single goroutine, in order.
+func (c *Chain) Source(ctx state.Context, from state.EventSource) state.EventSource {
+	out := make(chan state.Event)
+	go func() {
+		defer close(out)
+		c.pump(ctx, from.Source(), out)
+	}()
+	return source(out)
+}
+
+func (c *Chain) pump(ctx state.Context, in <-chan state.Event, out chan<- state.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-in:
+			if !ok {
+				return
+			}
+			e, err := c.Process(ctx, e)
+			if err != nil {
+				continue
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (s sink) Sink() chan<- state.Event     { return s }
+func (s source) Source() <-chan state.Event { return s }
+
+// Record records a drop; it may be assigned to Chain.OnDrop.
+func (d *Drops) Record(drop Drop) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.list = append(d.list, drop)
+}
+
+// List returns the drops recorded so far, in order.
+func (d *Drops) List() []Drop {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Drop(nil), d.list...)
+}
+
+// Filter drops the events (ErrFiltered) that keep returns false for.
+func Filter(keep func(state.Event) bool) state.Middleware {
+	return state.MiddlewareFunc(func(_ state.Context, e state.Event) (state.Event, error) {
+		if !keep(e) {
+			return nil, ErrFiltered
+		}
+		return e, nil
+	})
+}
+
+// Only drops the events (ErrFiltered) whose names (see state.EventName) are
+// not among the given names.
+func Only(names ...string) state.Middleware {
+	set := nameSet(names)
+	return Filter(func(e state.Event) bool { return set[state.EventName(e)] })
+}
+
+// Except drops the events (ErrFiltered) whose names (see state.EventName) are
+// among the given names.
+func Except(names ...string) state.Middleware {
+	set := nameSet(names)
+	return Filter(func(e state.Event) bool { return !set[state.EventName(e)] })
+}
+
+// Map replaces events by the result of f, e.g. to enrich them. Events that f
+// returns nil for are dropped (ErrNoEvent).
+func Map(f func(state.Context, state.Event) state.Event) state.Middleware {
+	return state.MiddlewareFunc(func(ctx state.Context, e state.Event) (state.Event, error) {
+		return f(ctx, e), nil
+	})
+}
+
+// Log logs the name (see state.EventName) of every event, e.g. via log.Printf.
+func Log(logf func(format string, args ...interface{})) state.Middleware {
+	return state.MiddlewareFunc(func(_ state.Context, e state.Event) (state.Event, error) {
+		logf("event %s", state.EventName(e))
+		return e, nil
+	})
+}
+
+// Validate drops the events that validate returns an error for; the error is
+// the reason for the drop.
+func Validate(validate func(state.Event) error) state.Middleware {
+	return state.MiddlewareFunc(func(_ state.Context, e state.Event) (state.Event, error) {
+		if err := validate(e); err != nil {
+			return nil, err
+		}
+		return e, nil
+	})
+}
+
+// Sample passes the first of every n events, and drops the others
+// (ErrSampled). All events pass if n < 2.
+func Sample(n int) state.Middleware {
+	var count uint64
+	return state.MiddlewareFunc(func(_ state.Context, e state.Event) (state.Event, error) {
+		if n > 1 && (atomic.AddUint64(&count, 1)-1)%uint64(n) != 0 {
+			return nil, ErrSampled
+		}
+		return e, nil
+	})
+}
+
+func nameSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
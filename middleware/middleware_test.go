@@ -0,0 +1,139 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/middleware"
+)
+
+func TestChain_Process(t *testing.T) {
+	var (
+		ctx    = make(state.SimpleContext)
+		logged []string
+		drops  = &middleware.Drops{}
+		chain  = &middleware.Chain{
+			Middleware: []state.Middleware{
+				middleware.Log(func(format string, args ...interface{}) { logged = append(logged, fmt.Sprintf(format, args...)) }),
+				middleware.Except("secret"),
+				middleware.Sample(2),
+				middleware.Map(func(_ state.Context, e state.Event) state.Event {
+					if state.EventName(e) == "void" {
+						return nil
+					}
+					return e
+				}),
+			},
+			OnDrop: drops.Record,
+		}
+		passed []string
+	)
+	for _, name := range []string{"a", "secret", "b", "c", "d", "void"} {
+		e, err := chain.Process(ctx, &state.NamedEvent{Name: name})
+		if err == nil {
+			passed = append(passed, state.EventName(e))
+		}
+	}
+	if fmt.Sprint(passed) != "[a c]" {
+		t.Errorf("unexpected events passed: %v", passed)
+	}
+	if len(logged) != 6 {
+		t.Errorf("expected every event to be logged, got %v", logged)
+	}
+	want := []struct {
+		name   string
+		stage  int
+		reason error
+	}{
+		{"secret", 1, middleware.ErrFiltered},
+		{"b", 2, middleware.ErrSampled},
+		{"d", 2, middleware.ErrSampled},
+		{"void", 3, middleware.ErrNoEvent},
+	}
+	got := drops.List()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d drops, got %v", len(want), got)
+	}
+	for i, w := range want {
+		if g := got[i]; state.EventName(g.Event) != w.name || g.Stage != w.stage || !errors.Is(g.Reason, w.reason) {
+			t.Errorf("drop %d: expected %s at stage %d (%v), got %s at stage %d (%v)",
+				i, w.name, w.stage, w.reason, state.EventName(g.Event), g.Stage, g.Reason)
+		}
+	}
+}
+
+// Req is a request that's named after its type, see state.EventName.
+type Req struct{ state.Request }
+
+func TestChain_Process_request(t *testing.T) {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	// requests that are dropped are discarded, rather than left unanswered
+	sink := middleware.New(middleware.Except("Req")).Sink(ctx, state.NewSimpleEvents(1), 0)
+	if _, err := state.Ask[bool](ctx, sink, &Req{}, time.Second); !errors.Is(err, state.ErrDropped) {
+		t.Fatalf("expected ErrDropped, got %v", err)
+	}
+}
+
+func TestChain_Source(t *testing.T) {
+	var (
+		ctx    = make(state.SimpleContext)
+		events = state.NewSimpleEvents(3)
+		source = middleware.New(middleware.Only("keep")).Source(ctx, events)
+	)
+	defer ctx.Cancel()
+	for _, name := range []string{"drop", "keep", "drop"} {
+		events.Sink() <- &state.NamedEvent{Name: name}
+	}
+	if e := <-source.Source(); state.EventName(e) != "keep" {
+		t.Fatalf("expected event keep, got %s", state.EventName(e))
+	}
+}
+
+// events is an EventSource that's fed, and closed, by hand.
+type events chan state.Event
+
+func (e events) Source() <-chan state.Event { return e }
+
+func TestChain_Source_closed(t *testing.T) {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	from := make(events, 1)
+	source := middleware.New().Source(ctx, from)
+	from <- &state.NamedEvent{Name: "last"}
+	close(from)
+	if e := <-source.Source(); state.EventName(e) != "last" {
+		t.Fatalf("expected event last, got %s", state.EventName(e))
+	}
+	if e, ok := <-source.Source(); ok {
+		t.Fatalf("expected the source to close, got %s", state.EventName(e))
+	}
+
+	// the source also closes once the Context is done
+	source = middleware.New().Source(ctx, make(events))
+	ctx.Cancel()
+	if _, ok := <-source.Source(); ok {
+		t.Fatal("expected the source to close")
+	}
+}
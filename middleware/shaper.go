@@ -0,0 +1,260 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+// ErrSuperseded is the reason for dropping an event that's superseded by a
+// later event of the same kind, see Shaper.
+var ErrSuperseded = errors.New("superseded")
+
+type (
+	// Policy shapes the bursts of events of a single kind, see Shaper.
+	Policy struct {
+		mode     mode
+		interval time.Duration
+	}
+
+	// Shaper shapes noisy events on their way to a sink, per kind of event
+	// (see state.EventName): events of kinds without a Policy are forwarded
+	// as is. An event that a Policy releases supersedes the event of the same
+	// kind, if any, that's pending delivery, so that at most one event of
+	// every shaped kind is pending; it's queued behind the events that are
+	// already pending, so events are delivered in the order of their release.
+	Shaper struct {
+		// Policies maps event names to policies.
+		Policies map[string]Policy
+		// OnDrop, if set, is notified of every event that's superseded
+		// (ErrSuperseded); the Stage of such drops is 0.
+		OnDrop func(Drop)
+	}
+
+	mode int
+
+	// shaper is the state of the goroutine that forwards the events of a
+	// sink that's shaped by a Shaper.
+	shaper struct {
+		*Shaper
+		ctx     state.Context
+		pending []pendingEvent // awaiting delivery, in order
+		plain   int            // pending events without policy
+		held    map[string]*held
+		fired   chan firing
+	}
+
+	pendingEvent struct {
+		kind  string
+		event state.Event
+	}
+
+	// held is the per-kind state of the Debounce and Throttle policies.
+	held struct {
+		event state.Event // the latest event that's held back, or nil
+		timer *time.Timer
+		gen   int       // invalidates timers that fire after being stopped
+		until time.Time // the end of the current Throttle interval
+	}
+
+	firing struct {
+		kind string
+		gen  int
+	}
+)
+
+const (
+	coalesce mode = iota
+	debounce
+	throttle
+)
+
+// Coalesce releases events at once, superseding the pending event of the same
+// kind, if any: a slow machine receives only the latest of the events that
+// arrive while it's busy.
+func Coalesce() Policy { return Policy{mode: coalesce} }
+
+// Debounce holds events back until no other event of the same kind arrives
+// for the given interval, and then releases the latest one.
+func Debounce(interval time.Duration) Policy { return Policy{mode: debounce, interval: interval} }
+
+// Throttle releases at most one event of a kind per interval: the first event
+// is released at once, and the latest of the events that arrive within the
+// interval is released at its end.
+func Throttle(interval time.Duration) Policy { return Policy{mode: throttle, interval: interval} }
+
+// Sink returns a sink, with a queue of the given length, whose events are
+// shaped and then forwarded to `to`, until the Context is done or the sink is
+// closed; the events that are pending delivery, or held back, by then are
+// discarded (see state.Discard). Producers block once the given number of
+// events without policy are pending delivery (at least one).
+func (s *Shaper) Sink(ctx state.Context, to state.EventSink, queueLength int) state.EventSink {
+	in := make(chan state.Event, queueLength)
+	sh := &shaper{
+		Shaper: s,
+		ctx:    ctx,
+		held:   map[string]*held{},
+		fired:  make(chan firing),
+	}
+	limit := queueLength
+	if limit < 1 {
+		limit = 1
+	}
+	go sh.run(in, to.Sink(), limit)
+	return sink(in)
+}
+
+func (s *shaper) run(in <-chan state.Event, out chan<- state.Event, limit int) {
+	defer s.stop()
+	for {
+		var (
+			recv = in
+			send chan<- state.Event
+			head state.Event
+		)
+		if len(s.pending) > 0 {
+			send, head = out, s.pending[0].event
+		}
+		if s.plain >= limit {
+			recv = nil
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case e, ok := <-recv:
+			if !ok {
+				return
+			}
+			s.receive(e)
+		case send <- head:
+			if _, ok := s.Policies[s.pending[0].kind]; !ok {
+				s.plain--
+			}
+			s.pending = s.pending[1:]
+		case f := <-s.fired:
+			s.fire(f)
+		}
+	}
+}
+
+func (s *shaper) receive(e state.Event) {
+	kind := state.EventName(e)
+	p, ok := s.Policies[kind]
+	if !ok {
+		s.pending = append(s.pending, pendingEvent{kind, e})
+		s.plain++
+		return
+	}
+	h := s.held[kind]
+	if h == nil {
+		h = &held{}
+		s.held[kind] = h
+	}
+	switch p.mode {
+	case coalesce:
+		s.release(kind, e)
+	case debounce:
+		s.hold(h, e)
+		s.arm(kind, h, p.interval)
+	case throttle:
+		if now := time.Now(); h.event == nil && !now.Before(h.until) {
+			s.release(kind, e)
+			h.until = now.Add(p.interval)
+			return
+		}
+		if h.event == nil {
+			s.arm(kind, h, time.Until(h.until))
+		}
+		s.hold(h, e)
+	}
+}
+
+// fire releases the event that's held back for a kind, once its timer fires.
+func (s *shaper) fire(f firing) {
+	h := s.held[f.kind]
+	if f.gen != h.gen || h.event == nil {
+		return
+	}
+	s.release(f.kind, h.event)
+	h.event = nil
+	if p := s.Policies[f.kind]; p.mode == throttle {
+		h.until = time.Now().Add(p.interval)
+	}
+}
+
+// hold holds an event back, in place of the one that's held back already.
+func (s *shaper) hold(h *held, e state.Event) {
+	if h.event != nil {
+		s.drop(h.event)
+	}
+	h.event = e
+}
+
+// arm (re)starts the timer of a kind.
+func (s *shaper) arm(kind string, h *held, d time.Duration) {
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.gen++
+	f := firing{kind, h.gen}
+	h.timer = time.AfterFunc(d, func() {
+		select {
+		case s.fired <- f:
+		case <-s.ctx.Done():
+		}
+	})
+}
+
+// release queues an event for delivery, dropping the pending event of the
+// same kind if there's one.
+func (s *shaper) release(kind string, e state.Event) {
+	for i := range s.pending {
+		if s.pending[i].kind == kind {
+			s.drop(s.pending[i].event)
+			s.pending = append(s.pending[:i:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	s.pending = append(s.pending, pendingEvent{kind, e})
+}
+
+// drop reports a superseded event to OnDrop, and discards it so that the
+// asker of a superseded request isn't left waiting.
+func (s *shaper) drop(e state.Event) {
+	if s.OnDrop != nil {
+		s.OnDrop(Drop{Event: e, Reason: ErrSuperseded})
+	}
+	state.Discard(e)
+}
+
+// stop stops the timers, and discards the events that won't be delivered.
+func (s *shaper) stop() {
+	for _, h := range s.held {
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		if h.event != nil {
+			state.Discard(h.event)
+		}
+	}
+	for _, p := range s.pending {
+		state.Discard(p.event)
+	}
+}
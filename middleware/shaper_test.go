@@ -0,0 +1,146 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/middleware"
+)
+
+func TestShaper(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	for _, tc := range []struct {
+		name   string
+		policy middleware.Policy
+		want   []int // the data of the events that are delivered
+	}{
+		{name: "debounce", policy: middleware.Debounce(interval), want: []int{3}},
+		{name: "throttle", policy: middleware.Throttle(interval), want: []int{1, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				ctx    = make(state.SimpleContext)
+				events = state.NewSimpleEvents(10)
+				drops  = &middleware.Drops{}
+				shaper = &middleware.Shaper{
+					Policies: map[string]middleware.Policy{"tick": tc.policy},
+					OnDrop:   drops.Record,
+				}
+				sink  = shaper.Sink(ctx, events, 0)
+				start = time.Now()
+			)
+			defer ctx.Cancel()
+			for i := 1; i <= 3; i++ {
+				sink.Sink() <- &state.NamedEvent{Name: "tick", Data: i}
+			}
+			for _, want := range tc.want {
+				select {
+				case e := <-events.Source():
+					if got := e.(*state.NamedEvent).Data; got != want {
+						t.Fatalf("expected event %d, got %v", want, got)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("timed out waiting for event %d", want)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < interval {
+				t.Fatalf("expected the last event to be held back for %v, got %v", interval, elapsed)
+			}
+			if n := len(drops.List()); n != 3-len(tc.want) {
+				t.Fatalf("expected %d superseded events, got %d", 3-len(tc.want), n)
+			}
+			select {
+			case e := <-events.Source():
+				t.Fatalf("unexpected event %v", e)
+			case <-time.After(2 * interval):
+			}
+		})
+	}
+}
+
+func TestShaper_order(t *testing.T) {
+	var (
+		ctx    = make(state.SimpleContext)
+		events = state.NewSimpleEvents(0) // not read until all events are shaped
+		drops  = &middleware.Drops{}
+		shaper = &middleware.Shaper{
+			Policies: map[string]middleware.Policy{"tick": middleware.Coalesce()},
+			OnDrop:   drops.Record,
+		}
+		sink = shaper.Sink(ctx, events, 2)
+	)
+	defer ctx.Cancel()
+	sink.Sink() <- &state.NamedEvent{Name: "tick", Data: 1}
+	sink.Sink() <- &state.NamedEvent{Name: "plain"}
+	sink.Sink() <- &state.NamedEvent{Name: "tick", Data: 2}
+	for deadline := time.Now().Add(time.Second); len(drops.List()) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the first tick to be superseded")
+		}
+	}
+
+	// the latest tick is delivered after the event that preceded it
+	for _, want := range []string{"plain", "tick"} {
+		select {
+		case e := <-events.Source():
+			if got := state.EventName(e); got != want {
+				t.Fatalf("expected event %s, got %s", want, got)
+			}
+			if want == "tick" && e.(*state.NamedEvent).Data != 2 {
+				t.Fatalf("expected the latest tick, got %v", e.(*state.NamedEvent).Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event %s", want)
+		}
+	}
+}
+
+func TestShaper_requests(t *testing.T) {
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+
+	var (
+		shaper = &middleware.Shaper{Policies: map[string]middleware.Policy{"Req": middleware.Coalesce()}}
+		sink   = shaper.Sink(ctx, state.NewSimpleEvents(0), 1) // never read
+		asked  = make(chan error)
+	)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := state.Ask[bool](ctx, sink, &Req{}, 0)
+			asked <- err
+		}()
+	}
+	// superseded requests are discarded, and so is the pending one once the
+	// sink is closed
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			close(sink.Sink())
+		}
+		select {
+		case err := <-asked:
+			if !errors.Is(err, state.ErrDropped) {
+				t.Fatalf("expected ErrDropped, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a discarded request")
+		}
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+type (
+	// Observer is notified by Run of every state transition.
+	Observer interface {
+		// Observe is invoked after state func `from` returns state `to`. The
+		// initial state is observed as a transition from nil, and termination
+		// of the machine as a transition to nil; a machine without an initial
+		// state is observed as a transition from nil to nil. The event is the
+		// last event delivered by the machine's Source while in state `from`,
+		// or nil if none was delivered or events aren't traced (see
+		// TraceEvents).
+		Observe(from Fn, e Event, to Fn)
+	}
+
+	// ObserverFunc adapts a func to the Observer interface.
+	ObserverFunc func(from Fn, e Event, to Fn)
+)
+
+func (f ObserverFunc) Observe(from Fn, e Event, to Fn) { f(from, e, to) }
+
+var observers = struct {
+	sync.Mutex
+	list []*Observer
+}{}
+
+// AddObserver registers an Observer that's notified of the transitions of
+// every Run, in addition to the observers given to Run. Returns a func that
+// unregisters the Observer. This is primarily intended for test tooling.
+func AddObserver(o Observer) (remove func()) {
+	observers.Lock()
+	defer observers.Unlock()
+	p := &o
+	observers.list = append(observers.list, p)
+	return func() {
+		observers.Lock()
+		defer observers.Unlock()
+		for i, x := range observers.list {
+			if x == p {
+				observers.list = append(observers.list[:i:i], observers.list[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func globalObservers() (result []Observer) {
+	observers.Lock()
+	defer observers.Unlock()
+	for _, p := range observers.list {
+		result = append(result, *p)
+	}
+	return
+}
+
+// FuncName returns the fully-qualified name of a state func, for example
+// "github.com/jdef/state/demo/agent.disconnected"; returns "" for nil.
+func FuncName(f Fn) string {
+	if f == nil {
+		return ""
+	}
+	if rf := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); rf != nil {
+		return rf.Name()
+	}
+	return ""
+}
+
+// EventName returns the name of an event: events that implement an
+// `EventName() string` method (like NamedEvent) name themselves, otherwise
+// the name of the type of the event is returned, without package qualifier or
+// pointer indirection, for example "ConnectRequest".
+func EventName(e Event) string {
+	if e == nil {
+		return ""
+	}
+	if n, ok := e.(interface{ EventName() string }); ok {
+		return n.EventName()
+	}
+	t := reflect.TypeOf(e)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+var tracing = struct {
+	sync.Mutex
+	enabled bool
+	tracers map[chan<- Event]*tracer // keyed by Sink
+}{tracers: map[chan<- Event]*tracer{}}
+
+// TraceEvents enables tracing of the events delivered by the Source of
+// SimpleEvents (and so SimpleMachine) instances that are created afterwards,
+// so that observers learn which event triggered a transition. While Run
+// executes a traced machine its Source is fed by a goroutine that holds at
+// most one event in flight: a send to an unbuffered Sink may complete before
+// a state func receives the event. The goroutine stops, and hands back any
+// event it holds, when Run returns. Tracing is meant for tests, not for
+// production use.
+func TraceEvents() {
+	tracing.Lock()
+	defer tracing.Unlock()
+	tracing.enabled = true
+}
+
+type (
+	// tracer interposes a pump between a SimpleEvents queue and its Source
+	// while the machine is run (see start and stop).
+	tracer struct {
+		in   <-chan Event
+		mu   sync.Mutex
+		out  chan Event // fed by the pump, nil unless running
+		rest chan Event // holds the event that was in flight upon stop
+		sync chan chan traceMark
+		halt chan chan Event
+	}
+
+	traceMark struct {
+		seq   uint64
+		event Event
+	}
+)
+
+// newTracer returns nil unless tracing is enabled, so that the Source of
+// SimpleEvents created before TraceEvents (or without it) is never routed
+// through a pump. The tracer is registered until `owner` is garbage collected.
+func newTracer(owner *SimpleEvents, events chan Event) *tracer {
+	tracing.Lock()
+	defer tracing.Unlock()
+	if !tracing.enabled {
+		return nil
+	}
+	t := &tracer{in: events}
+	tracing.tracers[events] = t
+	runtime.SetFinalizer(owner, func(*SimpleEvents) {
+		tracing.Lock()
+		defer tracing.Unlock()
+		delete(tracing.tracers, events)
+	})
+	return t
+}
+
+// source returns the chan from which the machine currently receives events.
+func (t *tracer) source() <-chan Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.out != nil {
+		return t.out
+	}
+	if t.rest != nil {
+		if len(t.rest) > 0 {
+			return t.rest
+		}
+		t.rest = nil
+	}
+	return t.in
+}
+
+// start interposes the pump and returns the tracer, or nil if the tracer is
+// nil or was already started.
+func (t *tracer) start() *tracer {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.out != nil {
+		return nil
+	}
+	in := t.in
+	if t.rest != nil && len(t.rest) > 0 {
+		in = t.rest // the pump switches to t.in once it's drained
+	}
+	t.out = make(chan Event)
+	t.rest = nil
+	t.sync = make(chan chan traceMark)
+	t.halt = make(chan chan Event)
+	go t.pump(in, t.out, t.sync, t.halt)
+	return t
+}
+
+// stop removes the pump. An event that the pump received, but the machine did
+// not, is delivered first by subsequent reads from the Source.
+func (t *tracer) stop() {
+	if t == nil {
+		return
+	}
+	r := make(chan Event, 1)
+	t.halt <- r
+	pending := <-r
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.out = nil
+	if pending != nil {
+		t.rest = make(chan Event, 1)
+		t.rest <- pending
+	}
+}
+
+// pump forwards events from in to out, counting deliveries. Because sync
+// requests are served by the same goroutine, a completed delivery is always
+// accounted for by the time a subsequent sync request is answered. Once in is
+// closed, out is closed too, and the pump only serves sync and halt requests.
+func (t *tracer) pump(in <-chan Event, out chan<- Event, sync <-chan chan traceMark, halt <-chan chan Event) {
+	var (
+		mark    traceMark
+		pending Event
+		send    chan<- Event
+		recv    = in
+	)
+	for {
+		select {
+		case e, ok := <-recv:
+			if !ok {
+				close(out)
+				in, recv = nil, nil
+				continue
+			}
+			pending, send, recv = e, out, nil
+		case send <- pending:
+			mark.seq++
+			mark.event = pending
+			if in != t.in && len(in) == 0 {
+				in = t.in
+			}
+			pending, send, recv = nil, nil, in
+		case r := <-sync:
+			r <- mark
+		case r := <-halt:
+			r <- pending
+			return
+		}
+	}
+}
+
+func (t *tracer) mark() traceMark {
+	if t == nil {
+		return traceMark{}
+	}
+	r := make(chan traceMark, 1)
+	t.sync <- r
+	return <-r
+}
+
+// since returns the last event delivered since the given mark, if any.
+func (t *tracer) since(m traceMark) Event {
+	if now := t.mark(); now.seq != m.seq {
+		return now.event
+	}
+	return nil
+}
+
+func tracerOf(m Machine) *tracer {
+	tracing.Lock()
+	defer tracing.Unlock()
+	return tracing.tracers[m.Sink()]
+}
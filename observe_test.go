@@ -0,0 +1,95 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+func TestTraceEvents(t *testing.T) {
+	state.TraceEvents()
+
+	m := state.NewSimpleMachine(0, func(ctx state.Context, m state.Machine) state.Fn {
+		select {
+		case <-m.Source():
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	go func() {
+		m.Sink() <- &state.NamedEvent{Name: "first"}
+		m.Sink() <- &state.NamedEvent{Name: "second"}
+	}()
+
+	var got []string
+	state.Run(make(state.SimpleContext), m, state.ObserverFunc(func(from state.Fn, e state.Event, to state.Fn) {
+		if from != nil {
+			got = append(got, state.EventName(e))
+		}
+	}))
+	if len(got) != 1 || got[0] != "first" {
+		t.Fatalf("expected the transition to be triggered by first, got %q", got)
+	}
+
+	// the second event may have been held by the tracer when Run returned;
+	// it must be available without waiting, as Host expects when it drains
+	select {
+	case e := <-m.Source():
+		if n := state.EventName(e); n != "second" {
+			t.Fatalf("expected second, got %q", n)
+		}
+	default:
+		t.Fatal("second event was lost")
+	}
+}
+
+func TestTraceEvents_closed(t *testing.T) {
+	state.TraceEvents()
+
+	m := state.NewSimpleMachine(1, func(ctx state.Context, m state.Machine) state.Fn {
+		for {
+			select {
+			case e, ok := <-m.Source():
+				if !ok {
+					return nil
+				}
+				if e == nil {
+					t.Error("unexpected nil event")
+					return nil
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	m.Sink() <- &state.NamedEvent{Name: "last"}
+	close(m.Sink())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		state.Run(make(state.SimpleContext), m, state.ObserverFunc(func(state.Fn, state.Event, state.Fn) {}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the traced Source wasn't closed")
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type (
+	// Registry makes machines addressable: machines register their Sink under
+	// a name, or any other comparable key, so that producers may Send events to
+	// them by key. Registrations are removed once a machine terminates, see
+	// Registration and Registry.Run. The zero value is ready for use.
+	Registry struct {
+		mu       sync.Mutex
+		entries  map[interface{}]*Registration
+		watchers map[*watcher]struct{}
+	}
+
+	// Registration is the registration of a machine under a key. It implements
+	// Observer: given to Run it removes the registration once the machine
+	// terminates.
+	Registration struct {
+		registry *Registry
+		key      interface{}
+		sink     chan<- Event
+		removed  chan struct{}
+		once     sync.Once
+	}
+
+	// RegistryEvent notifies a watcher that a key was registered, or that its
+	// registration was removed (in which case Sink is nil).
+	RegistryEvent struct {
+		Key        interface{}
+		Sink       chan<- Event
+		Registered bool
+	}
+
+	watcher struct {
+		mu     sync.Mutex
+		queue  []RegistryEvent
+		signal chan struct{}
+	}
+)
+
+var (
+	// ErrNotRegistered is returned when no machine is registered under a key.
+	ErrNotRegistered = errors.New("no machine registered")
+	// ErrAlreadyRegistered is returned when a key is already taken.
+	ErrAlreadyRegistered = errors.New("key already registered")
+	// ErrCancelled is returned when a Context is done before an operation
+	// completes.
+	ErrCancelled = errors.New("context cancelled")
+
+	// Registration implements Observer
+	_ Observer = &Registration{}
+)
+
+// Register registers the Sink of machine m under a key; returns an error that
+// wraps ErrAlreadyRegistered if the key is taken.
+func (r *Registry) Register(key interface{}, m EventSink) (*Registration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[key]; ok {
+		return nil, fmt.Errorf("%v: %w", key, ErrAlreadyRegistered)
+	}
+	if r.entries == nil {
+		r.entries = map[interface{}]*Registration{}
+	}
+	reg := &Registration{registry: r, key: key, sink: m.Sink(), removed: make(chan struct{})}
+	r.entries[key] = reg
+	r.notify(RegistryEvent{Key: key, Sink: reg.sink, Registered: true})
+	return reg, nil
+}
+
+// Run registers machine m under a key and runs it (see Run); the
+// registration is removed once the machine terminates, or panics, and the
+// events that it left queued are discarded (see DiscardQueued).
+func (r *Registry) Run(ctx Context, key interface{}, m Machine, observers ...Observer) error {
+	reg, err := r.Register(key, m)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		reg.Unregister()
+		DiscardQueued(m)
+	}()
+	Run(ctx, m, append(observers, reg)...)
+	return nil
+}
+
+// Lookup returns the Sink of the machine that's registered under a key.
+func (r *Registry) Lookup(key interface{}) (chan<- Event, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reg, ok := r.entries[key]; ok {
+		return reg.sink, true
+	}
+	return nil, false
+}
+
+// Keys returns the keys of all registrations, in no particular order.
+func (r *Registry) Keys() []interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]interface{}, 0, len(r.entries))
+	for k := range r.entries {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Send sends an event to the machine that's registered under a key, blocking
+// until the event is queued. Returns an error that wraps ErrNotRegistered if
+// no machine is registered under the key, or if its registration is removed
+// while Send blocks; returns ErrCancelled if the Context is done first.
+func (r *Registry) Send(ctx Context, key interface{}, e Event) error {
+	r.mu.Lock()
+	reg, ok := r.entries[key]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%v: %w", key, ErrNotRegistered)
+	}
+	select {
+	case reg.sink <- e:
+		return nil
+	case <-reg.removed:
+		return fmt.Errorf("%v: %w", key, ErrNotRegistered)
+	case <-ctx.Done():
+		return ErrCancelled
+	}
+}
+
+// Watch returns a chan that yields a RegistryEvent for every registration
+// that exists at the time of the call, followed by an event for every
+// subsequent registration and removal, until the Context is done, upon which
+// the chan is closed. Events are queued (without bound) for watchers that fall
+// behind.
+func (r *Registry) Watch(ctx Context) <-chan RegistryEvent {
+	w := &watcher{signal: make(chan struct{}, 1)}
+	r.mu.Lock()
+	if r.watchers == nil {
+		r.watchers = map[*watcher]struct{}{}
+	}
+	r.watchers[w] = struct{}{}
+	for k, reg := range r.entries {
+		w.push(RegistryEvent{Key: k, Sink: reg.sink, Registered: true})
+	}
+	r.mu.Unlock()
+
+	out := make(chan RegistryEvent)
+	go func() {
+		defer close(out)
+		defer func() {
+			r.mu.Lock()
+			delete(r.watchers, w)
+			r.mu.Unlock()
+		}()
+		for {
+			e, ok := w.pop()
+			if !ok {
+				select {
+				case <-w.signal:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// notify queues an event for every watcher; the registry must be locked.
+func (r *Registry) notify(e RegistryEvent) {
+	for w := range r.watchers {
+		w.push(e)
+	}
+}
+
+func (w *watcher) push(e RegistryEvent) {
+	w.mu.Lock()
+	w.queue = append(w.queue, e)
+	w.mu.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) pop() (RegistryEvent, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.queue) == 0 {
+		return RegistryEvent{}, false
+	}
+	e := w.queue[0]
+	w.queue = w.queue[1:]
+	return e, true
+}
+
+// Key returns the key of the registration.
+func (reg *Registration) Key() interface{} { return reg.key }
+
+// Unregister removes the registration; it may be invoked multiple times.
+func (reg *Registration) Unregister() {
+	reg.once.Do(func() {
+		r := reg.registry
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.entries, reg.key)
+		close(reg.removed)
+		r.notify(RegistryEvent{Key: reg.key})
+	})
+}
+
+// Observe removes the registration once the machine terminates.
+func (reg *Registration) Observe(_ Fn, _ Event, to Fn) {
+	if to == nil {
+		reg.Unregister()
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+func ExampleRegistry() {
+	var (
+		r   state.Registry
+		ctx = make(state.SimpleContext)
+	)
+	defer ctx.Cancel()
+	watch := r.Watch(ctx)
+
+	greeter := state.NewSimpleMachine(0, func(ctx state.Context, m state.Machine) state.Fn {
+		select {
+		case e := <-m.Source():
+			fmt.Println("hello,", e.(*state.NamedEvent).Data)
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	done := make(chan error)
+	go func() { done <- r.Run(ctx, "greeter", greeter) }()
+
+	e := <-watch
+	fmt.Println(e.Key, "registered:", e.Registered)
+	err := r.Send(ctx, "greeter", &state.NamedEvent{Name: "Greet", Data: "world"})
+	<-done
+	fmt.Println(err)
+	e = <-watch
+	fmt.Println(e.Key, "registered:", e.Registered)
+	fmt.Println(r.Send(ctx, "greeter", &state.NamedEvent{Name: "Greet"}))
+	// Output:
+	// greeter registered: true
+	// hello, world
+	// <nil>
+	// greeter registered: false
+	// greeter: no machine registered
+}
+
+func TestRegistry_Register(t *testing.T) {
+	var r state.Registry
+	m := state.NewSimpleMachine(1, nil)
+	reg, err := r.Register("m", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Register("m", m); !errors.Is(err, state.ErrAlreadyRegistered) {
+		t.Fatalf("expected ErrAlreadyRegistered, got %v", err)
+	}
+	if sink, ok := r.Lookup("m"); !ok || sink != m.Sink() {
+		t.Fatalf("expected the sink of m, got %v, %v", sink, ok)
+	}
+
+	// a watcher learns of existing registrations first
+	ctx := make(state.SimpleContext)
+	defer ctx.Cancel()
+	watch := r.Watch(ctx)
+	if e := <-watch; e.Key != "m" || !e.Registered {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// a blocked Send fails once the registration is removed
+	if err := r.Send(ctx, "m", &state.NamedEvent{Name: "fill"}); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error)
+	go func() { sent <- r.Send(ctx, "m", &state.NamedEvent{Name: "blocked"}) }()
+	reg.Observe(nil, nil, nil) // the machine terminated
+	if err := <-sent; !errors.Is(err, state.ErrNotRegistered) {
+		t.Fatalf("expected ErrNotRegistered, got %v", err)
+	}
+	if e := <-watch; e.Key != "m" || e.Registered || e.Sink != nil {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if keys := r.Keys(); len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	reg.Unregister() // again
+}
+
+func TestRegistry_Run(t *testing.T) {
+	var r state.Registry
+	ctx := make(state.SimpleContext)
+	watch := r.Watch(ctx)
+
+	// a machine without an initial state terminates immediately
+	m := state.NewSimpleMachine(0, nil)
+	reg, err := r.Register("m", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Run(ctx, m, reg)
+	if keys := r.Keys(); len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	for _, registered := range []bool{true, false} {
+		if e := <-watch; e.Key != "m" || e.Registered != registered {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+
+	// the watch chan is closed once the Context is done
+	ctx.Cancel()
+	if e, ok := <-watch; ok {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// requests that are left queued by the machine are discarded
+	var (
+		asks = make(state.SimpleContext)
+		stop = make(state.SimpleContext)
+		idle = state.NewSimpleMachine(1, func(ctx state.Context, m state.Machine) state.Fn {
+			<-ctx.Done()
+			return nil
+		})
+		done = make(chan error)
+	)
+	defer asks.Cancel()
+	go func() {
+		_, err := state.Ask[bool](asks, idle, &lookupRequest{}, time.Second)
+		done <- err
+	}()
+	for len(idle.Source()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	stop.Cancel()
+	if err := r.Run(stop, "idle", idle); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, state.ErrDropped) {
+		t.Fatalf("expected ErrDropped, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scxml_test
+
+import (
+	"fmt"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/scxml"
+)
+
+func ExampleParse() {
+	doc := `
+<scxml xmlns="http://www.w3.org/2005/07/scxml" xmlns:go="https://github.com/jdef/state/scxml"
+       name="agent" initial="disconnected" version="1.0" datamodel="null">
+  <state id="disconnected">
+    <onentry><go:action name="report"/></onentry>
+    <transition event="ConnectRequest" target="connected"/>
+  </state>
+  <state id="connected">
+    <onentry><go:action name="report"/></onentry>
+    <transition event="Heartbeat" cond="healthy"/>
+    <transition event="Heartbeat DisconnectRequest" target="disconnected"/>
+    <transition event="Shutdown" target="terminated"/>
+  </state>
+  <final id="terminated"/>
+</scxml>`
+	healthy := true
+	c, err := scxml.Parse([]byte(doc), scxml.Bindings{
+		Actions: map[string]state.Action{
+			"report": func(_ state.Context, m *state.ChartMachine, _ state.Event) { fmt.Println(m.Configuration()) },
+		},
+		Guards: map[string]state.Guard{
+			"healthy": func(state.Event, interface{}) bool { return healthy },
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	m, err := c.Machine(10)
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range []state.Event{
+		&state.NamedEvent{Name: "ConnectRequest"},
+		&state.NamedEvent{Name: "Heartbeat"}, // healthy: handled by connected
+		&state.NamedEvent{Name: "DisconnectRequest"},
+		&state.NamedEvent{Name: "ConnectRequest"},
+		&state.NamedEvent{Name: "Shutdown"},
+	} {
+		m.Sink() <- e
+	}
+	state.Run(make(state.SimpleContext), m)
+	// Output:
+	// [disconnected]
+	// [connected]
+	// [disconnected]
+	// [connected]
+}
@@ -0,0 +1,497 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scxml loads W3C SCXML documents (https://www.w3.org/TR/scxml/) as
+// statecharts, see state.Chart. The supported subset of SCXML is:
+//
+//   - <scxml>, <state>, <parallel>, <final>, <history> and <initial>;
+//   - <transition> with event descriptors, a single target, type="internal"
+//     and conditions (see below);
+//   - <onentry>, <onexit> and executable content: <raise>, <send> (to the
+//     external queue of the machine or to "#_internal", with an optional
+//     delay), <log>, <if>/<elseif>/<else> and the custom <action> element.
+//
+// Only the null datamodel is supported. A condition is either the name of a
+// guard, which is bound to a Go func (see Bindings), or the In('id')
+// predicate. Go actions are invoked by the custom <action name="..."/>
+// element in the Namespace of this package. Anything else (datamodels,
+// <script>, <assign>, <invoke>, <donedata>, executable content of <initial>
+// and <history> transitions, multiple targets, etc.) is rejected with an error
+// that names the offending element.
+//
+// Transitions with multiple targets, like target="a1 b1" that enters distinct
+// regions of a <parallel> at once, are not supported because a
+// state.ChartTransition has a single target. Target the <parallel> (or the
+// state in one of its regions) instead, and let the <initial> of the other
+// regions determine the states that are entered.
+package scxml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+const (
+	// SCXMLNamespace is the namespace of SCXML elements.
+	SCXMLNamespace = "http://www.w3.org/2005/07/scxml"
+	// Namespace is the namespace of the custom elements of this package:
+	// <action name="..."/> invokes the Go action bound to the name.
+	Namespace = "https://github.com/jdef/state/scxml"
+)
+
+// Bindings bind the names that are used by a document to Go funcs.
+type Bindings struct {
+	Actions map[string]state.Action
+	Guards  map[string]state.Guard
+	// Log is invoked by <log> elements; defaults to log.Printf.
+	Log func(label, expr string)
+}
+
+// node is a generic XML element.
+type node struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []node     `xml:",any"`
+}
+
+func (n *node) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *node) is(local string) bool {
+	return n.XMLName.Local == local && (n.XMLName.Space == SCXMLNamespace || n.XMLName.Space == "")
+}
+
+func (n *node) String() string {
+	if id := n.attr("id"); id != "" {
+		return fmt.Sprintf("<%s id=%q>", n.XMLName.Local, id)
+	}
+	return "<" + n.XMLName.Local + ">"
+}
+
+// Load reads and parses the SCXML document at path.
+func Load(path string, b Bindings) (*state.Chart, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, b)
+}
+
+// Parse parses an SCXML document and returns the (validated) chart that it
+// describes.
+func Parse(data []byte, b Bindings) (*state.Chart, error) {
+	var doc node
+	if err := xml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if !doc.is("scxml") {
+		return nil, fmt.Errorf("expected <scxml> document, found %v", &doc)
+	}
+	if dm := doc.attr("datamodel"); dm != "" && dm != "null" {
+		return nil, fmt.Errorf("unsupported datamodel %q", dm)
+	}
+	name := doc.attr("name")
+	if name == "" {
+		name = "scxml"
+	}
+	if b.Log == nil {
+		b.Log = func(label, expr string) { log.Printf("%s: %s", label, expr) }
+	}
+	l := &loader{c: state.NewChart(name), b: b}
+	if err := l.children(nil, &doc); err != nil {
+		return nil, err
+	}
+	if initial := doc.attr("initial"); initial != "" {
+		if strings.ContainsAny(strings.TrimSpace(initial), " \t\n") {
+			return nil, fmt.Errorf("<scxml>: multiple initial states are not supported")
+		}
+		l.c.Initial(initial)
+	}
+	if err := l.c.Validate(); err != nil {
+		return nil, err
+	}
+	return l.c, nil
+}
+
+type loader struct {
+	c       *state.Chart
+	b       Bindings
+	anon    int // generated state ids
+	actions int // generated action names
+}
+
+// children adds the child states of an <scxml>, <state> or <parallel> element
+// to the parent state (nil for the top-level).
+func (l *loader) children(parent *state.ChartState, n *node) error {
+	for i := range n.Children {
+		child := &n.Children[i]
+		var err error
+		switch {
+		case child.is("state"), child.is("parallel"), child.is("final"):
+			err = l.state(parent, child)
+		case child.is("history") && parent != nil:
+			err = l.history(parent, child)
+		case child.is("initial") && parent != nil:
+			err = l.initial(parent, child)
+		case child.is("transition") && parent != nil:
+			err = l.transition(parent, child)
+		case child.is("onentry") && parent != nil:
+			err = l.handler(child, parent.OnEntry)
+		case child.is("onexit") && parent != nil:
+			err = l.handler(child, parent.OnExit)
+		default:
+			err = fmt.Errorf("unsupported element %v", child)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", n, err)
+		}
+	}
+	return nil
+}
+
+func (l *loader) id(n *node) string {
+	if id := n.attr("id"); id != "" {
+		return id
+	}
+	l.anon++
+	return fmt.Sprintf("_state%d", l.anon)
+}
+
+func (l *loader) state(parent *state.ChartState, n *node) error {
+	var s *state.ChartState
+	if parent == nil {
+		s = l.c.State(l.id(n))
+	} else {
+		s = parent.State(l.id(n))
+	}
+	switch {
+	case n.is("parallel"):
+		s.Parallel()
+	case n.is("final"):
+		s.Final()
+		for _, child := range n.Children {
+			if child.is("donedata") {
+				return fmt.Errorf("%v: <donedata> is not supported", n)
+			}
+		}
+	}
+	if initial := n.attr("initial"); initial != "" {
+		if strings.ContainsAny(strings.TrimSpace(initial), " \t\n") {
+			return fmt.Errorf("%v: multiple initial states are not supported", n)
+		}
+		s.Initial(initial)
+	}
+	return l.children(s, n)
+}
+
+// target returns the single target of a <transition>, and rejects executable
+// content unless it's allowed.
+func (l *loader) target(n *node, content bool) (string, error) {
+	target := strings.TrimSpace(n.attr("target"))
+	if strings.ContainsAny(target, " \t\n") {
+		return "", fmt.Errorf("<%s target=%q>: multiple targets are not supported", n.XMLName.Local, target)
+	}
+	if !content && len(n.Children) > 0 {
+		return "", fmt.Errorf("%v: executable content is not supported here", n)
+	}
+	return target, nil
+}
+
+func (l *loader) initial(parent *state.ChartState, n *node) error {
+	if len(n.Children) != 1 || !n.Children[0].is("transition") {
+		return fmt.Errorf("%v: expected a single <transition>", n)
+	}
+	target, err := l.target(&n.Children[0], false)
+	if err != nil {
+		return err
+	}
+	parent.Initial(target)
+	return nil
+}
+
+func (l *loader) history(parent *state.ChartState, n *node) error {
+	h := parent.History(l.id(n), n.attr("type") == "deep")
+	for i := range n.Children {
+		t := &n.Children[i]
+		if !t.is("transition") {
+			return fmt.Errorf("%v: unsupported element %v", n, t)
+		}
+		target, err := l.target(t, false)
+		if err != nil {
+			return err
+		}
+		h.Initial(target)
+	}
+	return nil
+}
+
+func (l *loader) transition(s *state.ChartState, n *node) error {
+	target, err := l.target(n, true)
+	if err != nil {
+		return err
+	}
+	t := state.ChartTransition{
+		Event:  n.attr("event"),
+		Target: target,
+		Local:  n.attr("type") == "internal",
+	}
+	if cond := n.attr("cond"); cond != "" {
+		guard, in, err := l.condition(cond)
+		if err != nil {
+			return fmt.Errorf("%v: %v", n, err)
+		}
+		t.Guard, t.In = guard, in
+	}
+	if len(n.Children) > 0 {
+		name, err := l.action(n.Children)
+		if err != nil {
+			return fmt.Errorf("%v: %v", n, err)
+		}
+		t.Actions = []string{name}
+	}
+	s.Transition(t)
+	return nil
+}
+
+// handler registers the executable content of an <onentry> or <onexit>
+// element as an action.
+func (l *loader) handler(n *node, add func(...string) *state.ChartState) error {
+	name, err := l.action(n.Children)
+	if err != nil {
+		return fmt.Errorf("%v: %v", n, err)
+	}
+	add(name)
+	return nil
+}
+
+var inPredicate = regexp.MustCompile(`^In\(\s*(?:'([^']*)'|"([^"]*)")\s*\)$`)
+
+// condition interprets the cond attribute of a <transition>, <if> or <elseif>:
+// returns the name of a guard, or that of a state for the In() predicate.
+func (l *loader) condition(cond string) (guard, in string, err error) {
+	cond = strings.TrimSpace(cond)
+	if m := inPredicate.FindStringSubmatch(cond); m != nil {
+		return "", m[1] + m[2], nil
+	}
+	g := l.b.Guards[cond]
+	if g == nil {
+		return "", "", fmt.Errorf("unbound guard %q", cond)
+	}
+	l.c.Guard(cond, g)
+	return cond, "", nil
+}
+
+// step is a compiled unit of executable content.
+type step func(ctx state.Context, m *state.ChartMachine, e state.Event)
+
+// action compiles executable content and registers it as a (generated) action
+// of the chart; returns the name of the action.
+func (l *loader) action(content []node) (string, error) {
+	steps, err := l.compile(content)
+	if err != nil {
+		return "", err
+	}
+	l.actions++
+	name := fmt.Sprintf("scxml.%d", l.actions)
+	l.c.Action(name, func(ctx state.Context, m *state.ChartMachine, e state.Event) {
+		for _, s := range steps {
+			s(ctx, m, e)
+		}
+	})
+	return name, nil
+}
+
+func (l *loader) compile(content []node) (steps []step, err error) {
+	for i := range content {
+		n := &content[i]
+		var s step
+		switch {
+		case n.XMLName.Space == Namespace && n.XMLName.Local == "action":
+			s, err = l.custom(n)
+		case n.is("raise"):
+			s, err = raise(n)
+		case n.is("send"):
+			s, err = send(n)
+		case n.is("log"):
+			label, expr, logf := n.attr("label"), n.attr("expr"), l.b.Log
+			s = func(state.Context, *state.ChartMachine, state.Event) { logf(label, expr) }
+		case n.is("if"):
+			s, err = l.ifElse(n)
+		default:
+			err = fmt.Errorf("unsupported executable content %v", n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, s)
+	}
+	return
+}
+
+func (l *loader) custom(n *node) (step, error) {
+	name := n.attr("name")
+	a := l.b.Actions[name]
+	if a == nil {
+		return nil, fmt.Errorf("unbound action %q", name)
+	}
+	return step(a), nil
+}
+
+func raise(n *node) (step, error) {
+	event := n.attr("event")
+	if event == "" {
+		return nil, fmt.Errorf("%v: missing event", n)
+	}
+	return func(_ state.Context, m *state.ChartMachine, _ state.Event) {
+		m.Raise(&state.NamedEvent{Name: event})
+	}, nil
+}
+
+// send compiles a <send> element: the event is raised if the target is
+// "#_internal", otherwise it's delivered to the Sink of the machine, after the
+// delay (if any). Undelivered events are dropped once the Context is done.
+func send(n *node) (step, error) {
+	for _, a := range n.Attrs {
+		switch a.Name.Local {
+		case "event", "target", "delay", "id":
+		default:
+			return nil, fmt.Errorf("%v: unsupported attribute %q", n, a.Name.Local)
+		}
+	}
+	if len(n.Children) > 0 {
+		return nil, fmt.Errorf("%v: content is not supported", n)
+	}
+	event := n.attr("event")
+	if event == "" {
+		return nil, fmt.Errorf("%v: missing event", n)
+	}
+	var delay time.Duration
+	if d := n.attr("delay"); d != "" {
+		var err error
+		if delay, err = time.ParseDuration(d); err != nil {
+			return nil, fmt.Errorf("%v: invalid delay: %v", n, err)
+		}
+	}
+	switch n.attr("target") {
+	case "#_internal":
+		if delay > 0 {
+			return nil, fmt.Errorf("%v: delayed internal events are not supported", n)
+		}
+		return func(_ state.Context, m *state.ChartMachine, _ state.Event) {
+			m.Raise(&state.NamedEvent{Name: event})
+		}, nil
+	case "":
+		return func(ctx state.Context, m *state.ChartMachine, _ state.Event) {
+			go func() {
+				if delay > 0 {
+					t := time.NewTimer(delay)
+					defer t.Stop()
+					select {
+					case <-t.C:
+					case <-ctx.Done():
+						return
+					}
+				}
+				select {
+				case m.Sink() <- &state.NamedEvent{Name: event}:
+				case <-ctx.Done():
+				}
+			}()
+		}, nil
+	default:
+		return nil, fmt.Errorf("%v: unsupported target %q", n, n.attr("target"))
+	}
+}
+
+// ifElse compiles an <if> element, whose children are partitioned into
+// branches by <elseif> and <else> elements.
+func (l *loader) ifElse(n *node) (step, error) {
+	type branch struct {
+		cond  func(m *state.ChartMachine, e state.Event) bool
+		steps []step
+	}
+	var (
+		branches []*branch
+		content  []node
+		cond     = n.attr("cond")
+	)
+	flush := func() error {
+		b := &branch{}
+		if cond != "" {
+			guard, in, err := l.condition(cond)
+			if err != nil {
+				return fmt.Errorf("%v: %v", n, err)
+			}
+			if in != "" {
+				b.cond = func(m *state.ChartMachine, _ state.Event) bool { return m.In(in) }
+			} else {
+				g := l.b.Guards[guard]
+				b.cond = func(m *state.ChartMachine, e state.Event) bool { return g(e, m.Data()) }
+			}
+		}
+		steps, err := l.compile(content)
+		if err != nil {
+			return err
+		}
+		b.steps = steps
+		branches = append(branches, b)
+		return nil
+	}
+	if cond == "" {
+		return nil, fmt.Errorf("%v: missing cond", n)
+	}
+	for _, child := range n.Children {
+		switch {
+		case child.is("elseif"), child.is("else"):
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			content, cond = nil, child.attr("cond")
+			if child.is("elseif") && cond == "" {
+				return nil, fmt.Errorf("%v: missing cond", &child)
+			}
+		default:
+			content = append(content, child)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return func(ctx state.Context, m *state.ChartMachine, e state.Event) {
+		for _, b := range branches {
+			if b.cond == nil || b.cond(m, e) {
+				for _, s := range b.steps {
+					s(ctx, m, e)
+				}
+				return
+			}
+		}
+	}, nil
+}
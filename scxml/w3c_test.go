@@ -0,0 +1,103 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scxml_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/scxml"
+)
+
+// TestW3C runs the documents in testdata/w3c, local adaptations of the subset
+// of the W3C SCXML conformance tests that's relevant to this package (see the
+// comments at the top of each document). A test passes once the machine
+// terminates in the top-level final state "pass".
+func TestW3C(t *testing.T) {
+	files, err := filepath.Glob("testdata/w3c/*.scxml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings := scxml.Bindings{
+		Guards: map[string]state.Guard{
+			"true":  func(state.Event, interface{}) bool { return true },
+			"false": func(state.Event, interface{}) bool { return false },
+		},
+	}
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			c, err := scxml.Load(file, bindings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var outcome string
+			for _, name := range []string{"pass", "fail"} {
+				name := name
+				c.Action("outcome."+name, func(state.Context, *state.ChartMachine, state.Event) { outcome = name })
+				c.Lookup(name).OnEntry("outcome." + name)
+			}
+			m, err := c.Machine(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				ctx  = make(state.SimpleContext)
+				done = make(chan struct{})
+			)
+			go func() {
+				defer close(done)
+				state.Run(ctx, m)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				ctx.Cancel()
+				<-done
+				t.Fatalf("timed out in configuration %v", m.Configuration())
+			}
+			if outcome != "pass" {
+				t.Fatalf("expected to terminate in pass, not %q", outcome)
+			}
+		})
+	}
+}
+
+func TestParse_unsupported(t *testing.T) {
+	for _, doc := range []string{
+		`<scxml xmlns="http://www.w3.org/2005/07/scxml" datamodel="ecmascript"><state id="a"/></scxml>`,
+		`<scxml xmlns="http://www.w3.org/2005/07/scxml"><state id="a"><transition target="a b"/></state><state id="b"/></scxml>`,
+		`<scxml xmlns="http://www.w3.org/2005/07/scxml"><state id="a"><onentry><assign location="x" expr="1"/></onentry></state></scxml>`,
+		`<scxml xmlns="http://www.w3.org/2005/07/scxml"><state id="a"><transition cond="x &gt; 1" target="a"/></state></scxml>`,
+		`<scxml xmlns="http://www.w3.org/2005/07/scxml"><state id="a"><invoke src="b.scxml"/></state></scxml>`,
+	} {
+		if _, err := scxml.Parse([]byte(doc), scxml.Bindings{}); err == nil {
+			t.Errorf("expected an error for %s", doc)
+		}
+	}
+}
+
+func TestParse_multipleTargets(t *testing.T) {
+	const doc = `<scxml xmlns="http://www.w3.org/2005/07/scxml"><state id="a"><transition event="go" target="a b"/></state><state id="b"/></scxml>`
+	_, err := scxml.Parse([]byte(doc), scxml.Bindings{})
+	if err == nil || !strings.Contains(err.Error(), `<transition target="a b">`) {
+		t.Fatalf("expected an error naming the transition, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spec_test
+
+import (
+	"fmt"
+
+	"github.com/jdef/state/spec"
+)
+
+const agentSpec = `
+package: agent
+type: Agent
+initial: Disconnected
+cancel: Terminating
+states:
+  - name: Disconnected
+  - name: Connected
+  - name: Terminating
+    final: true
+events: [ConnectRequest, DisconnectRequest, Heartbeat]
+transitions:
+  - {from: Disconnected, event: ConnectRequest, to: Connected}
+  - {from: Disconnected, event: Heartbeat}
+  - {from: Connected, event: DisconnectRequest, to: Disconnected}
+  - {from: Connected, event: Heartbeat}
+`
+
+func ExampleParse() {
+	s, err := spec.Parse([]byte(agentSpec))
+	if err != nil {
+		panic(err)
+	}
+	for _, st := range s.States {
+		fmt.Print(spec.FuncName(st.Name), ":")
+		for _, t := range s.TransitionsFrom(st.Name) {
+			fmt.Print(" ", t.Event, "->", t.To)
+		}
+		fmt.Println()
+	}
+	// Output:
+	// disconnected: ConnectRequest->Connected Heartbeat->
+	// connected: DisconnectRequest->Disconnected Heartbeat->
+	// terminating:
+}
+
+func ExampleParse_invalid() {
+	_, err := spec.Parse([]byte(`{"type": "Agent", "initial": "Idle", "states": [{"name": "Running"}]}`))
+	fmt.Println(err)
+	// Output:
+	// initial state "Idle" is not declared
+}
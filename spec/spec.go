@@ -0,0 +1,196 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package spec describes state machines declaratively: the states, events and
+// transitions of a machine, as read from a small YAML (or JSON) document.
+package spec
+
+import (
+	"fmt"
+	"go/token"
+	"os"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// Spec is a declarative description of a state machine.
+	Spec struct {
+		// Package is the name of the Go package that implements the machine.
+		Package string `yaml:"package,omitempty" json:"package,omitempty"`
+		// Interface is the name of the public state machine interface type,
+		// defaults to "Interface".
+		Interface string `yaml:"interface,omitempty" json:"interface,omitempty"`
+		// Type is the name of the concrete state machine type.
+		Type string `yaml:"type" json:"type"`
+		// Initial is the name of the initial state.
+		Initial string `yaml:"initial" json:"initial"`
+		// Cancel is the name of the state that's transitioned to when the
+		// Context signals completion. If empty then state funcs simply return
+		// nil upon cancellation.
+		Cancel      string       `yaml:"cancel,omitempty" json:"cancel,omitempty"`
+		States      []State      `yaml:"states" json:"states"`
+		Events      []string     `yaml:"events,omitempty" json:"events,omitempty"`
+		Transitions []Transition `yaml:"transitions,omitempty" json:"transitions,omitempty"`
+	}
+
+	State struct {
+		Name string `yaml:"name" json:"name"`
+		// Final states return a nil state Fn: they terminate the machine.
+		Final bool `yaml:"final,omitempty" json:"final,omitempty"`
+	}
+
+	// Transition describes the reaction of state From to an event. An empty
+	// To indicates that the event is handled without changing state.
+	Transition struct {
+		From  string `yaml:"from" json:"from"`
+		Event string `yaml:"event" json:"event"`
+		To    string `yaml:"to,omitempty" json:"to,omitempty"`
+	}
+)
+
+// Parse decodes and validates a spec. JSON is a subset of YAML, so either
+// format is accepted.
+func Parse(data []byte) (*Spec, error) {
+	s := &Spec{}
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, err
+	}
+	if s.Interface == "" {
+		s.Interface = "Interface"
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads and parses the spec file at the given path.
+func Load(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Validate checks that all names are valid Go identifiers and that the
+// initial state, cancel state and all transitions reference declared states
+// and events.
+func (s *Spec) Validate() error {
+	if !isIdentifier(s.Interface) {
+		return fmt.Errorf("invalid interface name %q", s.Interface)
+	}
+	if !isIdentifier(s.Type) {
+		return fmt.Errorf("invalid type name %q", s.Type)
+	}
+	states := map[string]bool{}
+	for _, st := range s.States {
+		if !isExported(st.Name) {
+			return fmt.Errorf("invalid state name %q: must be an exported identifier", st.Name)
+		}
+		if states[st.Name] {
+			return fmt.Errorf("duplicate state %q", st.Name)
+		}
+		states[st.Name] = true
+	}
+	events := map[string]bool{}
+	for _, e := range s.Events {
+		if !isExported(e) {
+			return fmt.Errorf("invalid event name %q: must be an exported identifier", e)
+		}
+		if events[e] || states[e] {
+			return fmt.Errorf("duplicate event %q", e)
+		}
+		events[e] = true
+	}
+	if !states[s.Initial] {
+		return fmt.Errorf("initial state %q is not declared", s.Initial)
+	}
+	if s.Cancel != "" && !states[s.Cancel] {
+		return fmt.Errorf("cancel state %q is not declared", s.Cancel)
+	}
+	handled := map[Transition]bool{}
+	for _, t := range s.Transitions {
+		if k := (Transition{From: t.From, Event: t.Event}); handled[k] {
+			return fmt.Errorf("duplicate transition from %q upon event %q", t.From, t.Event)
+		} else {
+			handled[k] = true
+		}
+		if !states[t.From] {
+			return fmt.Errorf("transition from undeclared state %q", t.From)
+		}
+		if !events[t.Event] {
+			return fmt.Errorf("transition from %q upon undeclared event %q", t.From, t.Event)
+		}
+		if t.To != "" && !states[t.To] {
+			return fmt.Errorf("transition from %q to undeclared state %q", t.From, t.To)
+		}
+	}
+	return nil
+}
+
+// State returns the named state, or nil if there's no such state.
+func (s *Spec) State(name string) *State {
+	for i := range s.States {
+		if s.States[i].Name == name {
+			return &s.States[i]
+		}
+	}
+	return nil
+}
+
+// TransitionsFrom returns the transitions declared for the named state, in
+// declaration order.
+func (s *Spec) TransitionsFrom(name string) (result []Transition) {
+	for _, t := range s.Transitions {
+		if t.From == name {
+			result = append(result, t)
+		}
+	}
+	return
+}
+
+// FuncName returns the name of the (unexported) state func that implements the
+// named state, for example "Disconnected" is implemented by "disconnected".
+// A leading initialism is lowered as a whole: "TCPConnected" yields "tcpConnected".
+func FuncName(state string) string {
+	r := []rune(state)
+	for i := 0; i < len(r) && unicode.IsUpper(r[i]); i++ {
+		if i > 0 && i+1 < len(r) && unicode.IsLower(r[i+1]) {
+			break
+		}
+		r[i] = unicode.ToLower(r[i])
+	}
+	name := string(r)
+	if token.Lookup(name).IsKeyword() {
+		name += "State"
+	}
+	return name
+}
+
+func isIdentifier(s string) bool {
+	return token.IsIdentifier(s)
+}
+
+func isExported(s string) bool {
+	return isIdentifier(s) && token.IsExported(s)
+}
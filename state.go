@@ -16,6 +16,10 @@ limitations under the License.
 
 package state
 
+import (
+	"sync"
+)
+
 type (
 	// Context provides runtime context to state machines.
 	Context interface {
@@ -37,6 +41,14 @@ type (
 	// Event implementations may embed AbstractEvent to reduce boilerplate code.
 	AbstractEvent struct{}
 
+	// NamedEvent is an event that's identified by name rather than by type,
+	// see EventName. Data is an optional payload.
+	NamedEvent struct {
+		AbstractEvent
+		Name string
+		Data interface{}
+	}
+
 	EventSource interface {
 		Source() <-chan Event
 	}
@@ -53,6 +65,7 @@ type (
 	// SimpleEvents provides a basic implementation of the Events interface
 	SimpleEvents struct {
 		events chan Event
+		tracer *tracer // nil unless TraceEvents was invoked beforehand
 	}
 
 	Machine interface {
@@ -69,7 +82,9 @@ type (
 
 	// Fn is a state func that implements behavior for a particular state. Upon
 	// state transition the next state is returned. Nil is returned to indicate
-	// that there is no next state and that the state machine should die.
+	// that there is no next state and that the state machine should die. When
+	// invoked by Run, the Context is scoped to the state: it's cancelled once
+	// the state func returns.
 	Fn func(Context, Machine) Fn
 
 	// Transition is implemened by state machines that support "out-of-band" requests
@@ -78,11 +93,19 @@ type (
 		NextState() <-chan Fn
 	}
 
+	// Hijackable is implemented by state machines that accept "out-of-band"
+	// state transitions: the desired next state is sent to the chan returned
+	// by Hijack, and received by the current state func via Next, which may
+	// decide upon it, see Accept.
+	Hijackable interface {
+		Hijack() chan<- Fn
+	}
+
 	// SuperMachine is implemented by state machines that support being extended
 	// by sub-state machines. A sub-state machine triggers a state transition
 	// by sending desired next state to the chan returned by Hijack.
 	SuperMachine interface {
-		Hijack() chan<- Fn
+		Hijackable
 		// SubMachine returns a simple sub-state Machine with the given queue length
 		// and (optional) initial state. If nil is given for the initial state of the
 		// sub-state Machine then the actual initial state is derived from the
@@ -99,6 +122,8 @@ type (
 var (
 	// AbstractEvent implements Event
 	_ Event = &AbstractEvent{}
+	// NamedEvent implements Event
+	_ Event = &NamedEvent{}
 	// SimpleContext implements Context
 	_ Context = make(SimpleContext)
 	// SimpleEvents implements Events
@@ -109,11 +134,24 @@ var (
 
 func (_ *AbstractEvent) Event() struct{} { return struct{}{} }
 
+func (e *NamedEvent) EventName() string { return e.Name }
+
 func (c SimpleContext) Done() <-chan struct{} { return c }
 
-func NewSimpleEvents(queueLength int) Events  { return &SimpleEvents{make(chan Event, queueLength)} }
-func (se *SimpleEvents) Source() <-chan Event { return se.events }
-func (se *SimpleEvents) Sink() chan<- Event   { return se.events }
+func NewSimpleEvents(queueLength int) Events {
+	events := make(chan Event, queueLength)
+	se := &SimpleEvents{events: events}
+	se.tracer = newTracer(se, events)
+	return se
+}
+
+func (se *SimpleEvents) Source() <-chan Event {
+	if se.tracer != nil {
+		return se.tracer.source()
+	}
+	return se.events
+}
+func (se *SimpleEvents) Sink() chan<- Event { return se.events }
 
 func NewSimpleMachine(queueLength int, initialState Fn) Machine {
 	return &SimpleMachine{
@@ -135,13 +173,105 @@ func (c SimpleContext) Cancel() {
 	}
 }
 
+// CancelFunc cancels a Context derived via WithCancel; it may be invoked
+// multiple times, and concurrently.
+type CancelFunc func()
+
+// cancelContext is a child Context that embeds its parent and overrides Done.
+type cancelContext struct {
+	Context
+	done SimpleContext
+}
+
+func (c *cancelContext) Done() <-chan struct{} { return c.done }
+
+// Unwrap returns the parent Context.
+func (c *cancelContext) Unwrap() Context { return c.Context }
+
+// ContextAs returns the first Context of type T found by walking from ctx up
+// through the parents of Contexts derived via WithCancel (such as those given
+// to state funcs by Run), for example a custom Context that carries request
+// scoped values.
+func ContextAs[T any](ctx Context) (T, bool) {
+	for ctx != nil {
+		if t, ok := ctx.(T); ok {
+			return t, true
+		}
+		u, ok := ctx.(interface{ Unwrap() Context })
+		if !ok {
+			break
+		}
+		ctx = u.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// WithCancel returns a child Context that's done once the parent is done or
+// once the returned CancelFunc is invoked, whichever happens first. The child
+// keeps the parent, so a custom Context remains accessible, see ContextAs. Callers
+// should always eventually invoke the CancelFunc: until then a goroutine
+// watches the parent.
+func WithCancel(parent Context) (Context, CancelFunc) {
+	var (
+		child = &cancelContext{Context: parent, done: make(SimpleContext)}
+		once  sync.Once
+	)
+	cancel := func() { once.Do(child.done.Cancel) }
+	go func() {
+		select {
+		case <-parent.Done():
+			cancel()
+		case <-child.done:
+		}
+	}()
+	return child, cancel
+}
+
 // Run runs a state Machine, beginning with the InitialState() and transitioning
-// through states as returned by state funcs until reaching a nil state Fn.
-func Run(ctx Context, m Machine) {
+// through states as returned by state funcs until reaching a nil state Fn. The
+// given observers, as well as those registered via AddObserver, are notified
+// of every transition.
+//
+// Each state func is invoked with its own Context, derived from `ctx`, that's
+// cancelled as soon as the state func returns. Goroutines and futures (see
+// Upon, Delegate) that are tied to the Context of a state are therefore
+// cleaned up upon transition.
+func Run(ctx Context, m Machine, observers ...Observer) {
 	state := m.InitialState()
+	observers = append(observers, globalObservers()...)
+	if len(observers) == 0 {
+		for state != nil {
+			state = runState(ctx, m, state)
+		}
+		return
+	}
+	for _, o := range observers {
+		o.Observe(nil, nil, state)
+	}
+	tr := tracerOf(m).start()
+	defer tr.stop()
 	for state != nil {
-		state = state(ctx, m)
+		mark := tr.mark()
+		next := runState(ctx, m, state)
+		e := tr.since(mark)
+		for _, o := range observers {
+			o.Observe(state, e, next)
+		}
+		state = next
+	}
+}
+
+// runState invokes a state func with a Context that's scoped to the invocation.
+// A hijack that the state func returns without deciding upon it is decided
+// upon here (see Accept); the state func is re-entered if it's rejected.
+func runState(ctx Context, m Machine, state Fn) Fn {
+	ctx, cancel := WithCancel(ctx)
+	defer cancel()
+	if next, ok := Accept(state(ctx, m)); ok {
+		return next
 	}
+	return state
 }
 
 // Next is a convenience func that attempts to cast the given Machine to the
@@ -160,9 +290,11 @@ func (u upon) NextState() <-chan Fn { return u }
 
 // Upon is a convenience func that invokes state func Fn with the given Context
 // and Machine, the result of which is returned as a future in the form of a
-// Transition.
+// Transition. The result is buffered, so the goroutine that runs `f` doesn't
+// block if the future is never read; however `f` keeps running until it
+// returns of its own accord. See Delegate for futures that may be cancelled.
 func Upon(f Fn, c Context, m Machine) Transition {
-	fn := make(upon)
+	fn := make(upon, 1)
 	go func() {
 		fn <- f(c, m)
 	}()
@@ -177,17 +309,10 @@ func NoTransition() Transition {
 // TryHijack is a convenience func: attempt to hijack state transition from the
 // super-state machine `super` to state `target`. Returns the state that the machine
 // should transition to when successful. If false is returned then the Context
-// has indicated completion prior to the state transition taking place. It's expected
-// that the `next` Transition is driven by the super-state machine, perhaps via Upon.
+// has indicated completion prior to the state transition taking place, or the
+// hijack failed for another reason, see Hijack. It's expected that the `next`
+// Transition is driven by the super-state machine, perhaps via Upon.
 func TryHijack(super SuperMachine, c Context, target Fn, next Transition) (Fn, bool) {
-	select {
-	case super.Hijack() <- target:
-		select {
-		case <-c.Done():
-		case f := <-next.NextState():
-			return f, true
-		}
-	case <-c.Done():
-	}
-	return nil, false
+	f, err := Hijack(c, super, target, next, 0)
+	return f, err == nil
 }
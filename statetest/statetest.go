@@ -0,0 +1,254 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package statetest provides helpers for driving state machines in tests and
+// asserting the sequence of states that they visit.
+package statetest
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+type (
+	// Recorder is a state.Observer that records the states visited by a
+	// machine. It may be passed to state.Run, or to funcs that eventually
+	// invoke Run, such as demo.RunWith.
+	Recorder struct {
+		mu         sync.Mutex
+		visited    []state.Fn
+		terminated bool
+		changed    chan struct{} // closed, and replaced, upon every transition
+	}
+
+	// Harness runs a machine for the duration of a test.
+	Harness struct {
+		*Recorder
+		t    testing.TB
+		m    state.Machine
+		ctx  state.SimpleContext
+		done chan struct{}
+	}
+)
+
+// Recorder implements state.Observer
+var _ state.Observer = &Recorder{}
+
+func NewRecorder() *Recorder {
+	return &Recorder{changed: make(chan struct{})}
+}
+
+func (r *Recorder) Observe(from state.Fn, _ state.Event, to state.Fn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if to == nil {
+		r.terminated = true
+	} else {
+		r.visited = append(r.visited, to)
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Visited returns the states visited so far, in order.
+func (r *Recorder) Visited() []state.Fn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]state.Fn(nil), r.visited...)
+}
+
+// Terminated returns true once the machine has reached the nil state.
+func (r *Recorder) Terminated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.terminated
+}
+
+// Current returns the state that the machine is in, or nil if the machine
+// hasn't started or has terminated.
+func (r *Recorder) Current() state.Fn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.terminated || len(r.visited) == 0 {
+		return nil
+	}
+	return r.visited[len(r.visited)-1]
+}
+
+// WaitUntil blocks until cond, evaluated against the states visited so far,
+// returns true; returns false if that doesn't happen within the timeout.
+func (r *Recorder) WaitUntil(cond func(visited []state.Fn, terminated bool) bool, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		ok, changed := cond(r.visited, r.terminated), r.changed
+		r.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// WaitFor blocks until the machine is in the given state; returns false if
+// that doesn't happen within the timeout.
+func (r *Recorder) WaitFor(f state.Fn, timeout time.Duration) bool {
+	name := state.FuncName(f)
+	return r.WaitUntil(func(visited []state.Fn, terminated bool) bool {
+		return !terminated && len(visited) > 0 && state.FuncName(visited[len(visited)-1]) == name
+	}, timeout)
+}
+
+// WaitTerminated blocks until the machine reaches the nil state; returns false
+// if that doesn't happen within the timeout.
+func (r *Recorder) WaitTerminated(timeout time.Duration) bool {
+	return r.WaitUntil(func(_ []state.Fn, terminated bool) bool { return terminated }, timeout)
+}
+
+// String returns the visited states as a sequence, e.g.
+// "agent.disconnected -> agent.connected".
+func (r *Recorder) String() string {
+	return strings.Join(Names(r.Visited()...), " -> ")
+}
+
+// Name returns the package-qualified name of a state func, e.g. "agent.connected".
+func Name(f state.Fn) string {
+	if f == nil {
+		return "nil"
+	}
+	return path.Base(state.FuncName(f))
+}
+
+// Names returns the names of the given state funcs, see Name.
+func Names(fns ...state.Fn) []string {
+	names := make([]string, len(fns))
+	for i, f := range fns {
+		names[i] = Name(f)
+	}
+	return names
+}
+
+// Diff compares the wanted and actual sequences of states; returns a
+// description of the differences, or "" if there are none.
+func Diff(want, got []state.Fn) string {
+	w, g := Names(want...), Names(got...)
+	i := 0
+	for i < len(w) && i < len(g) && w[i] == g[i] {
+		i++
+	}
+	if i == len(w) && i == len(g) {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "state sequences differ at step %d\n", i+1)
+	fmt.Fprintf(&b, "\twant: %s\n", strings.Join(mark(w, i), " -> "))
+	fmt.Fprintf(&b, "\t got: %s", strings.Join(mark(g, i), " -> "))
+	return b.String()
+}
+
+// mark highlights the i'th name, or appends a marker if the sequence ends early.
+func mark(names []string, i int) []string {
+	names = append([]string(nil), names...)
+	if i < len(names) {
+		names[i] = "[" + names[i] + "]"
+	} else {
+		names = append(names, "[<end>]")
+	}
+	return names
+}
+
+// Start runs a machine until the test completes, or until Stop is invoked.
+func Start(t testing.TB, m state.Machine) *Harness {
+	h := &Harness{
+		Recorder: NewRecorder(),
+		t:        t,
+		m:        m,
+		ctx:      make(state.SimpleContext),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(h.done)
+		state.Run(h.ctx, m, h.Recorder)
+	}()
+	t.Cleanup(h.Stop)
+	return h
+}
+
+// DefaultTimeout bounds the waits of a Harness.
+var DefaultTimeout = 5 * time.Second
+
+// Context returns the context that the machine runs with.
+func (h *Harness) Context() state.Context { return h.ctx }
+
+// Send delivers an event to the machine's Sink; fails the test if the event
+// isn't accepted within DefaultTimeout.
+func (h *Harness) Send(e state.Event) {
+	h.t.Helper()
+	select {
+	case h.m.Sink() <- e:
+	case <-time.After(DefaultTimeout):
+		h.t.Fatalf("timed out sending %T, machine is in state %s", e, Name(h.Current()))
+	}
+}
+
+// Expect waits for the machine to enter the given state; fails the test if
+// that doesn't happen within DefaultTimeout.
+func (h *Harness) Expect(f state.Fn) {
+	h.t.Helper()
+	if !h.WaitFor(f, DefaultTimeout) {
+		h.t.Fatalf("timed out waiting for state %s\n%s", Name(f), Diff(append(h.Visited(), f), h.Visited()))
+	}
+}
+
+// ExpectVisited waits for the machine to have visited exactly the given
+// sequence of states; fails the test with a diff if it doesn't within
+// DefaultTimeout.
+func (h *Harness) ExpectVisited(want ...state.Fn) {
+	h.t.Helper()
+	ok := h.WaitUntil(func(visited []state.Fn, _ bool) bool {
+		return len(visited) >= len(want)
+	}, DefaultTimeout)
+	if d := Diff(want, h.Visited()); !ok || d != "" {
+		if d == "" {
+			d = "timed out"
+		}
+		h.t.Fatal(d)
+	}
+}
+
+// Stop cancels the machine's context and waits for the machine to terminate;
+// fails the test if it doesn't within DefaultTimeout. Stop may be invoked
+// multiple times.
+func (h *Harness) Stop() {
+	h.t.Helper()
+	h.ctx.Cancel()
+	select {
+	case <-h.done:
+	case <-time.After(DefaultTimeout):
+		h.t.Fatalf("timed out waiting for termination, machine is in state %s", Name(h.Current()))
+	}
+}
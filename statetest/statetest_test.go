@@ -0,0 +1,207 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statetest_test
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/statetest"
+)
+
+// fakeTB records failures instead of failing the enclosing test. Like
+// testing.T, Fatal and Fatalf stop the calling goroutine.
+type fakeTB struct {
+	testing.TB
+	mu       sync.Mutex
+	failures []string
+	cleanups []func()
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Cleanup(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cleanups = append(f.cleanups, fn)
+}
+
+func (f *fakeTB) Fatal(args ...interface{}) {
+	f.fail(fmt.Sprint(args...))
+}
+
+func (f *fakeTB) Fatalf(format string, args ...interface{}) {
+	f.fail(fmt.Sprintf(format, args...))
+}
+
+func (f *fakeTB) fail(msg string) {
+	f.mu.Lock()
+	f.failures = append(f.failures, msg)
+	f.mu.Unlock()
+	runtime.Goexit()
+}
+
+// run invokes fn in its own goroutine, so that it may call Fatal, and returns
+// the failure that it reported, if any.
+func (f *fakeTB) run(fn func()) string {
+	f.mu.Lock()
+	n := len(f.failures)
+	f.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	<-done
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.failures) > n {
+		return f.failures[n]
+	}
+	return ""
+}
+
+func (f *fakeTB) cleanup() {
+	for i := len(f.cleanups) - 1; i >= 0; i-- {
+		f.run(f.cleanups[i])
+	}
+}
+
+func first(ctx state.Context, m state.Machine) state.Fn { return second }
+
+func second(ctx state.Context, m state.Machine) state.Fn {
+	select {
+	case <-m.Source():
+		return third
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func third(ctx state.Context, m state.Machine) state.Fn {
+	<-ctx.Done()
+	return nil
+}
+
+func TestDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		want, got []state.Fn
+		diff      string
+	}{
+		{"same", []state.Fn{first, second}, []state.Fn{first, second}, ""},
+		{"different", []state.Fn{first, second}, []state.Fn{first, third},
+			"state sequences differ at step 2\n" +
+				"\twant: statetest_test.first -> [statetest_test.second]\n" +
+				"\t got: statetest_test.first -> [statetest_test.third]"},
+		{"short", []state.Fn{first, second}, []state.Fn{first},
+			"state sequences differ at step 2\n" +
+				"\twant: statetest_test.first -> [statetest_test.second]\n" +
+				"\t got: statetest_test.first -> [<end>]"},
+		{"long", nil, []state.Fn{first},
+			"state sequences differ at step 1\n" +
+				"\twant: [<end>]\n" +
+				"\t got: [statetest_test.first]"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := statetest.Diff(tc.want, tc.got); d != tc.diff {
+				t.Fatalf("expected diff %q, got %q", tc.diff, d)
+			}
+		})
+	}
+}
+
+func TestRecorder_WaitUntil(t *testing.T) {
+	r := statetest.NewRecorder()
+	start := time.Now()
+	if r.WaitFor(second, 50*time.Millisecond) {
+		t.Fatal("expected WaitFor to time out")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("WaitFor returned after %v, before the timeout", d)
+	}
+
+	go func() {
+		r.Observe(nil, nil, first)
+		r.Observe(first, nil, second)
+	}()
+	if !r.WaitFor(second, time.Second) {
+		t.Fatalf("expected WaitFor to succeed, visited %s", r)
+	}
+	if r.WaitTerminated(10 * time.Millisecond) {
+		t.Fatal("expected WaitTerminated to time out")
+	}
+	r.Observe(second, nil, nil)
+	if !r.WaitTerminated(time.Second) {
+		t.Fatal("expected WaitTerminated to succeed")
+	}
+	if r.WaitFor(second, 10*time.Millisecond) {
+		t.Fatal("expected WaitFor to fail once the machine terminated")
+	}
+}
+
+func TestHarness(t *testing.T) {
+	defer func(d time.Duration) { statetest.DefaultTimeout = d }(statetest.DefaultTimeout)
+	statetest.DefaultTimeout = 50 * time.Millisecond
+
+	tb := &fakeTB{}
+	defer tb.cleanup()
+	h := statetest.Start(tb, state.NewSimpleMachine(0, first))
+
+	if msg := tb.run(func() { h.ExpectVisited(first, second) }); msg != "" {
+		t.Fatalf("unexpected failure: %s", msg)
+	}
+
+	msg := tb.run(func() { h.ExpectVisited(first, third) })
+	if want := statetest.Diff([]state.Fn{first, third}, []state.Fn{first, second}); msg != want {
+		t.Fatalf("expected failure %q, got %q", want, msg)
+	}
+
+	msg = tb.run(func() { h.ExpectVisited(first, second, third) })
+	if !strings.HasSuffix(msg, "\t got: statetest_test.first -> statetest_test.second -> [<end>]") {
+		t.Fatalf("expected a diff that ends early, got %q", msg)
+	}
+
+	msg = tb.run(func() { h.Expect(third) })
+	if !strings.HasPrefix(msg, "timed out waiting for state statetest_test.third\n") {
+		t.Fatalf("unexpected failure: %q", msg)
+	}
+
+	h.Send(&state.NamedEvent{Name: "next"})
+	if msg := tb.run(func() { h.Expect(third) }); msg != "" {
+		t.Fatalf("unexpected failure: %s", msg)
+	}
+
+	msg = tb.run(func() { h.Send(&state.NamedEvent{Name: "ignored"}) })
+	if want := "timed out sending *state.NamedEvent, machine is in state statetest_test.third"; msg != want {
+		t.Fatalf("expected failure %q, got %q", want, msg)
+	}
+
+	if msg := tb.run(h.Stop); msg != "" {
+		t.Fatalf("unexpected failure: %s", msg)
+	}
+	if !h.Terminated() {
+		t.Fatal("expected the machine to terminate")
+	}
+}
@@ -0,0 +1,387 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package statevet defines an Analyzer that reports common mistakes in state
+// funcs, i.e. funcs that have the signature of state.Fn:
+//
+//   - blocking selects that don't select on the Done() chan of a Context;
+//   - receives from Source(), or sends to a Sink(), a field or a parameter,
+//     that aren't part of a select, and so can't be interrupted by cancellation;
+//   - event loops (selects that receive from Source()) that ignore state.Next(m)
+//     in packages that implement hijackable (super-state) machines;
+//   - state.Upon and state.Delegate futures that are never read (or stopped).
+//
+// The Analyzer is driven by `go vet -vettool=$(which statevet)`, see cmd/statevet,
+// and may be registered with any other driver built upon golang.org/x/tools/go/analysis
+// (multichecker, gopls builds with additional analyzers, etc).
+package statevet
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+const doc = `report common mistakes in state funcs
+
+A state func is any func with the signature of state.Fn. Reports selects that
+can't be interrupted by the Done() chan of a Context, receives from Source()
+and sends to a Sink(), a field or a parameter that happen outside of a
+select, event loops that ignore state.Next(m) in packages that implement
+hijackable machines (outside of test files), and state.Upon or
+state.Delegate futures that are never read.`
+
+var Analyzer = &analysis.Analyzer{
+	Name: "statevet",
+	Doc:  doc,
+	Run:  run,
+}
+
+var statePackage = "github.com/jdef/state"
+
+func init() {
+	Analyzer.Flags.StringVar(&statePackage, "statepkg", statePackage, "fully-qualified name of the state package")
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	statepkg := findPackage(pass.Pkg, statePackage)
+	if statepkg == nil {
+		return nil, nil // package doesn't use state machines
+	}
+	fnObj, ok := statepkg.Scope().Lookup("Fn").(*types.TypeName)
+	if !ok {
+		return nil, nil
+	}
+	c := &checker{
+		pass:       pass,
+		statepkg:   statepkg,
+		fnSig:      fnObj.Type().Underlying().(*types.Signature),
+		hijackable: declaresSuperMachine(pass, statepkg),
+	}
+	for _, file := range pass.Files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				if n.Body != nil && c.isStateFn(pass.TypesInfo.Defs[n.Name]) {
+					c.checkStateFn(n.Type, n.Body)
+				}
+			case *ast.FuncLit:
+				if tv, ok := pass.TypesInfo.Types[n]; ok && c.isStateFnType(tv.Type) {
+					c.checkStateFn(n.Type, n.Body)
+				}
+			}
+			return true
+		})
+	}
+	return nil, nil
+}
+
+type checker struct {
+	pass       *analysis.Pass
+	statepkg   *types.Package
+	fnSig      *types.Signature
+	hijackable bool
+}
+
+func (c *checker) isStateFn(obj types.Object) bool {
+	return obj != nil && c.isStateFnType(obj.Type())
+}
+
+func (c *checker) isStateFnType(t types.Type) bool {
+	sig, ok := t.(*types.Signature)
+	return ok && sig.Recv() == nil && types.Identical(sig, c.fnSig)
+}
+
+// checkStateFn checks the body of a state func. Nested func literals are not
+// part of the state func and are skipped; those that are state funcs
+// themselves are checked independently.
+func (c *checker) checkStateFn(typ *ast.FuncType, body *ast.BlockStmt) {
+	var (
+		selects    []*ast.SelectStmt
+		eventLoop  bool // a select receives from Source()
+		handlesHij bool
+	)
+	// comms are the send/receive statements of select cases: they're allowed
+	// to block because the select itself is checked.
+	comms := map[ast.Node]bool{}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.SelectStmt:
+			selects = append(selects, n)
+			for _, s := range n.Body.List {
+				if cc := s.(*ast.CommClause); cc.Comm != nil {
+					ast.Inspect(cc.Comm, func(n ast.Node) bool {
+						switch n := n.(type) {
+						case *ast.SendStmt:
+							comms[n] = true
+						case *ast.UnaryExpr:
+							comms[n] = true
+							if n.Op == token.ARROW && isMethodCall(n.X, "Source") {
+								eventLoop = true
+							}
+						}
+						return true
+					})
+				}
+			}
+		case *ast.SendStmt:
+			if !comms[n] && c.isSharedChan(typ, n.Chan) {
+				c.pass.ReportRangef(n, "chan send outside of select blocks indefinitely, it can't be interrupted by the Done() chan of the Context")
+			}
+		case *ast.UnaryExpr:
+			if n.Op == token.ARROW && !comms[n] && isMethodCall(n.X, "Source") {
+				c.pass.ReportRangef(n, "receive from Source() outside of select blocks indefinitely, it can't be interrupted by the Done() chan of the Context")
+			}
+		case *ast.CallExpr:
+			if c.isStateCall(n, "Next") || isMethodCall(n, "NextState") {
+				handlesHij = true
+			}
+			for _, name := range []string{"Upon", "Delegate"} {
+				if c.isStateCall(n, name) {
+					c.checkFuture(body, n, name)
+				}
+			}
+		}
+		return true
+	})
+	for _, s := range selects {
+		if !hasDefault(s) && !hasDoneCase(s) {
+			c.pass.ReportRangef(s, "select does not receive from the Done() chan of the Context, it can't be interrupted by cancellation")
+		}
+	}
+	if c.hijackable && eventLoop && !handlesHij {
+		c.pass.ReportRangef(body, "state func of a hijackable machine ignores state.Next(m)")
+	}
+}
+
+// isSharedChan returns true if ch is the result of Sink(), a field, or a
+// parameter of the state func: chans that other goroutines may be slow (or
+// fail) to receive from. Sends to the state func's own, or captured, chans are
+// assumed to be the author's business.
+func (c *checker) isSharedChan(typ *ast.FuncType, ch ast.Expr) bool {
+	switch ch := ast.Unparen(ch).(type) {
+	case *ast.CallExpr:
+		return isMethodCall(ch, "Sink")
+	case *ast.SelectorExpr:
+		sel, ok := c.pass.TypesInfo.Selections[ch]
+		return ok && sel.Kind() == types.FieldVal
+	case *ast.Ident:
+		obj := c.pass.TypesInfo.Uses[ch]
+		for _, field := range typ.Params.List {
+			for _, name := range field.Names {
+				if obj != nil && c.pass.TypesInfo.Defs[name] == obj {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// checkFuture reports state.Upon (or state.Delegate) calls whose result is
+// discarded, or assigned to a variable that's never read by NextState(), never
+// stopped (Delegate) or passed along to another func.
+func (c *checker) checkFuture(body *ast.BlockStmt, call *ast.CallExpr, name string) {
+	var obj types.Object
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for i, rhs := range n.Rhs {
+				if rhs == call && i < len(n.Lhs) {
+					if id, ok := n.Lhs[i].(*ast.Ident); ok {
+						obj = c.pass.TypesInfo.ObjectOf(id)
+					}
+				}
+			}
+		case *ast.ValueSpec:
+			for i, v := range n.Values {
+				if v == call && i < len(n.Names) {
+					obj = c.pass.TypesInfo.ObjectOf(n.Names[i])
+				}
+			}
+		}
+		return obj == nil
+	})
+	if obj == nil {
+		if !isReturned(body, call) && !isArgument(body, call) {
+			c.pass.ReportRangef(call, "result of state.%s is never read", name)
+		}
+		return
+	}
+	read := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if id, ok := n.X.(*ast.Ident); ok && c.pass.TypesInfo.Uses[id] == obj {
+				switch n.Sel.Name {
+				case "NextState", "Stop", "Cancel":
+					read = true
+				}
+			}
+		case *ast.CallExpr:
+			for _, arg := range n.Args {
+				if id, ok := arg.(*ast.Ident); ok && c.pass.TypesInfo.Uses[id] == obj {
+					read = true
+				}
+			}
+		case *ast.ReturnStmt:
+			for _, r := range n.Results {
+				if id, ok := r.(*ast.Ident); ok && c.pass.TypesInfo.Uses[id] == obj {
+					read = true
+				}
+			}
+		}
+		return !read
+	})
+	if !read {
+		c.pass.ReportRangef(call, "future returned by state.%s is never read", name)
+	}
+}
+
+// isStateCall returns true if call invokes the named func of the state package.
+func (c *checker) isStateCall(call *ast.CallExpr, name string) bool {
+	var id *ast.Ident
+	switch fun := call.Fun.(type) {
+	case *ast.SelectorExpr:
+		id = fun.Sel
+	case *ast.Ident:
+		id = fun
+	default:
+		return false
+	}
+	fn, ok := c.pass.TypesInfo.Uses[id].(*types.Func)
+	return ok && fn.Pkg() == c.statepkg && fn.Name() == name && fn.Type().(*types.Signature).Recv() == nil
+}
+
+func isMethodCall(e ast.Expr, name string) bool {
+	call, ok := ast.Unparen(e).(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == name && len(call.Args) == 0
+}
+
+func hasDefault(s *ast.SelectStmt) bool {
+	for _, cc := range s.Body.List {
+		if cc.(*ast.CommClause).Comm == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDoneCase(s *ast.SelectStmt) bool {
+	for _, cc := range s.Body.List {
+		var x ast.Expr
+		switch comm := cc.(*ast.CommClause).Comm.(type) {
+		case *ast.ExprStmt:
+			x = comm.X
+		case *ast.AssignStmt:
+			x = comm.Rhs[0]
+		default:
+			continue
+		}
+		if u, ok := ast.Unparen(x).(*ast.UnaryExpr); ok && u.Op == token.ARROW && isMethodCall(u.X, "Done") {
+			return true
+		}
+	}
+	return false
+}
+
+func isReturned(body *ast.BlockStmt, e ast.Expr) (found bool) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		if r, ok := n.(*ast.ReturnStmt); ok {
+			for _, x := range r.Results {
+				if x == e {
+					found = true
+				}
+			}
+		}
+		return !found
+	})
+	return
+}
+
+func isArgument(body *ast.BlockStmt, e ast.Expr) (found bool) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			for _, x := range call.Args {
+				if x == e {
+					found = true
+				}
+			}
+		}
+		return !found
+	})
+	return
+}
+
+// findPackage returns pkg if it has the given path, otherwise the (transitively)
+// imported package with the given path; returns nil if there's no such package.
+func findPackage(pkg *types.Package, path string) *types.Package {
+	seen := map[*types.Package]bool{}
+	var find func(*types.Package) *types.Package
+	find = func(p *types.Package) *types.Package {
+		if p.Path() == path {
+			return p
+		}
+		if seen[p] {
+			return nil
+		}
+		seen[p] = true
+		for _, i := range p.Imports() {
+			if found := find(i); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	return find(pkg)
+}
+
+// declaresSuperMachine returns true if the non-test files of the package
+// declare a type that implements state.SuperMachine: the state funcs of such a
+// package may be hijacked. Fakes that are declared by tests don't count.
+func declaresSuperMachine(pass *analysis.Pass, statepkg *types.Package) bool {
+	obj, ok := statepkg.Scope().Lookup("SuperMachine").(*types.TypeName)
+	if !ok {
+		return false
+	}
+	iface, ok := obj.Type().Underlying().(*types.Interface)
+	if !ok {
+		return false
+	}
+	scope := pass.Pkg.Scope()
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok || types.IsInterface(tn.Type()) {
+			continue
+		}
+		if strings.HasSuffix(pass.Fset.Position(tn.Pos()).Filename, "_test.go") {
+			continue
+		}
+		if types.Implements(tn.Type(), iface) || types.Implements(types.NewPointer(tn.Type()), iface) {
+			return true
+		}
+	}
+	return false
+}
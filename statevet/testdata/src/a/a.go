@@ -0,0 +1,77 @@
+package a
+
+import "github.com/jdef/state"
+
+func good(ctx state.Context, m state.Machine) state.Fn {
+	t := state.Upon(other, ctx, m)
+	for {
+		select {
+		case e := <-m.Source():
+			select {
+			case m.Sink() <- e:
+			case <-ctx.Done():
+				return nil
+			}
+		case f := <-t.NextState():
+			return f
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func other(ctx state.Context, m state.Machine) state.Fn {
+	e := <-m.Source() // want `receive from Source\(\) outside of select`
+	m.Sink() <- e     // want `chan send outside of select`
+	select {          // want `select does not receive from the Done\(\) chan`
+	case <-m.Source():
+	}
+	select {
+	case <-m.Source():
+	default:
+	}
+	return nil
+}
+
+func futures(ctx state.Context, m state.Machine) state.Fn {
+	state.Upon(other, ctx, m)      // want `result of state.Upon is never read`
+	t := state.Upon(other, ctx, m) // want `future returned by state.Upon is never read`
+	_ = t
+	d := state.Delegate(ctx, other, m)
+	defer d.Stop()
+	state.Delegate(ctx, other, m) // want `result of state.Delegate is never read`
+	if f, ok := state.TryHijack(nil, ctx, good, state.Upon(other, ctx, m)); ok {
+		return f
+	}
+	return nil
+}
+
+// notAStateFn has a different signature and is ignored.
+func notAStateFn(m state.Machine) {
+	<-m.Source()
+	go func(ctx state.Context, m state.Machine) state.Fn {
+		m.Sink() <- nil // want `chan send outside of select`
+		return nil
+	}(nil, m)
+}
+
+type machine struct {
+	state.Machine
+	pulse chan struct{}
+}
+
+// sends reports sends to chans that other goroutines own, but not to its own.
+func sends(ctx state.Context, m state.Machine) state.Fn {
+	done := make(chan struct{}, 1)
+	done <- struct{}{}
+	m.(*machine).pulse <- struct{}{} // want `chan send outside of select`
+	return nil
+}
+
+// captures returns a state func that sends to a captured chan.
+func captures(started chan<- string) state.Fn {
+	return func(ctx state.Context, m state.Machine) state.Fn {
+		started <- "captures"
+		return nil
+	}
+}
@@ -0,0 +1,39 @@
+package b
+
+import "github.com/jdef/state"
+
+type super struct{ hijack chan state.Fn }
+
+func (s *super) Hijack() chan<- state.Fn                   { return s.hijack }
+func (s *super) SubMachine(int, state.Fn) state.SubMachine { return nil }
+
+func hijackable(ctx state.Context, m state.Machine) state.Fn {
+	next := state.Next(m)
+	for {
+		select {
+		case <-m.Source():
+		case f := <-next:
+			return f
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func stubborn(ctx state.Context, m state.Machine) state.Fn { // want `ignores state.Next\(m\)`
+	for {
+		select {
+		case <-m.Source():
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// waiting doesn't read events, it isn't an event loop.
+func waiting(ctx state.Context, m state.Machine) state.Fn {
+	select {
+	case <-ctx.Done():
+		return nil
+	}
+}
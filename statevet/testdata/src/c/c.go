@@ -0,0 +1,14 @@
+package c
+
+import "github.com/jdef/state"
+
+// loop ignores state.Next(m): only a test declares a super-state machine.
+func loop(ctx state.Context, m state.Machine) state.Fn {
+	for {
+		select {
+		case <-m.Source():
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
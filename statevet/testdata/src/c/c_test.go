@@ -0,0 +1,8 @@
+package c
+
+import "github.com/jdef/state"
+
+type fakeSuper struct{ hijack chan state.Fn }
+
+func (s *fakeSuper) Hijack() chan<- state.Fn                   { return s.hijack }
+func (s *fakeSuper) SubMachine(int, state.Fn) state.SubMachine { return nil }
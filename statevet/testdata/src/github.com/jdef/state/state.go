@@ -0,0 +1,33 @@
+// Package state is a minimal stand-in for github.com/jdef/state.
+package state
+
+type (
+	Context interface{ Done() <-chan struct{} }
+	Event   interface{ Event() struct{} }
+	Machine interface {
+		Source() <-chan Event
+		Sink() chan<- Event
+		InitialState() Fn
+	}
+	Fn           func(Context, Machine) Fn
+	Transition   interface{ NextState() <-chan Fn }
+	SubMachine   interface{ Super() SuperMachine }
+	SuperMachine interface {
+		Hijack() chan<- Fn
+		SubMachine(int, Fn) SubMachine
+	}
+)
+
+func Next(m Machine) <-chan Fn                   { return nil }
+func Upon(f Fn, c Context, m Machine) Transition { return nil }
+
+type Future struct{}
+
+func (*Future) NextState() <-chan Fn { return nil }
+func (*Future) Stop()                {}
+
+func Delegate(c Context, f Fn, m Machine) *Future { return nil }
+
+func TryHijack(super SuperMachine, c Context, target Fn, next Transition) (Fn, bool) {
+	return nil, false
+}
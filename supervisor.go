@@ -0,0 +1,374 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+type (
+	// RestartStrategy determines which children a Supervisor restarts when a
+	// child ends and is restarted.
+	RestartStrategy int
+
+	// RestartPolicy determines whether a child is restarted when it ends.
+	RestartPolicy int
+
+	// ChildSpec specifies a child of a Supervisor: either a machine, created
+	// anew upon every (re)start by New, or a nested Supervisor.
+	ChildSpec struct {
+		Name       string
+		New        func() Machine
+		Supervisor *Supervisor
+		Restart    RestartPolicy
+		// Observers are notified of the transitions of the child machine,
+		// see Run.
+		Observers []Observer
+		// Registry, if not nil, registers the child machine under Name for
+		// as long as it runs, see Registry.Run.
+		Registry *Registry
+	}
+
+	// ChildExit reports how a child ended: Err is nil if the child's machine
+	// reached the nil state, a *PanicError if a state func panicked, the
+	// error returned by a nested Supervisor, or the error that prevented the
+	// child from registering, see ChildSpec.Registry.
+	ChildExit struct {
+		Name       string
+		Err        error
+		Restarting bool
+	}
+
+	// Supervisor starts child machines and restarts them, according to its
+	// Strategy and the RestartPolicy of each child, when they end. Children
+	// are started in order, and stopped (their Context cancelled) in reverse
+	// order. A Supervisor may be run any number of times, but not concurrently.
+	Supervisor struct {
+		Name     string
+		Strategy RestartStrategy
+		Children []ChildSpec
+		// MaxRestarts limits the restart intensity: if more than MaxRestarts
+		// restarts happen within Period then the supervisor stops all of its
+		// children and escalates, see Run. Defaults to 3 restarts in 5s.
+		MaxRestarts int
+		Period      time.Duration
+		// Backoff, if not nil, returns the delay before a child is restarted,
+		// given the number of times that it was restarted before within
+		// Period (0 for the first restart), see ExponentialBackoff.
+		Backoff func(restarts int) time.Duration
+		// Report, if not nil, is notified whenever a child ends by itself.
+		Report func(ChildExit)
+	}
+
+	// PanicError is the exit reason of a child whose state func panicked.
+	PanicError struct {
+		Value interface{}
+		Stack []byte
+	}
+
+	// EscalationError is returned by a Supervisor whose restart intensity
+	// was exceeded; Err is the exit reason of the child that ended last. A
+	// nested supervisor that escalates ends abnormally, as far as its parent
+	// is concerned.
+	EscalationError struct {
+		Supervisor string
+		Child      string
+		Err        error
+	}
+)
+
+const (
+	// OneForOne restarts just the child that ended.
+	OneForOne RestartStrategy = iota
+	// OneForAll stops all other children and then restarts all children.
+	OneForAll
+	// RestForOne stops the children that were started after the child that
+	// ended, and then restarts it and them.
+	RestForOne
+)
+
+const (
+	// Permanent children are always restarted.
+	Permanent RestartPolicy = iota
+	// Transient children are restarted only if they end abnormally: if they
+	// panic, or if they're nested supervisors that escalate.
+	Transient
+	// Temporary children are never restarted.
+	Temporary
+)
+
+const (
+	defaultMaxRestarts = 3
+	defaultPeriod      = 5 * time.Second
+)
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic: %v", e.Value) }
+
+func (e *EscalationError) Error() string {
+	return fmt.Sprintf("supervisor %q: restart intensity exceeded by child %q: %v", e.Supervisor, e.Child, e.Err)
+}
+
+func (e *EscalationError) Unwrap() error { return e.Err }
+
+// ExponentialBackoff returns a Backoff func that doubles the delay, starting
+// at `base`, for every restart up to `max`.
+func ExponentialBackoff(base, max time.Duration) func(int) time.Duration {
+	return func(restarts int) time.Duration {
+		d := base
+		for i := 0; i < restarts && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+type (
+	child struct {
+		spec     ChildSpec
+		index    int
+		running  *instance
+		pending  *restart
+		restarts []time.Time // within the period
+	}
+
+	// instance is a running child.
+	instance struct {
+		child   *child
+		cancel  CancelFunc
+		err     error
+		stopped chan struct{} // closed by the supervisor when it stops the child
+		exited  chan struct{}
+	}
+
+	// restart is a (delayed) restart of a group of children.
+	restart struct {
+		children []*child
+	}
+
+	supervision struct {
+		*Supervisor
+		ctx      Context
+		children []*child
+		exits    chan *instance
+		restarts chan *restart
+		history  []time.Time // restarts within the period
+		quit     chan struct{}
+	}
+)
+
+// Run starts the children and supervises them until the Context is done, or
+// until no children are left to supervise (because none of them are to be
+// restarted), in which case nil is returned. If the restart intensity is
+// exceeded then Run returns an *EscalationError. Either way all children
+// have been stopped by the time Run returns.
+//
+// Panics are only recovered from state funcs that are invoked by Run (of the
+// child machine): panics in other goroutines still crash the process.
+func (s *Supervisor) Run(ctx Context) error {
+	sv := &supervision{
+		Supervisor: s,
+		ctx:        ctx,
+		exits:      make(chan *instance),
+		restarts:   make(chan *restart),
+		quit:       make(chan struct{}),
+	}
+	defer close(sv.quit)
+	for i, spec := range s.Children {
+		sv.children = append(sv.children, &child{spec: spec, index: i})
+	}
+	for _, c := range sv.children {
+		sv.start(c)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			sv.stopAll()
+			return nil
+		default:
+		}
+		if !sv.active() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case inst := <-sv.exits:
+			if err := sv.exited(inst); err != nil {
+				sv.stopAll()
+				return err
+			}
+		case r := <-sv.restarts:
+			for _, c := range r.children {
+				if c.pending == r {
+					sv.start(c)
+				}
+			}
+		}
+	}
+}
+
+func (sv *supervision) active() bool {
+	for _, c := range sv.children {
+		if c.running != nil || c.pending != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (sv *supervision) start(c *child) {
+	ctx, cancel := WithCancel(sv.ctx)
+	inst := &instance{
+		child:   c,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	c.running, c.pending = inst, nil
+	go func() {
+		defer close(inst.exited)
+		defer cancel()
+		inst.err = runChild(ctx, c.spec)
+		select {
+		case sv.exits <- inst:
+		case <-inst.stopped:
+		}
+	}()
+}
+
+func runChild(ctx Context, spec ChildSpec) (err error) {
+	if spec.Supervisor != nil {
+		return spec.Supervisor.Run(ctx)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	if spec.Registry != nil {
+		return spec.Registry.Run(ctx, spec.Name, spec.New(), spec.Observers...)
+	}
+	Run(ctx, spec.New(), spec.Observers...)
+	return nil
+}
+
+// stop stops a running child and waits for it to exit.
+func (sv *supervision) stop(c *child) {
+	if inst := c.running; inst != nil {
+		c.running = nil
+		close(inst.stopped)
+		inst.cancel()
+		<-inst.exited
+	}
+	c.pending = nil
+}
+
+func (sv *supervision) stopAll() {
+	for i := len(sv.children) - 1; i >= 0; i-- {
+		sv.stop(sv.children[i])
+	}
+}
+
+// exited handles a child that ended by itself; returns an error if the restart
+// intensity is exceeded.
+func (sv *supervision) exited(inst *instance) error {
+	c := inst.child
+	c.running = nil
+
+	again := false
+	switch c.spec.Restart {
+	case Permanent:
+		again = true
+	case Transient:
+		again = inst.err != nil
+	}
+	if sv.Report != nil {
+		sv.Report(ChildExit{Name: c.spec.Name, Err: inst.err, Restarting: again})
+	}
+	if !again {
+		return nil
+	}
+
+	now := time.Now()
+	max, period := sv.MaxRestarts, sv.Period
+	if max <= 0 {
+		max = defaultMaxRestarts
+	}
+	if period <= 0 {
+		period = defaultPeriod
+	}
+	sv.history = append(within(sv.history, now.Add(-period)), now)
+	if len(sv.history) > max {
+		return &EscalationError{Supervisor: sv.Name, Child: c.spec.Name, Err: inst.err}
+	}
+	c.restarts = within(c.restarts, now.Add(-period))
+
+	affected := []*child{c}
+	switch sv.Strategy {
+	case OneForAll:
+		affected = sv.children
+	case RestForOne:
+		affected = sv.children[c.index:]
+	}
+	// children that already ended for good aren't restarted, neither are
+	// temporary children that are stopped along with the others
+	var group []*child
+	for _, other := range affected {
+		if other == c || ((other.running != nil || other.pending != nil) && other.spec.Restart != Temporary) {
+			group = append(group, other)
+		}
+	}
+	for i := len(affected) - 1; i >= 0; i-- {
+		sv.stop(affected[i])
+	}
+	var delay time.Duration
+	if sv.Backoff != nil {
+		delay = sv.Backoff(len(c.restarts))
+	}
+	c.restarts = append(c.restarts, now)
+
+	r := &restart{children: group}
+	for _, c := range group {
+		c.pending = r
+	}
+	if delay <= 0 {
+		for _, c := range group {
+			sv.start(c)
+		}
+		return nil
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case sv.restarts <- r:
+		case <-sv.quit:
+		}
+	})
+	return nil
+}
+
+// within returns the times that happened after `since`.
+func within(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(since) {
+		i++
+	}
+	return append(times[:0], times[i:]...)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+func ExampleSupervisor() {
+	attempts := 0
+	worker := func(state.Context, state.Machine) state.Fn {
+		attempts++
+		if attempts < 3 {
+			panic("connection refused")
+		}
+		fmt.Println("worker done")
+		return nil
+	}
+	s := &state.Supervisor{
+		Name: "agents",
+		Children: []state.ChildSpec{{
+			Name:    "worker",
+			New:     func() state.Machine { return state.NewSimpleMachine(0, worker) },
+			Restart: state.Transient, // restart only upon panic
+		}},
+		Report: func(e state.ChildExit) {
+			fmt.Printf("%s exited: %v (restarting: %v)\n", e.Name, e.Err, e.Restarting)
+		},
+	}
+	fmt.Println(s.Run(make(state.SimpleContext)))
+	// Output:
+	// worker exited: panic: connection refused (restarting: true)
+	// worker exited: panic: connection refused (restarting: true)
+	// worker done
+	// worker exited: <nil> (restarting: false)
+	// <nil>
+}
+
+// supervised returns child specs that report their starts, and that panic
+// upon request.
+func supervised(started chan<- string, crash map[string]chan struct{}, names ...string) (specs []state.ChildSpec) {
+	for _, name := range names {
+		name := name
+		crash[name] = make(chan struct{}, 1)
+		specs = append(specs, state.ChildSpec{
+			Name: name,
+			New: func() state.Machine {
+				return state.NewSimpleMachine(0, func(ctx state.Context, _ state.Machine) state.Fn {
+					started <- name
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-crash[name]:
+						panic(name + " crashed")
+					}
+				})
+			},
+		})
+	}
+	return
+}
+
+func TestSupervisor_RestForOne(t *testing.T) {
+	var (
+		started = make(chan string, 10)
+		crash   = map[string]chan struct{}{}
+		ctx     = make(state.SimpleContext)
+		s       = &state.Supervisor{Strategy: state.RestForOne, Children: supervised(started, crash, "a", "b", "c")}
+		done    = make(chan error)
+	)
+	go func() { done <- s.Run(ctx) }()
+
+	// children start concurrently, in no particular order
+	expect := func(names ...string) {
+		t.Helper()
+		want := map[string]bool{}
+		for _, name := range names {
+			want[name] = true
+		}
+		for range names {
+			select {
+			case got := <-started:
+				if !want[got] {
+					t.Fatalf("unexpected start of %q, expected %v", got, names)
+				}
+				delete(want, got)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %v to start", want)
+			}
+		}
+	}
+	expect("a", "b", "c")
+	crash["b"] <- struct{}{}
+	expect("b", "c")
+	select {
+	case name := <-started:
+		t.Fatalf("unexpected restart of %q", name)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	ctx.Cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSupervisor_escalation(t *testing.T) {
+	var (
+		started = make(chan string, 100)
+		crash   = map[string]chan struct{}{}
+		mu      sync.Mutex
+		exits   []string
+	)
+	children := supervised(started, crash, "flaky")
+	close(crash["flaky"]) // crashes upon every start
+	nested := &state.Supervisor{Name: "nested", MaxRestarts: 1, Children: children}
+	s := &state.Supervisor{
+		Name:        "root",
+		MaxRestarts: 1,
+		Backoff:     state.ExponentialBackoff(time.Millisecond, 10*time.Millisecond),
+		Children:    []state.ChildSpec{{Name: "nested", Supervisor: nested, Restart: state.Transient}},
+		Report: func(e state.ChildExit) {
+			mu.Lock()
+			defer mu.Unlock()
+			exits = append(exits, e.Name)
+		},
+	}
+	err := s.Run(make(state.SimpleContext))
+
+	var (
+		escalation *state.EscalationError
+		panicked   *state.PanicError
+	)
+	if !errors.As(err, &escalation) || escalation.Supervisor != "root" || escalation.Child != "nested" {
+		t.Fatalf("expected escalation by root, got %v", err)
+	}
+	if !errors.As(err, &panicked) || panicked.Value != "flaky crashed" {
+		t.Fatalf("expected the panic of flaky as the root cause, got %v", err)
+	}
+	if len(exits) != 2 {
+		t.Fatalf("expected nested to exit twice, got %v", exits)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := state.ExponentialBackoff(time.Second, 5*time.Second)
+	for restarts, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := b(restarts); got != want {
+			t.Errorf("restarts %d: expected %v, got %v", restarts, want, got)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xstate_test
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/xstate"
+)
+
+func ExampleParse() {
+	config := `{
+  "id": "light",
+  "initial": "green",
+  "states": {
+    "green": {
+      "entry": "report",
+      "on": { "EMERGENCY": { "target": "red", "cond": "authorized" } },
+      "after": { "10": "yellow" }
+    },
+    "yellow": {
+      "entry": ["report"],
+      "after": { "short": "red" }
+    },
+    "red": {
+      "entry": { "type": "report" },
+      "after": { "10": { "target": "off", "actions": "report" } }
+    },
+    "off": { "type": "final" }
+  }
+}`
+	c, err := xstate.Parse([]byte(config), xstate.Bindings{
+		Actions: map[string]state.Action{
+			"report": func(_ state.Context, m *state.ChartMachine, e state.Event) {
+				if e == nil {
+					fmt.Println(m.Configuration())
+				} else {
+					fmt.Println(m.Configuration(), state.EventName(e))
+				}
+			},
+		},
+		Guards: map[string]state.Guard{
+			"authorized": func(state.Event, interface{}) bool { return false },
+		},
+		Delays: map[string]time.Duration{"short": 5 * time.Millisecond},
+	})
+	if err != nil {
+		panic(err)
+	}
+	m, err := c.Machine(1)
+	if err != nil {
+		panic(err)
+	}
+	m.Sink() <- &state.NamedEvent{Name: "EMERGENCY"} // not authorized
+	state.Run(make(state.SimpleContext), m)
+	// Output:
+	// [green]
+	// [yellow] after(10ms)#green
+	// [red] after(5ms)#yellow
+	// [] after(10ms)#red
+}
+
+func ExampleExport() {
+	c := state.NewChart("agent").Initial("Disconnected")
+	c.State("Disconnected").
+		On("ConnectRequest", "Dial")
+	c.Junction("Dial").
+		When("online", "Connected").
+		Else("Disconnected", "backoff")
+	connected := c.State("Connected").OnEntry("greet")
+	connected.State("Idle").On("Request", "Busy")
+	connected.State("Busy").After(time.Second, "Idle")
+	connected.On("DisconnectRequest", "Disconnected")
+
+	noop := func(state.Context, *state.ChartMachine, state.Event) {}
+	c.Action("backoff", noop).Action("greet", noop).
+		Guard("online", func(state.Event, interface{}) bool { return true })
+
+	data, err := xstate.Export(c)
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(data)
+	// Output:
+	// {
+	//   "id": "agent",
+	//   "initial": "Disconnected",
+	//   "states": {
+	//     "Disconnected": {
+	//       "on": {
+	//         "ConnectRequest": [
+	//           {
+	//             "target": "Connected",
+	//             "cond": "online"
+	//           },
+	//           {
+	//             "target": "Disconnected",
+	//             "actions": [
+	//               "backoff"
+	//             ]
+	//           }
+	//         ]
+	//       }
+	//     },
+	//     "Connected": {
+	//       "initial": "Idle",
+	//       "entry": [
+	//         "greet"
+	//       ],
+	//       "on": {
+	//         "DisconnectRequest": "Disconnected"
+	//       },
+	//       "states": {
+	//         "Idle": {
+	//           "id": "Idle",
+	//           "on": {
+	//             "Request": "Busy"
+	//           }
+	//         },
+	//         "Busy": {
+	//           "id": "Busy",
+	//           "after": {
+	//             "1000": "Idle"
+	//           }
+	//         }
+	//       }
+	//     }
+	//   }
+	// }
+}
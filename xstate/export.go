@@ -0,0 +1,362 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xstate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+type (
+	// object is a JSON object that retains the order of its members.
+	object []field
+
+	field struct {
+		key   string
+		value interface{}
+	}
+
+	// transitions groups the transitions of a state by event, in order of
+	// first appearance.
+	transitions struct {
+		keys  []string
+		byKey map[string][]interface{}
+	}
+)
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (t *transitions) add(key string, v interface{}) {
+	if t.byKey == nil {
+		t.byKey = map[string][]interface{}{}
+	}
+	if _, ok := t.byKey[key]; !ok {
+		t.keys = append(t.keys, key)
+	}
+	t.byKey[key] = append(t.byKey[key], v)
+}
+
+func (t *transitions) object() object {
+	var o object
+	for _, k := range t.keys {
+		o = append(o, field{k, single(t.byKey[k])})
+	}
+	return o
+}
+
+// single returns the only item of a list, or the list.
+func single(items []interface{}) interface{} {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return items
+}
+
+// Export returns the machine config (indented JSON) of a chart; the id of the
+// machine is the name of the chart. Parse(Export(c)) yields a chart that's
+// equivalent to c, given bindings for the actions and guards of c.
+//
+// States are keyed by their name, less the name of the parent state and a
+// "." separator (if the name is so prefixed); states whose name differs from
+// the path of keys declare their name as id. Transitions that target choice
+// or junction pseudo-states are expanded into a list of guarded transitions,
+// one per branch, with the else branch last. Note that XState evaluates the
+// conditions of such transitions before executing their actions, whereas
+// the guards of choice pseudo-states are evaluated afterwards.
+//
+// Charts that XState can't express are rejected: deep initial states,
+// branches that target pseudo-states, guarded transitions to pseudo-states,
+// and delays that aren't a whole number of milliseconds.
+func Export(c *state.Chart) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	ex := &exporter{c: c, states: c.States(), keys: map[*state.ChartState]string{}}
+	if err := ex.keyChildren(nil); err != nil {
+		return nil, err
+	}
+	root := object{{"id", c.Name()}}
+	if s := c.InitialChild(); s != nil {
+		if s.Parent() != nil {
+			return nil, fmt.Errorf("machine: deep initial state %q is not supported", s.Name())
+		}
+		root = append(root, field{"initial", ex.keys[s]})
+	}
+	states, err := ex.children(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(states) > 0 {
+		root = append(root, field{"states", states})
+	}
+	return json.MarshalIndent(root, "", "  ")
+}
+
+type exporter struct {
+	c      *state.Chart
+	states []*state.ChartState // in document order
+	keys   map[*state.ChartState]string
+}
+
+// childrenOf returns the children (pseudo-states included) of a state, or
+// the top-level states, in document order.
+func (ex *exporter) childrenOf(parent *state.ChartState) (children []*state.ChartState) {
+	for _, s := range ex.states {
+		if s.Parent() == parent {
+			children = append(children, s)
+		}
+	}
+	return
+}
+
+func exported(s *state.ChartState) bool { return !s.IsChoice() && !s.IsJunction() }
+
+// keyChildren assigns keys to the (exported) descendants of a state.
+func (ex *exporter) keyChildren(parent *state.ChartState) error {
+	taken := map[string]*state.ChartState{}
+	for _, s := range ex.childrenOf(parent) {
+		if !exported(s) {
+			continue
+		}
+		key := s.Name()
+		if parent != nil {
+			key = strings.TrimPrefix(key, parent.Name()+".")
+		}
+		key = strings.Replace(key, ".", "_", -1)
+		if other := taken[key]; other != nil {
+			return fmt.Errorf("states %q and %q have the same key %q", other.Name(), s.Name(), key)
+		}
+		taken[key] = s
+		ex.keys[s] = key
+		if err := ex.keyChildren(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path returns the path of keys that identifies a state.
+func (ex *exporter) path(s *state.ChartState) string {
+	if p := s.Parent(); p != nil {
+		return ex.path(p) + "." + ex.keys[s]
+	}
+	return ex.keys[s]
+}
+
+// target returns a reference to a state, relative to the source state.
+func (ex *exporter) target(source, s *state.ChartState) string {
+	switch {
+	case s.Parent() == source.Parent():
+		return ex.keys[s]
+	case s.Parent() == source:
+		return "." + ex.keys[s]
+	}
+	return ex.ref(s)
+}
+
+// ref returns an absolute reference to a state.
+func (ex *exporter) ref(s *state.ChartState) string {
+	if p := ex.path(s); p != s.Name() {
+		return "#" + s.Name() // by id
+	}
+	return "#" + ex.c.Name() + "." + s.Name()
+}
+
+func (ex *exporter) children(parent *state.ChartState) (object, error) {
+	var states object
+	for _, s := range ex.childrenOf(parent) {
+		if !exported(s) {
+			continue
+		}
+		o, err := ex.state(s)
+		if err != nil {
+			return nil, fmt.Errorf("state %q: %v", s.Name(), err)
+		}
+		states = append(states, field{ex.keys[s], o})
+	}
+	return states, nil
+}
+
+func (ex *exporter) state(s *state.ChartState) (object, error) {
+	var o object
+	if ex.path(s) != s.Name() {
+		o = append(o, field{"id", s.Name()})
+	}
+	if ok, deep := s.IsHistory(); ok {
+		o = append(o, field{"type", "history"})
+		if deep {
+			o = append(o, field{"history", "deep"})
+		}
+		if t := s.InitialChild(); t != nil {
+			o = append(o, field{"target", ex.target(s, t)})
+		}
+		return o, nil
+	}
+	switch {
+	case s.IsParallel():
+		o = append(o, field{"type", "parallel"})
+	case s.IsFinal():
+		o = append(o, field{"type", "final"})
+	}
+	if t := s.InitialChild(); t != nil {
+		if t.Parent() != s {
+			return nil, fmt.Errorf("deep initial state %q is not supported", t.Name())
+		}
+		o = append(o, field{"initial", ex.keys[t]})
+	}
+	if a := s.EntryActions(); len(a) > 0 {
+		o = append(o, field{"entry", a})
+	}
+	if a := s.ExitActions(); len(a) > 0 {
+		o = append(o, field{"exit", a})
+	}
+
+	var on, after, always, done transitions
+	for _, t := range s.Transitions() {
+		configs, err := ex.transition(s, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, tc := range configs {
+			switch {
+			case t.After > 0:
+				if t.After%time.Millisecond != 0 {
+					return nil, fmt.Errorf("delay %v is not a whole number of milliseconds", t.After)
+				}
+				after.add(strconv.FormatInt(int64(t.After/time.Millisecond), 10), tc)
+			case t.Event == "":
+				always.add("", tc)
+			default:
+				for _, e := range strings.Fields(t.Event) {
+					if e == "done.state."+s.Name() {
+						done.add("", tc)
+					} else {
+						on.add(e, tc)
+					}
+				}
+			}
+		}
+	}
+	if len(on.keys) > 0 {
+		o = append(o, field{"on", on.object()})
+	}
+	if len(after.keys) > 0 {
+		o = append(o, field{"after", after.object()})
+	}
+	if len(always.keys) > 0 {
+		o = append(o, field{"always", single(always.byKey[""])})
+	}
+	if len(done.keys) > 0 {
+		o = append(o, field{"onDone", single(done.byKey[""])})
+	}
+
+	states, err := ex.children(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(states) > 0 {
+		o = append(o, field{"states", states})
+	}
+	return o, nil
+}
+
+// transition returns the transition configs of a chart transition: one per
+// branch of a targeted choice or junction pseudo-state, otherwise just one.
+func (ex *exporter) transition(s *state.ChartState, t *state.ChartTransition) ([]interface{}, error) {
+	target := ex.c.Lookup(t.Target)
+	if target == nil || exported(target) {
+		return []interface{}{ex.config(s, target, t.Guard, t.Actions, t)}, nil
+	}
+	if t.Guard != "" {
+		return nil, fmt.Errorf("guarded transition to pseudo-state %q is not supported", target.Name())
+	}
+	var configs []interface{}
+	var otherwise interface{}
+	for _, b := range target.Branches() {
+		bt := ex.c.Lookup(b.Target)
+		if !exported(bt) {
+			return nil, fmt.Errorf("branch of %q to pseudo-state %q is not supported", target.Name(), bt.Name())
+		}
+		actions := append(append([]string(nil), t.Actions...), b.Actions...)
+		tc := ex.config(s, bt, b.Guard, actions, t)
+		if b.Guard == "" {
+			otherwise = tc
+		} else {
+			configs = append(configs, tc)
+		}
+	}
+	return append(configs, otherwise), nil
+}
+
+// config returns the transition config of a transition, in the shortest form
+// that's equivalent: just the target if possible.
+func (ex *exporter) config(s, target *state.ChartState, guard string, actions []string, t *state.ChartTransition) interface{} {
+	var (
+		o   object
+		ref string
+	)
+	if target != nil {
+		ref = ex.target(s, target)
+		o = append(o, field{"target", ref})
+	}
+	if len(actions) > 0 {
+		o = append(o, field{"actions", actions})
+	}
+	if guard != "" {
+		o = append(o, field{"cond", guard})
+	}
+	if t.In != "" {
+		o = append(o, field{"in", ex.ref(ex.c.Lookup(t.In))})
+	}
+	if internal := strings.HasPrefix(ref, "."); target != nil && t.Local != internal {
+		o = append(o, field{"internal", t.Local})
+	}
+	if len(o) == 1 && target != nil {
+		return ref
+	}
+	if len(o) == 0 {
+		return object{{"target", nil}}
+	}
+	return o
+}
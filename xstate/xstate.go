@@ -0,0 +1,549 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package xstate imports XState (v4) machine configs as statecharts (see
+// state.Chart), and exports charts as XState machine configs, so that one
+// definition can drive both a Go backend and an XState frontend.
+//
+// The supported subset of the machine config is: `id`, `initial`, `states`,
+// `type` (parallel, final and history, along with `history` and `target`),
+// `entry` and `exit`, and the transitions of `on`, `after`, `always` and
+// `onDone`. Transitions may declare a single `target`, `actions`, a `cond`
+// (or `guard`), `in` and `internal`. Actions, guards and named delays are
+// bound to Go implementations by name, see Bindings. Documentation-only
+// properties (`context`, `meta`, `description`, `tags`, etc.) are ignored;
+// anything else, such as `invoke` or transitions at the machine level, is
+// rejected.
+//
+// Transitions match events like those of charts do (see state.ChartState.On);
+// the events of `after` transitions are internal to the machine.
+package xstate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdef/state"
+)
+
+// Bindings bind the names that are used by a machine config to Go
+// implementations.
+type Bindings struct {
+	Actions map[string]state.Action
+	Guards  map[string]state.Guard
+	// Delays bind the named delays of `after` transitions; numeric delays are
+	// in milliseconds.
+	Delays map[string]time.Duration
+}
+
+// member is a member of a JSON object: the order of members matters for the
+// order of states and transitions.
+type member struct {
+	key   string
+	value json.RawMessage
+}
+
+func members(raw json.RawMessage) ([]member, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('{') {
+		return nil, fmt.Errorf("expected an object, found %s", raw)
+	}
+	var result []member
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		result = append(result, member{key: t.(string), value: value})
+	}
+	return result, nil
+}
+
+// list decodes a value that may be given as a single item or as an array.
+func list(raw json.RawMessage) []json.RawMessage {
+	var items []json.RawMessage
+	if len(raw) > 0 && raw[0] == '[' && json.Unmarshal(raw, &items) == nil {
+		return items
+	}
+	return []json.RawMessage{raw}
+}
+
+// node is a state node of the config.
+type node struct {
+	key      string
+	name     string // name of the chart state
+	parent   *node
+	children map[string]*node
+	state    *state.ChartState
+	config   map[string]json.RawMessage
+	order    []member
+}
+
+func (n *node) String() string {
+	if n.parent == nil {
+		return "machine"
+	}
+	return fmt.Sprintf("state %q", n.name)
+}
+
+// ignored properties are documentation, or only meaningful to a frontend.
+var ignored = map[string]bool{
+	"context": true, "meta": true, "description": true, "tags": true, "key": true,
+	"version": true, "schema": true, "tsTypes": true, "predictableActionArguments": true,
+	"preserveActionOrder": true, "strict": true,
+}
+
+var supported = map[string]bool{
+	"id": true, "type": true, "initial": true, "states": true, "history": true, "target": true,
+	"entry": true, "exit": true, "on": true, "after": true, "always": true, "onDone": true,
+}
+
+// Load reads and parses the machine config at path.
+func Load(path string, b Bindings) (*state.Chart, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, b)
+}
+
+// Parse parses a machine config (JSON) and returns the (validated) chart that
+// it describes. The chart is named after the id of the machine. States are
+// named after their id, if any, otherwise after their path: the dot-separated
+// keys of the state and its ancestors, e.g. "connected.idle".
+func Parse(data []byte, b Bindings) (*state.Chart, error) {
+	root := &node{children: map[string]*node{}}
+	if err := root.decode(data); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"on", "after", "always", "onDone", "entry", "exit", "type", "history", "target"} {
+		if _, ok := root.config[key]; ok {
+			return nil, fmt.Errorf("machine: %q is not supported at the machine level", key)
+		}
+	}
+	var id string
+	if raw, ok := root.config["id"]; ok {
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return nil, fmt.Errorf("machine: id: %v", err)
+		}
+	}
+	if id == "" {
+		id = "machine"
+	}
+	im := &importer{c: state.NewChart(id), b: b, root: root, ids: map[string]*node{id: root}}
+	if err := im.states(root); err != nil {
+		return nil, err
+	}
+	if err := im.behavior(root); err != nil {
+		return nil, err
+	}
+	if err := im.c.Validate(); err != nil {
+		return nil, err
+	}
+	return im.c, nil
+}
+
+func (n *node) decode(raw json.RawMessage) error {
+	ms, err := members(raw)
+	if err != nil {
+		return fmt.Errorf("%v: %v", n, err)
+	}
+	n.order, n.config = ms, map[string]json.RawMessage{}
+	for _, m := range ms {
+		switch {
+		case supported[m.key]:
+			n.config[m.key] = m.value
+		case !ignored[m.key]:
+			return fmt.Errorf("%v: %q is not supported", n, m.key)
+		}
+	}
+	return nil
+}
+
+func (n *node) str(key string) (string, error) {
+	raw, ok := n.config[key]
+	if !ok {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("%v: %s: %v", n, key, err)
+	}
+	return s, nil
+}
+
+type importer struct {
+	c    *state.Chart
+	b    Bindings
+	root *node
+	ids  map[string]*node
+}
+
+// states creates the chart states of the children of a node, recursively.
+func (im *importer) states(parent *node) error {
+	raw, ok := parent.config["states"]
+	if !ok {
+		return nil
+	}
+	ms, err := members(raw)
+	if err != nil {
+		return fmt.Errorf("%v: states: %v", parent, err)
+	}
+	for _, m := range ms {
+		n := &node{key: m.key, parent: parent, children: map[string]*node{}}
+		if m.key == "" || strings.Contains(m.key, ".") {
+			return fmt.Errorf("%v: invalid state key %q", parent, m.key)
+		}
+		if err := n.decode(m.value); err != nil {
+			return err
+		}
+		parent.children[m.key] = n
+
+		id, err := n.str("id")
+		if err != nil {
+			return err
+		}
+		n.name = id
+		if id == "" {
+			n.name = m.key
+			if parent != im.root {
+				n.name = parent.path() + "." + m.key
+			}
+		} else {
+			im.ids[id] = n
+		}
+
+		typ, err := n.str("type")
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case "history":
+			if parent == im.root {
+				return fmt.Errorf("%v: history states require a parent state", n)
+			}
+			h, err := n.str("history")
+			if err != nil {
+				return err
+			}
+			n.state = parent.state.History(n.name, h == "deep")
+			continue
+		case "", "atomic", "compound":
+			n.state = im.child(parent, n.name)
+		case "parallel":
+			n.state = im.child(parent, n.name).Parallel()
+		case "final":
+			n.state = im.child(parent, n.name).Final()
+		default:
+			return fmt.Errorf("%v: unsupported type %q", n, typ)
+		}
+		for key, add := range map[string]func(...string) *state.ChartState{"entry": n.state.OnEntry, "exit": n.state.OnExit} {
+			if raw, ok := n.config[key]; ok {
+				actions, err := im.actions(raw)
+				if err != nil {
+					return fmt.Errorf("%v: %s: %v", n, key, err)
+				}
+				add(actions...)
+			}
+		}
+		if err := im.states(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *node) path() string {
+	if n.parent == nil {
+		return ""
+	}
+	if p := n.parent.path(); p != "" {
+		return p + "." + n.key
+	}
+	return n.key
+}
+
+func (im *importer) child(parent *node, name string) *state.ChartState {
+	if parent == im.root {
+		return im.c.State(name)
+	}
+	return parent.state.State(name)
+}
+
+// behavior adds the initial states and transitions of the children of a
+// node, recursively; all states are known by now.
+func (im *importer) behavior(parent *node) error {
+	if initial, err := parent.str("initial"); err != nil {
+		return err
+	} else if initial != "" {
+		child := parent.children[initial]
+		if child == nil {
+			return fmt.Errorf("%v: initial state %q is not a child", parent, initial)
+		}
+		if parent == im.root {
+			im.c.Initial(child.name)
+		} else {
+			parent.state.Initial(child.name)
+		}
+	}
+	raw, _ := parent.config["states"]
+	ms, _ := members(raw)
+	for _, m := range ms {
+		n := parent.children[m.key]
+		if err := im.transitions(n); err != nil {
+			return err
+		}
+		if err := im.behavior(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) transitions(n *node) error {
+	if target, err := n.str("target"); err != nil {
+		return err
+	} else if target != "" {
+		t, err := im.resolve(n, target)
+		if err != nil {
+			return err
+		}
+		n.state.Initial(t.name) // default target of a history state
+	}
+	var wildcard []member
+	for _, m := range n.order {
+		var err error
+		switch m.key {
+		case "on":
+			var events []member
+			if events, err = members(m.value); err != nil {
+				break
+			}
+			for _, e := range events {
+				if e.key == "*" {
+					wildcard = append(wildcard, e) // lowest priority
+					continue
+				}
+				if strings.ContainsAny(e.key, " \t\n") {
+					return fmt.Errorf("%v: invalid event %q", n, e.key)
+				}
+				err = im.transition(n, state.ChartTransition{Event: e.key}, e.value)
+				if err != nil {
+					break
+				}
+			}
+		case "after":
+			var delays []member
+			if delays, err = members(m.value); err != nil {
+				break
+			}
+			for _, d := range delays {
+				delay, ok := im.b.Delays[d.key]
+				if !ok {
+					ms, perr := strconv.ParseUint(d.key, 10, 63)
+					if perr != nil || ms == 0 {
+						return fmt.Errorf("%v: after: unbound delay %q", n, d.key)
+					}
+					delay = time.Duration(ms) * time.Millisecond
+				}
+				if err = im.transition(n, state.ChartTransition{After: delay}, d.value); err != nil {
+					break
+				}
+			}
+		case "always":
+			err = im.transition(n, state.ChartTransition{}, m.value)
+		case "onDone":
+			err = im.transition(n, state.ChartTransition{Event: "done.state." + n.name}, m.value)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %s: %v", n, m.key, err)
+		}
+	}
+	for _, e := range wildcard {
+		if err := im.transition(n, state.ChartTransition{Event: "*"}, e.value); err != nil {
+			return fmt.Errorf("%v: on: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// transitionConfig is the object form of a transition.
+type transitionConfig struct {
+	Target   json.RawMessage `json:"target"`
+	Actions  json.RawMessage `json:"actions"`
+	Cond     json.RawMessage `json:"cond"`
+	Guard    json.RawMessage `json:"guard"`
+	In       string          `json:"in"`
+	Internal *bool           `json:"internal"`
+
+	Description string          `json:"description"`
+	Meta        json.RawMessage `json:"meta"`
+}
+
+// transition adds the transitions (a target, object or array of either) that
+// are configured for an event.
+func (im *importer) transition(n *node, t state.ChartTransition, raw json.RawMessage) error {
+	for _, item := range list(raw) {
+		var (
+			tc  transitionConfig
+			tgt string
+		)
+		if err := json.Unmarshal(item, &tgt); err != nil {
+			dec := json.NewDecoder(bytes.NewReader(item))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&tc); err != nil {
+				return err
+			}
+			if len(tc.Target) > 0 {
+				targets := list(tc.Target)
+				if len(targets) != 1 || json.Unmarshal(targets[0], &tgt) != nil {
+					return fmt.Errorf("multiple targets are not supported: %s", tc.Target)
+				}
+			}
+		}
+		t := t
+		if tgt != "" {
+			target, err := im.resolve(n, tgt)
+			if err != nil {
+				return err
+			}
+			t.Target = target.name
+			t.Local = strings.HasPrefix(tgt, ".")
+		}
+		if tc.Internal != nil {
+			t.Local = *tc.Internal
+		}
+		if len(tc.Actions) > 0 {
+			actions, err := im.actions(tc.Actions)
+			if err != nil {
+				return err
+			}
+			t.Actions = actions
+		}
+		for _, cond := range []json.RawMessage{tc.Cond, tc.Guard} {
+			if len(cond) == 0 {
+				continue
+			}
+			name, err := typeName(cond)
+			if err != nil {
+				return err
+			}
+			g := im.b.Guards[name]
+			if g == nil {
+				return fmt.Errorf("unbound guard %q", name)
+			}
+			im.c.Guard(name, g)
+			t.Guard = name
+		}
+		if tc.In != "" {
+			in, err := im.resolve(im.root, tc.In)
+			if err != nil {
+				return err
+			}
+			t.In = in.name
+		}
+		n.state.Transition(t)
+	}
+	return nil
+}
+
+// actions binds the named actions of an `entry`, `exit` or `actions` property.
+func (im *importer) actions(raw json.RawMessage) ([]string, error) {
+	var names []string
+	for _, item := range list(raw) {
+		name, err := typeName(item)
+		if err != nil {
+			return nil, err
+		}
+		a := im.b.Actions[name]
+		if a == nil {
+			return nil, fmt.Errorf("unbound action %q", name)
+		}
+		im.c.Action(name, a)
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// typeName decodes the name of an action or guard, given as a string or as an
+// object with a type.
+func typeName(raw json.RawMessage) (string, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return name, nil
+	}
+	var obj struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil || obj.Type == "" {
+		return "", fmt.Errorf("expected a name, found %s", raw)
+	}
+	return obj.Type, nil
+}
+
+// resolve returns the node that a target refers to, relative to the source
+// node: "#id.path" refers to a node by id (the machine's id, or that of a
+// state) and an optional path of keys, ".path" refers to a descendant of the
+// source, and "path" to a sibling of the source (or a descendant of one).
+func (im *importer) resolve(source *node, target string) (*node, error) {
+	var (
+		from *node
+		path string
+	)
+	switch {
+	case strings.HasPrefix(target, "#"):
+		id := target[1:]
+		// the longest prefix of the reference that's an id
+		for i := len(id); i > 0; i = strings.LastIndex(id[:i], ".") {
+			if n := im.ids[id[:i]]; n != nil {
+				from, path = n, strings.TrimPrefix(id[i:], ".")
+				break
+			}
+		}
+	case strings.HasPrefix(target, "."):
+		from, path = source, target[1:]
+	case source.parent != nil:
+		from, path = source.parent, target
+	default:
+		from, path = source, target
+	}
+	if from == nil {
+		return nil, fmt.Errorf("unknown target %q", target)
+	}
+	n := from
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			if n = n.children[key]; n == nil {
+				return nil, fmt.Errorf("unknown target %q", target)
+			}
+		}
+	}
+	if n == im.root {
+		return nil, fmt.Errorf("target %q refers to the machine", target)
+	}
+	return n, nil
+}
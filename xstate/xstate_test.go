@@ -0,0 +1,126 @@
+/*
+Copyright 2016 James DeFelice
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xstate_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdef/state"
+	"github.com/jdef/state/xstate"
+)
+
+var (
+	noop     = func(state.Context, *state.ChartMachine, state.Event) {}
+	never    = func(state.Event, interface{}) bool { return false }
+	bindings = xstate.Bindings{
+		Actions: map[string]state.Action{"a": noop, "b": noop, "c": noop},
+		Guards:  map[string]state.Guard{"g": never, "h": never},
+	}
+)
+
+func TestExport_roundTrip(t *testing.T) {
+	c := state.NewChart("m").Initial("top")
+	c.Action("a", noop).Action("b", noop).Action("c", noop).Guard("g", never).Guard("h", never)
+
+	top := c.State("top").Initial("top.work").OnEntry("a").OnExit("b", "c")
+	top.History("top.h", true).Initial("top.work.x")
+	work := top.State("top.work").Parallel()
+	x := work.State("top.work.x")
+	x.State("top.work.x.1").On("E F", "top.work.x.2").On("*", "", "c")
+	x.State("top.work.x.2").Final()
+	y := work.State("y")
+	y.State("y1").Transition(state.ChartTransition{Event: "G", Target: "y2", Guard: "g", In: "top.work.x.2"})
+	y.State("y2").Final()
+	work.On("done.state.top.work", "top.done")
+	top.State("top.done").
+		After(1500*time.Millisecond, "top.h").
+		Transition(state.ChartTransition{Target: "top.work", Guard: "h"}).
+		On("H", "top.work.x", "a")
+	top.Transition(state.ChartTransition{Event: "L", Target: "top.work", Local: true})
+	top.Transition(state.ChartTransition{Event: "R", Target: "top.done", Actions: []string{"a"}})
+	top.On("Q", "quit")
+	c.Choice("quit").When("g", "top").Else("end", "b")
+	c.State("end").Final()
+
+	data, err := xstate.Export(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := xstate.Parse(data, bindings)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+	data2, err := xstate.Export(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(data2) {
+		t.Fatalf("round trip changed the config:\n%s\n\n%s", data, data2)
+	}
+	for _, name := range []string{"top", "top.h", "top.work", "top.work.x.2", "y", "y2", "end"} {
+		if c2.Lookup(name) == nil {
+			t.Errorf("missing state %q", name)
+		}
+	}
+	tr := c2.Lookup("top").Transitions()
+	if len(tr) != 4 || !tr[0].Local || tr[1].Local || tr[2].Guard != "g" || tr[3].Target != "end" {
+		t.Errorf("unexpected transitions of top: %+v", tr)
+	}
+	// transitions are grouped by on, after and always
+	if tr := c2.Lookup("top.done").Transitions(); tr[1].After != 1500*time.Millisecond || tr[1].Target != "top.h" {
+		t.Errorf("unexpected delayed transition: %+v", tr[1])
+	}
+	if tr := c2.Lookup("y1").Transitions(); tr[0].In != "top.work.x.2" || tr[0].Guard != "g" {
+		t.Errorf("unexpected guarded transition: %+v", tr[0])
+	}
+}
+
+func TestParse_errors(t *testing.T) {
+	for _, tc := range []struct {
+		config, err string
+	}{
+		{`{"states": {"a": {"invoke": {"src": "x"}}}}`, `"invoke" is not supported`},
+		{`{"on": {"E": "a"}, "states": {"a": {}}}`, `not supported at the machine level`},
+		{`{"states": {"a": {"entry": "nope"}}}`, `unbound action "nope"`},
+		{`{"states": {"a": {"on": {"E": {"target": "a", "cond": "nope"}}}}}`, `unbound guard "nope"`},
+		{`{"states": {"a": {"on": {"E": "b"}}}}`, `unknown target "b"`},
+		{`{"states": {"a": {"on": {"E": {"target": ["a", "a"]}}}}}`, `multiple targets`},
+		{`{"states": {"a": {"after": {"soon": "a"}}}}`, `unbound delay "soon"`},
+		{`{"initial": "b", "states": {"a": {}}}`, `initial state "b" is not a child`},
+	} {
+		_, err := xstate.Parse([]byte(tc.config), bindings)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.config, tc.err, err)
+		}
+	}
+}
+
+func TestExport_errors(t *testing.T) {
+	c := state.NewChart("m").Initial("a.b")
+	c.State("a").State("a.b")
+	if _, err := xstate.Export(c); err == nil || !strings.Contains(err.Error(), "deep initial") {
+		t.Errorf("expected deep initial error, got %v", err)
+	}
+
+	c = state.NewChart("m")
+	c.State("a").After(time.Microsecond, "a")
+	if _, err := xstate.Export(c); err == nil || !strings.Contains(err.Error(), "milliseconds") {
+		t.Errorf("expected delay error, got %v", err)
+	}
+}